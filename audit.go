@@ -0,0 +1,267 @@
+package ipop
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/validate/v3"
+)
+
+// AuditTableName is the name of the table holding the audit log
+const AuditTableName = "ipop_audit"
+
+// AuditMigrations holds the fizz migration creating the audit table. Run it
+// with pop.NewMigrationBox, or copy it next to your own migrations.
+//
+//go:embed migrations/*_create_ipop_audit.*.fizz
+var AuditMigrations embed.FS
+
+// AuditEntry is a row of the audit table, recording one write of one model
+type AuditEntry struct {
+	// ID is given by the database in insertion order, it orders the entries
+	// written within the resolution of CreatedAt
+	ID        int64     `json:"id" db:"id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	Table     string    `json:"table_name" db:"table_name"`
+	RowID     string    `json:"row_id" db:"row_id"`
+	Op        ChangeOp  `json:"operation" db:"operation"`
+	Actor     string    `json:"actor" db:"actor"`
+	// Changes is the JSON encoding of the changed columns, see FieldChanges
+	Changes   string `json:"changes" db:"changes"`
+	RequestID string `json:"request_id" db:"request_id"`
+}
+
+// TableName maps AuditEntry onto the audit table
+func (AuditEntry) TableName() string {
+	return AuditTableName
+}
+
+// FieldChanges decodes the changed columns of the entry. Values come back
+// the way encoding/json decodes them into an interface{}.
+func (e AuditEntry) FieldChanges() (map[string]FieldChange, error) {
+	changes := map[string]FieldChange{}
+	if err := json.Unmarshal([]byte(e.Changes), &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID of the request being
+// served, which AuditedConnection records next to the actor.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID stored by WithRequestID, or an
+// empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// AuditedConnection decorates a Connection, writing an AuditEntry for every
+// Create, Update, Save, Upsert and Destroy made through it. The entry is
+// written in the same transaction as the change, a transaction being opened
+// when there is none, so the log can not miss a committed write.
+//
+// Set based writes (Query.UpdateAll, Query.DeleteAll) and raw SQL are not
+// audited.
+type AuditedConnection struct {
+	decorator
+	actor func(ctx context.Context) string
+}
+
+// Audited wraps conn so that writes made through it are audited. The actor
+// is read from the context of the connection, set it with WithContext.
+//
+//	audited := Audited(conn, func(ctx context.Context) string {
+//		return auth.UserFrom(ctx).Email
+//	})
+//	audited.WithContext(r.Context()).Update(&user)
+func Audited(conn Connection, actorFromContext func(ctx context.Context) string) *AuditedConnection {
+	c := &AuditedConnection{actor: actorFromContext}
+	c.decorator = decorator{Connection: conn, wrap: func(conn Connection) Connection {
+		return Audited(conn, actorFromContext)
+	}}
+	return c
+}
+
+// AuditHistory returns the audit entries of the row model is stored in,
+// oldest first, in the order they were written for equal timestamps.
+func AuditHistory(conn Connection, model interface{}) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := conn.Where("table_name = ? AND row_id = ?", modelTable(model), fmt.Sprint(modelID(model))).
+		Order("created_at, id").
+		All(&entries)
+	return entries, mapError(err, &AuditEntry{})
+}
+
+func (c *AuditedConnection) record(tx Connection, op ChangeOp, model interface{}, before map[interface{}]interface{}) error {
+	ctx := tx.Context()
+	actor := ""
+	if c.actor != nil {
+		actor = c.actor(ctx)
+	}
+
+	var err error
+	eachModel(model, func(m interface{}) {
+		if err != nil {
+			return
+		}
+		id := modelID(m)
+		var after interface{}
+		if op != ChangeDestroy {
+			after = m
+		}
+		var changes []byte
+		changes, err = json.Marshal(diffFields(before[id], after))
+		if err != nil {
+			return
+		}
+		err = tx.Create(&AuditEntry{
+			Table:     modelTable(m),
+			RowID:     fmt.Sprint(id),
+			Op:        op,
+			Actor:     actor,
+			Changes:   string(changes),
+			RequestID: RequestIDFromContext(ctx),
+		})
+	})
+	return err
+}
+
+// Create add a new given entry to the database, excluding the given columns,
+// and audits it.
+func (c *AuditedConnection) Create(model interface{}, excludeColumns ...string) error {
+	return c.Connection.Transaction(func(tx Connection) error {
+		if err := tx.Create(model, excludeColumns...); err != nil {
+			return err
+		}
+		return c.record(tx, ChangeCreate, model, nil)
+	})
+}
+
+// ValidateAndCreate applies validation rules on the given entry, then creates
+// it if the validation succeed, and audits it.
+func (c *AuditedConnection) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.Connection.Transaction(func(tx Connection) error {
+		var err error
+		verrs, err = tx.ValidateAndCreate(model, excludeColumns...)
+		if err != nil || verrs.HasAny() {
+			return err
+		}
+		return c.record(tx, ChangeCreate, model, nil)
+	})
+	return verrs, err
+}
+
+// Update writes changes from an entry to the database, excluding the given
+// columns, and audits them.
+func (c *AuditedConnection) Update(model interface{}, excludeColumns ...string) error {
+	return c.Connection.Transaction(func(tx Connection) error {
+		before := loadStored(tx, model)
+		if err := tx.Update(model, excludeColumns...); err != nil {
+			return err
+		}
+		return c.record(tx, ChangeUpdate, model, before)
+	})
+}
+
+// ValidateAndUpdate applies validation rules on the given entry, then update
+// it if the validation succeed, and audits the changes.
+func (c *AuditedConnection) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.Connection.Transaction(func(tx Connection) error {
+		before := loadStored(tx, model)
+		var err error
+		verrs, err = tx.ValidateAndUpdate(model, excludeColumns...)
+		if err != nil || verrs.HasAny() {
+			return err
+		}
+		return c.record(tx, ChangeUpdate, model, before)
+	})
+	return verrs, err
+}
+
+// Save wraps the Create and Update methods, auditing either.
+func (c *AuditedConnection) Save(model interface{}, excludeColumns ...string) error {
+	return c.Connection.Transaction(func(tx Connection) error {
+		created := map[interface{}]bool{}
+		eachModel(model, func(m interface{}) {
+			created[m] = hasZeroID(m)
+		})
+		before := loadStored(tx, model)
+		if err := tx.Save(model, excludeColumns...); err != nil {
+			return err
+		}
+		return c.recordSaved(tx, model, created, before)
+	})
+}
+
+// ValidateAndSave applies validation rules on the given entry, then save it
+// if the validation succeed, auditing either the creation or the update.
+func (c *AuditedConnection) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.Connection.Transaction(func(tx Connection) error {
+		created := map[interface{}]bool{}
+		eachModel(model, func(m interface{}) {
+			created[m] = hasZeroID(m)
+		})
+		before := loadStored(tx, model)
+		var err error
+		verrs, err = tx.ValidateAndSave(model, excludeColumns...)
+		if err != nil || verrs.HasAny() {
+			return err
+		}
+		return c.recordSaved(tx, model, created, before)
+	})
+	return verrs, err
+}
+
+func (c *AuditedConnection) recordSaved(tx Connection, model interface{}, created map[interface{}]bool, before map[interface{}]interface{}) error {
+	var err error
+	eachModel(model, func(m interface{}) {
+		if err != nil {
+			return
+		}
+		if created[m] {
+			err = c.record(tx, ChangeCreate, m, nil)
+		} else {
+			err = c.record(tx, ChangeUpdate, m, before)
+		}
+	})
+	return err
+}
+
+// Upsert inserts or updates the given entry, auditing a creation or an update
+// depending on whether a row matching the conflict columns existed.
+func (c *AuditedConnection) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	return c.Connection.Transaction(func(tx Connection) error {
+		before, existed := findByColumns(tx, model, conflictColumns)
+		if err := tx.Upsert(model, conflictColumns, updateColumns...); err != nil {
+			return err
+		}
+		if !existed {
+			return c.record(tx, ChangeCreate, model, nil)
+		}
+		return c.record(tx, ChangeUpdate, model, map[interface{}]interface{}{modelID(model): before})
+	})
+}
+
+// Destroy deletes a given entry from the database and audits it.
+func (c *AuditedConnection) Destroy(model interface{}) error {
+	return c.Connection.Transaction(func(tx Connection) error {
+		before := loadStored(tx, model)
+		if err := tx.Destroy(model); err != nil {
+			return err
+		}
+		return c.record(tx, ChangeDestroy, model, before)
+	})
+}
@@ -0,0 +1,451 @@
+package ipop
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+)
+
+// Budget limits the database work done within a scope, such as a request or
+// a test. Zero values mean no limit.
+type Budget struct {
+	// MaxQueries is the number of statements the scope may run
+	MaxQueries int
+	// MaxDuration is the total time the scope may spend in the database
+	MaxDuration time.Duration
+	// MaxRows is the total number of rows All may return within the scope
+	MaxRows int
+	// SlowQuery is the duration from which a statement is logged as slow,
+	// with its SQL, arguments and caller. The SQL of writes is rebuilt from
+	// the model, and marked as approximate
+	SlowQuery time.Duration
+	// Strict makes the connection return ErrBudgetExceeded once the budget is
+	// used up, rather than only logging it
+	Strict bool
+	// Logf receives the slow statements and budget overruns, it defaults to
+	// log.Printf
+	Logf func(format string, args ...interface{})
+}
+
+// BudgetUsage is the database work done within a scope so far
+type BudgetUsage struct {
+	Queries  int
+	Duration time.Duration
+	Rows     int
+}
+
+// BudgetedConnection decorates a Connection, measuring the statements made
+// through it against a Budget.
+//
+// Queries built with Where, Order and the like return a *pop.Query which is
+// not measured, hand them to Query to measure them too.
+type BudgetedConnection struct {
+	decorator
+	scope *budgetScope
+}
+
+type budgetScope struct {
+	budget Budget
+
+	mu    sync.Mutex
+	usage BudgetUsage
+}
+
+// WithBudget wraps conn and begins a scope limited by budget.
+//
+//	conn := WithBudget(db, Budget{MaxQueries: 20, SlowQuery: 100 * time.Millisecond})
+func WithBudget(conn Connection, budget Budget) *BudgetedConnection {
+	if budget.Logf == nil {
+		budget.Logf = log.Printf
+	}
+	return newBudgetedConnection(conn, &budgetScope{budget: budget})
+}
+
+func newBudgetedConnection(conn Connection, scope *budgetScope) *BudgetedConnection {
+	c := &BudgetedConnection{scope: scope}
+	c.decorator = decorator{Connection: conn, wrap: func(conn Connection) Connection {
+		return newBudgetedConnection(conn, scope)
+	}}
+	return c
+}
+
+// Begin returns a connection measured against a new scope with the same
+// budget, such as one per request.
+func (c *BudgetedConnection) Begin() *BudgetedConnection {
+	return newBudgetedConnection(c.Connection, &budgetScope{budget: c.scope.budget})
+}
+
+// Usage returns the work done within the scope so far
+func (c *BudgetedConnection) Usage() BudgetUsage {
+	c.scope.mu.Lock()
+	defer c.scope.mu.Unlock()
+	return c.scope.usage
+}
+
+// Query wraps a query built on the connection so that it is measured too.
+// Finish building the query first, the methods returning a new Query return
+// an unmeasured one.
+func (c *BudgetedConnection) Query(q *pop.Query) Query {
+	return &budgetedQuery{Query: NewQueryAdapter(q), q: q, conn: c}
+}
+
+// measure runs fn as one statement of the scope, described by stmt in the
+// slow query log. model is what op reads or writes.
+func (c *BudgetedConnection) measure(op string, stmt statement, model interface{}, fn func() error) error {
+	s := c.scope
+	if err := s.check(func(u BudgetUsage, b Budget) string {
+		if b.MaxQueries > 0 && u.Queries >= b.MaxQueries {
+			return fmt.Sprintf("more than %d queries", b.MaxQueries)
+		}
+		return ""
+	}); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+
+	rows := 0
+	if op == "all" && err == nil {
+		if v := reflect.Indirect(reflect.ValueOf(model)); v.Kind() == reflect.Slice {
+			rows = v.Len()
+		}
+	}
+
+	s.mu.Lock()
+	s.usage.Queries++
+	s.usage.Duration += elapsed
+	s.usage.Rows += rows
+	s.mu.Unlock()
+
+	if s.budget.SlowQuery > 0 && elapsed >= s.budget.SlowQuery {
+		sql, args := stmt()
+		s.budget.Logf("ipop: slow query (%s) %s %v at %s", elapsed, sql, args, caller())
+	}
+	if err != nil {
+		return err
+	}
+	return s.check(func(u BudgetUsage, b Budget) string {
+		if b.MaxDuration > 0 && u.Duration > b.MaxDuration {
+			return fmt.Sprintf("%s spent in the database, max %s", u.Duration, b.MaxDuration)
+		}
+		if b.MaxRows > 0 && u.Rows > b.MaxRows {
+			return fmt.Sprintf("%d rows returned by All, max %d", u.Rows, b.MaxRows)
+		}
+		return ""
+	})
+}
+
+// check reports the overrun found by over, as an error in strict mode and in
+// the log otherwise.
+func (s *budgetScope) check(over func(u BudgetUsage, b Budget) string) error {
+	s.mu.Lock()
+	msg := over(s.usage, s.budget)
+	s.mu.Unlock()
+	if msg == "" {
+		return nil
+	}
+	if s.budget.Strict {
+		return fmt.Errorf("%w: %s", ErrBudgetExceeded, msg)
+	}
+	s.budget.Logf("ipop: %s: %s at %s", ErrBudgetExceeded, msg, caller())
+	return nil
+}
+
+// statement returns the SQL of a measured call and its arguments. It is only
+// built for the slow query log.
+type statement func() (string, []interface{})
+
+// approximate starts the statements built from a model rather than by pop
+const approximate = "/* approximate */ "
+
+// describe returns a statement naming op and the table of model, for the
+// calls whose SQL can not be built.
+func describe(op string, model interface{}) statement {
+	return func() (string, []interface{}) {
+		return fmt.Sprintf("%s %s", op, modelTable(model)), nil
+	}
+}
+
+// selectStatement returns the SELECT q runs for model. A non nil id narrows
+// it to the row with that id, as Find and Reload do.
+func selectStatement(op string, q *pop.Query, model interface{}, id interface{}) statement {
+	if q == nil || q.Connection == nil {
+		return describe(op, model)
+	}
+	return func() (string, []interface{}) {
+		m := pop.NewModel(model, q.Connection.Context())
+		if id != nil {
+			// Where appends to the query, keep the one of the caller intact
+			cp := *q
+			q = cp.Where(m.WhereID(), id)
+		}
+		return q.ToSQL(m)
+	}
+}
+
+// writeStatement returns an approximation of the INSERT, UPDATE or DELETE pop
+// runs for op on model, marked as such in the log: it is built from the
+// writeable columns of model, less excludeColumns, with the values model
+// holds before the call as arguments, while pop sets the ID and timestamps
+// while running it. Upserts are described by their conflict and update
+// columns.
+func (c *BudgetedConnection) writeStatement(op string, model interface{}, excludeColumns, conflictColumns, updateColumns []string) statement {
+	conn := c.Connection.Q().Connection
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if conn == nil || v.Kind() != reflect.Struct {
+		return describe(op, model)
+	}
+	return func() (string, []interface{}) {
+		m := pop.NewModel(model, conn.Context())
+		table, id := conn.Dialect.Quote(m.TableName()), conn.Dialect.Quote(m.IDField())
+		if op == "save" {
+			op = "update"
+			if hasZeroID(model) {
+				op = "create"
+			}
+		}
+		if op == "destroy" {
+			return fmt.Sprintf("%sDELETE FROM %s WHERE %s = ?", approximate, table, id), []interface{}{modelID(model)}
+		}
+
+		cols := m.Columns()
+		cols.Remove(excludeColumns...)
+		if op == "update" {
+			cols.Remove(m.IDField(), createdAtColumn)
+		}
+		var names []string
+		for name := range cols.Writeable().Cols {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		quoted := make([]string, len(names))
+		args := make([]interface{}, len(names))
+		for i, name := range names {
+			quoted[i] = conn.Dialect.Quote(name)
+			args[i], _ = columnValue(model, name)
+		}
+
+		if op == "update" {
+			for i := range quoted {
+				quoted[i] += " = ?"
+			}
+			return fmt.Sprintf("%sUPDATE %s SET %s WHERE %s = ?", approximate, table, strings.Join(quoted, ", "), id),
+				append(args, modelID(model))
+		}
+		sql := fmt.Sprintf("%sINSERT INTO %s (%s) VALUES (%s)", approximate, table, strings.Join(quoted, ", "),
+			strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "))
+		if op == "upsert" {
+			sql += " " + upsertClause(conn.Dialect.Name(), conn.Dialect, conflictColumns, updateColumns)
+		}
+		return sql, args
+	}
+}
+
+// caller returns the file and line of the first caller outside this package,
+// test files excepted.
+func caller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, "github.com/kiihela/ipop.") &&
+			!strings.HasSuffix(frame.File, "_test.go")
+		if !internal || !more {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+	}
+}
+
+// Find the first record of the model in the database with a particular id.
+func (c *BudgetedConnection) Find(model interface{}, id interface{}) error {
+	return c.measure("find", selectStatement("find", c.Connection.Q(), model, id), model, func() error {
+		return c.Connection.Find(model, id)
+	})
+}
+
+// First record of the model in the database that matches the query.
+func (c *BudgetedConnection) First(model interface{}) error {
+	return c.measure("first", selectStatement("first", c.Connection.Q(), model, nil), model, func() error {
+		return c.Connection.First(model)
+	})
+}
+
+// Last record of the model in the database that matches the query.
+func (c *BudgetedConnection) Last(model interface{}) error {
+	return c.measure("last", selectStatement("last", c.Connection.Q(), model, nil), model, func() error {
+		return c.Connection.Last(model)
+	})
+}
+
+// All retrieves all of the records in the database that match the query.
+func (c *BudgetedConnection) All(models interface{}) error {
+	return c.measure("all", selectStatement("all", c.Connection.Q(), models, nil), models, func() error {
+		return c.Connection.All(models)
+	})
+}
+
+// Count the number of records in the database.
+func (c *BudgetedConnection) Count(model interface{}) (int, error) {
+	var count int
+	err := c.measure("count", selectStatement("count", c.Connection.Q(), model, nil), model, func() error {
+		var err error
+		count, err = c.Connection.Count(model)
+		return err
+	})
+	return count, err
+}
+
+// Reload fetch fresh data for a given model, using its ID.
+func (c *BudgetedConnection) Reload(model interface{}) error {
+	return c.measure("reload", selectStatement("reload", c.Connection.Q(), model, modelID(model)), model, func() error {
+		return c.Connection.Reload(model)
+	})
+}
+
+// Load loads all association or the fields specified in params for
+// an already loaded model.
+func (c *BudgetedConnection) Load(model interface{}, fields ...string) error {
+	return c.measure("load", describe("load", model), model, func() error {
+		return c.Connection.Load(model, fields...)
+	})
+}
+
+// Create add a new given entry to the database, excluding the given columns.
+func (c *BudgetedConnection) Create(model interface{}, excludeColumns ...string) error {
+	return c.measure("create", c.writeStatement("create", model, excludeColumns, nil, nil), model, func() error {
+		return c.Connection.Create(model, excludeColumns...)
+	})
+}
+
+// ValidateAndCreate applies validation rules on the given entry, then creates it
+// if the validation succeed, excluding the given columns.
+func (c *BudgetedConnection) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.measure("create", c.writeStatement("create", model, excludeColumns, nil, nil), model, func() error {
+		var err error
+		verrs, err = c.Connection.ValidateAndCreate(model, excludeColumns...)
+		return err
+	})
+	return verrs, err
+}
+
+// Update writes changes from an entry to the database, excluding the given columns.
+func (c *BudgetedConnection) Update(model interface{}, excludeColumns ...string) error {
+	return c.measure("update", c.writeStatement("update", model, excludeColumns, nil, nil), model, func() error {
+		return c.Connection.Update(model, excludeColumns...)
+	})
+}
+
+// ValidateAndUpdate applies validation rules on the given entry, then update it
+// if the validation succeed, excluding the given columns.
+func (c *BudgetedConnection) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.measure("update", c.writeStatement("update", model, excludeColumns, nil, nil), model, func() error {
+		var err error
+		verrs, err = c.Connection.ValidateAndUpdate(model, excludeColumns...)
+		return err
+	})
+	return verrs, err
+}
+
+// Save wraps the Create and Update methods. It executes a Create if no ID is provided with the entry;
+// or issues an Update otherwise.
+func (c *BudgetedConnection) Save(model interface{}, excludeColumns ...string) error {
+	return c.measure("save", c.writeStatement("save", model, excludeColumns, nil, nil), model, func() error {
+		return c.Connection.Save(model, excludeColumns...)
+	})
+}
+
+// ValidateAndSave applies validation rules on the given entry, then save it
+// if the validation succeed, excluding the given columns.
+func (c *BudgetedConnection) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.measure("save", c.writeStatement("save", model, excludeColumns, nil, nil), model, func() error {
+		var err error
+		verrs, err = c.Connection.ValidateAndSave(model, excludeColumns...)
+		return err
+	})
+	return verrs, err
+}
+
+// Upsert inserts the given entry, or updates the row it conflicts with.
+func (c *BudgetedConnection) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	return c.measure("upsert", c.writeStatement("upsert", model, nil, conflictColumns, updateColumns), model, func() error {
+		return c.Connection.Upsert(model, conflictColumns, updateColumns...)
+	})
+}
+
+// Destroy deletes a given entry from the database.
+func (c *BudgetedConnection) Destroy(model interface{}) error {
+	return c.measure("destroy", c.writeStatement("destroy", model, nil, nil, nil), model, func() error {
+		return c.Connection.Destroy(model)
+	})
+}
+
+// budgetedQuery is the Query returned by BudgetedConnection.Query
+type budgetedQuery struct {
+	Query
+	q    *pop.Query
+	conn *BudgetedConnection
+}
+
+// Find the first record of the model in the database with a particular id.
+func (q *budgetedQuery) Find(model interface{}, id interface{}) error {
+	return q.conn.measure("find", selectStatement("find", q.q, model, id), model, func() error {
+		return q.Query.Find(model, id)
+	})
+}
+
+// First record of the model in the database that matches the query.
+func (q *budgetedQuery) First(model interface{}) error {
+	return q.conn.measure("first", selectStatement("first", q.q, model, nil), model, func() error {
+		return q.Query.First(model)
+	})
+}
+
+// Last record of the model in the database that matches the query.
+func (q *budgetedQuery) Last(model interface{}) error {
+	return q.conn.measure("last", selectStatement("last", q.q, model, nil), model, func() error {
+		return q.Query.Last(model)
+	})
+}
+
+// All retrieves all of the records in the database that match the query.
+func (q *budgetedQuery) All(models interface{}) error {
+	return q.conn.measure("all", selectStatement("all", q.q, models, nil), models, func() error {
+		return q.Query.All(models)
+	})
+}
+
+// Exists returns true/false if a record exists in the database that matches
+// the query.
+func (q *budgetedQuery) Exists(model interface{}) (bool, error) {
+	var exists bool
+	err := q.conn.measure("exists", selectStatement("exists", q.q, model, nil), model, func() error {
+		var err error
+		exists, err = q.Query.Exists(model)
+		return err
+	})
+	return exists, err
+}
+
+// Count the number of records in the database.
+func (q *budgetedQuery) Count(model interface{}) (int, error) {
+	var count int
+	err := q.conn.measure("count", selectStatement("count", q.q, model, nil), model, func() error {
+		var err error
+		count, err = q.Query.Count(model)
+		return err
+	})
+	return count, err
+}
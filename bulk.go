@@ -0,0 +1,120 @@
+package ipop
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// updateAll runs an UPDATE on the rows of model's table selected by q.
+func updateAll(q *pop.Query, model interface{}, values map[string]interface{}, allowFullTable bool) (int, error) {
+	if len(values) == 0 {
+		return 0, errors.New("no values to update")
+	}
+
+	m := pop.NewModel(model, q.Connection.Context())
+	if _, ok := m.Columns().Cols[updatedAtColumn]; ok {
+		if _, set := values[updatedAtColumn]; !set {
+			withTimestamp := make(map[string]interface{}, len(values)+1)
+			for k, v := range values {
+				withTimestamp[k] = v
+			}
+			withTimestamp[updatedAtColumn] = time.Now().Truncate(time.Microsecond)
+			values = withTimestamp
+		}
+	}
+
+	where, whereArgs, err := selectedIDs(q, m, allowFullTable)
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Postgres style placeholders are numbered, so the SET arguments come
+	// after the ones already used by the sub-select. Everywhere else the
+	// arguments follow the order of the statement text.
+	numbered := usesNumberedPlaceholders(q.Connection)
+	sets := make([]string, 0, len(names))
+	setArgs := make([]interface{}, 0, len(names))
+	for i, name := range names {
+		placeholder := "?"
+		if numbered {
+			placeholder = fmt.Sprintf("$%d", len(whereArgs)+i+1)
+		}
+		sets = append(sets, fmt.Sprintf("%s = %s", q.Connection.Dialect.Quote(name), placeholder))
+		setArgs = append(setArgs, values[name])
+	}
+
+	var args []interface{}
+	if numbered {
+		args = append(whereArgs, setArgs...)
+	} else {
+		args = append(setArgs, whereArgs...)
+	}
+
+	stmt := fmt.Sprintf("UPDATE %s SET %s WHERE %s", q.Connection.Dialect.Quote(m.TableName()), strings.Join(sets, ", "), where)
+	return q.Connection.RawQuery(stmt, args...).ExecWithCount()
+}
+
+// deleteAll runs a DELETE on the rows of model's table selected by q.
+func deleteAll(q *pop.Query, model interface{}, allowFullTable bool) (int, error) {
+	m := pop.NewModel(model, q.Connection.Context())
+	where, args, err := selectedIDs(q, m, allowFullTable)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE %s", q.Connection.Dialect.Quote(m.TableName()), where)
+	return q.Connection.RawQuery(stmt, args...).ExecWithCount()
+}
+
+// selectedIDs turns the query into a condition matching the IDs it selects,
+// which keeps the where, join and limit clauses working for every dialect.
+// The sub-select is wrapped in a derived table since MySQL can neither
+// select from the table it modifies nor use LIMIT inside IN.
+func selectedIDs(q *pop.Query, m *pop.Model, allowFullTable bool) (string, []interface{}, error) {
+	if q.RawSQL != nil && q.RawSQL.Fragment != "" {
+		return "", nil, errors.New("set based operations can not be used with a raw query")
+	}
+
+	if !allowFullTable && !hasWhereClause(q, m) {
+		return "", nil, ErrFullTable
+	}
+	sub, args := q.ToSQL(m, fmt.Sprintf("%s.%s", m.Alias(), m.IDField()))
+
+	id := q.Connection.Dialect.Quote(m.IDField())
+	return fmt.Sprintf("%s IN (SELECT ipop_ids.%s FROM (%s) AS ipop_ids)", id, id, sub), args, nil
+}
+
+// hasWhereClause reports whether q has where clauses of its own. pop does not
+// expose them, so a probe clause is added to a copy of q and looked for in
+// its SQL: it follows the clauses of q, and comes first otherwise, before
+// those of BelongsToThrough. Join clauses or string literals holding the
+// word WHERE do not fool it.
+func hasWhereClause(q *pop.Query, m *pop.Model) bool {
+	const probe = "ipop_where_probe"
+	cp := *q
+	sql, _ := cp.Where(probe).ToSQL(m)
+	if strings.Contains(sql, " AND "+probe) {
+		return true
+	}
+	i := strings.Index(sql, " WHERE "+probe)
+	return i >= 0 && strings.HasPrefix(sql[i+len(" WHERE "+probe):], " AND ")
+}
+
+func usesNumberedPlaceholders(conn *pop.Connection) bool {
+	switch conn.Dialect.Name() {
+	case "postgres", "cockroach":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,454 @@
+package ipop
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+)
+
+// CacheStats counts the lookups of a CachingConnection
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// CachingConnection decorates a Connection, caching the results of Find,
+// First, Last, All and Count. Any write made through it drops, once the write
+// is committed, the cached results of every query reading the table written
+// to: the table of the model, the tables joined and those of FROM clauses.
+// Queries whose tables can not be told, such as raw SQL, BelongsToThrough or
+// conditions holding a subquery, are dropped by any write.
+//
+// The cache is bypassed inside transactions and on Eager connections.
+// Queries built with Where, Order and the like return a *pop.Query which is
+// not cached, hand them to Query to cache their results. Writes made by raw
+// SQL, or by other connections, are not seen and only expire with the cache.
+type CachingConnection struct {
+	decorator
+	state  *cacheState
+	bypass bool
+}
+
+type cacheState struct {
+	cache Cache
+
+	mu          sync.Mutex
+	epoch       uint64
+	generations map[string]uint64
+	// writes counts the invalidations of any table, for the queries whose
+	// tables are not known
+	writes uint64
+
+	hits   uint64
+	misses uint64
+}
+
+// NewCachingConnection wraps conn so that its reads are served from cache.
+// A nil cache defaults to an LRUCache of 1000 entries kept for a minute.
+func NewCachingConnection(conn Connection, cache Cache) *CachingConnection {
+	if cache == nil {
+		cache = NewLRUCache(1000, time.Minute)
+	}
+	return newCachingConnection(conn, &cacheState{cache: cache, generations: map[string]uint64{}}, false)
+}
+
+func newCachingConnection(conn Connection, state *cacheState, bypass bool) *CachingConnection {
+	c := &CachingConnection{state: state, bypass: bypass}
+	c.decorator = decorator{
+		Connection: conn,
+		wrap: func(conn Connection) Connection {
+			return newCachingConnection(conn, state, bypass)
+		},
+		wrapTx: func(tx Connection) Connection {
+			return newCachingConnection(tx, state, true)
+		},
+	}
+	return c
+}
+
+// Stats returns the number of lookups served from and missing the cache
+func (c *CachingConnection) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.state.hits),
+		Misses: atomic.LoadUint64(&c.state.misses),
+	}
+}
+
+// Invalidate drops the cached results of the given tables, or of every
+// table when none is given. Use it after writing outside of the connection.
+func (c *CachingConnection) Invalidate(tables ...string) {
+	c.state.invalidate(tables...)
+}
+
+// Query wraps a query built on the connection so that its results are cached
+// too. Finish building the query first, the methods returning a new Query
+// return an uncached one.
+//
+//	c.Query(c.Where("name = ?", "mark").Order("created_at")).All(&users)
+func (c *CachingConnection) Query(q *pop.Query) Query {
+	return &cachedQuery{Query: NewQueryAdapter(q), q: q, conn: c}
+}
+
+func (s *cacheState) invalidate(tables ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(tables) == 0 {
+		s.epoch++
+		return
+	}
+	s.writes++
+	for _, t := range tables {
+		s.generations[t]++
+	}
+}
+
+// key returns the cache key of a query reading tables, which are nil when not
+// known. It changes whenever one of them is invalidated.
+func (s *cacheState) key(tables []string, op, sql string, args []interface{}) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gens := fmt.Sprintf("*.%d", s.writes)
+	if tables != nil {
+		parts := make([]string, len(tables))
+		for i, t := range tables {
+			parts[i] = fmt.Sprintf("%s.%d", t, s.generations[t])
+		}
+		gens = strings.Join(parts, ",")
+	}
+	return fmt.Sprintf("%d|%s|%s|%s|%v", s.epoch, gens, op, sql, args)
+}
+
+// readTables returns the tables q reads for a model stored in table, or nil
+// when they can not be told from its clauses. The clauses are read from the
+// unexported fields of pop.Query, ok is false when those are not found, as
+// after a change of pop.
+func readTables(q *pop.Query, table string) (tables []string, ok bool) {
+	if q.RawSQL != nil && q.RawSQL.Fragment != "" {
+		return nil, true
+	}
+	v := reflect.ValueOf(q).Elem()
+	clauses := map[string][]string{}
+	for name, field := range map[string]string{
+		"belongsToThroughClauses": "",
+		"whereClauses":            "Fragment",
+		"havingClauses":           "Fragment",
+		"joinClauses":             "Table",
+		"fromClauses":             "From",
+	} {
+		list := v.FieldByName(name)
+		if !list.IsValid() || list.Kind() != reflect.Slice {
+			return nil, false
+		}
+		for i := 0; i < list.Len(); i++ {
+			if field == "" {
+				clauses[name] = append(clauses[name], "")
+				continue
+			}
+			value := reflect.Indirect(list.Index(i))
+			if value.Kind() != reflect.Struct {
+				return nil, false
+			}
+			f := value.FieldByName(field)
+			if !f.IsValid() || f.Kind() != reflect.String {
+				return nil, false
+			}
+			clauses[name] = append(clauses[name], f.String())
+		}
+	}
+
+	if len(clauses["belongsToThroughClauses"]) > 0 {
+		return nil, true
+	}
+	for _, fragment := range append(clauses["whereClauses"], clauses["havingClauses"]...) {
+		if strings.Contains(strings.ToUpper(fragment), "SELECT") {
+			return nil, true
+		}
+	}
+	tables = []string{table}
+	for _, join := range clauses["joinClauses"] {
+		tables = append(tables, clauseTable(join))
+	}
+	for _, from := range clauses["fromClauses"] {
+		tables = append(tables, clauseTable(from))
+	}
+	return tables, true
+}
+
+// clauseTable strips the alias and quotes off a table of a join or FROM clause.
+func clauseTable(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		s = fields[0]
+	}
+	return strings.Trim(s, "`\"[]")
+}
+
+// read serves dest from the cache when possible, calling load and storing
+// its result otherwise. The key is made of the SQL q builds for model.
+func (c *CachingConnection) read(q *pop.Query, op string, model, dest interface{}, extra []interface{}, load func() error) error {
+	if c.bypass || q == nil || q.Connection == nil {
+		return load()
+	}
+	m := pop.NewModel(model, c.Context())
+	tables, ok := readTables(q, m.TableName())
+	if !ok {
+		return load()
+	}
+	sql, args := q.ToSQL(m)
+	key := c.state.key(tables, op, sql, append(args, extra...))
+
+	if v, ok := c.state.cache.Get(key); ok && restoreCached(dest, v) {
+		atomic.AddUint64(&c.state.hits, 1)
+		return nil
+	}
+	atomic.AddUint64(&c.state.misses, 1)
+	if err := load(); err != nil {
+		return err
+	}
+	c.state.cache.Set(key, copyCached(dest))
+	return nil
+}
+
+// written drops the cached results of the tables of model once the current
+// transaction, if any, commits.
+func (c *CachingConnection) written(model interface{}) {
+	tables := []string{}
+	eachModel(model, func(m interface{}) {
+		tables = append(tables, modelTable(m))
+	})
+	c.Connection.AfterCommit(func() {
+		c.state.invalidate(tables...)
+	})
+}
+
+// copyCached returns a copy of what model points to, detached from model.
+func copyCached(model interface{}) interface{} {
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if v.Kind() == reflect.Slice {
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(cp, v)
+		return cp.Interface()
+	}
+	return v.Interface()
+}
+
+// restoreCached copies a cached value into dest, reporting false when they
+// do not have the same type.
+func restoreCached(dest interface{}, value interface{}) bool {
+	dst := reflect.ValueOf(dest)
+	src := reflect.ValueOf(value)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() || !src.IsValid() || src.Type() != dst.Elem().Type() {
+		return false
+	}
+	if src.Kind() == reflect.Slice {
+		cp := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		reflect.Copy(cp, src)
+		src = cp
+	}
+	dst.Elem().Set(src)
+	return true
+}
+
+// Find the first record of the model in the database with a particular id.
+//
+//	c.Find(&User{}, 1)
+func (c *CachingConnection) Find(model interface{}, id interface{}) error {
+	return c.read(c.Connection.Q(), "find", model, model, []interface{}{id}, func() error {
+		return c.Connection.Find(model, id)
+	})
+}
+
+// First record of the model in the database that matches the query.
+//
+//	c.First(&User{})
+func (c *CachingConnection) First(model interface{}) error {
+	return c.read(c.Connection.Q(), "first", model, model, nil, func() error {
+		return c.Connection.First(model)
+	})
+}
+
+// Last record of the model in the database that matches the query.
+//
+//	c.Last(&User{})
+func (c *CachingConnection) Last(model interface{}) error {
+	return c.read(c.Connection.Q(), "last", model, model, nil, func() error {
+		return c.Connection.Last(model)
+	})
+}
+
+// All retrieves all of the records in the database that match the query.
+//
+//	c.All(&[]User{})
+func (c *CachingConnection) All(models interface{}) error {
+	return c.read(c.Connection.Q(), "all", models, models, nil, func() error {
+		return c.Connection.All(models)
+	})
+}
+
+// Count the number of records in the database.
+//
+//	c.Count(&User{})
+func (c *CachingConnection) Count(model interface{}) (int, error) {
+	var count int
+	err := c.read(c.Connection.Q(), "count", model, &count, nil, func() error {
+		var err error
+		count, err = c.Connection.Count(model)
+		return err
+	})
+	return count, err
+}
+
+// Create add a new given entry to the database, excluding the given columns.
+func (c *CachingConnection) Create(model interface{}, excludeColumns ...string) error {
+	defer c.written(model)
+	return c.Connection.Create(model, excludeColumns...)
+}
+
+// ValidateAndCreate applies validation rules on the given entry, then creates it
+// if the validation succeed, excluding the given columns.
+func (c *CachingConnection) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	defer c.written(model)
+	return c.Connection.ValidateAndCreate(model, excludeColumns...)
+}
+
+// Update writes changes from an entry to the database, excluding the given columns.
+func (c *CachingConnection) Update(model interface{}, excludeColumns ...string) error {
+	defer c.written(model)
+	return c.Connection.Update(model, excludeColumns...)
+}
+
+// ValidateAndUpdate applies validation rules on the given entry, then update it
+// if the validation succeed, excluding the given columns.
+func (c *CachingConnection) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	defer c.written(model)
+	return c.Connection.ValidateAndUpdate(model, excludeColumns...)
+}
+
+// Save wraps the Create and Update methods. It executes a Create if no ID is provided with the entry;
+// or issues an Update otherwise.
+func (c *CachingConnection) Save(model interface{}, excludeColumns ...string) error {
+	defer c.written(model)
+	return c.Connection.Save(model, excludeColumns...)
+}
+
+// ValidateAndSave applies validation rules on the given entry, then save it
+// if the validation succeed, excluding the given columns.
+func (c *CachingConnection) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	defer c.written(model)
+	return c.Connection.ValidateAndSave(model, excludeColumns...)
+}
+
+// Upsert inserts the given entry, or updates the row it conflicts with.
+func (c *CachingConnection) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	defer c.written(model)
+	return c.Connection.Upsert(model, conflictColumns, updateColumns...)
+}
+
+// Destroy deletes a given entry from the database.
+func (c *CachingConnection) Destroy(model interface{}) error {
+	defer c.written(model)
+	return c.Connection.Destroy(model)
+}
+
+// TruncateAll truncates all data from the datasource, dropping the whole cache.
+func (c *CachingConnection) TruncateAll() error {
+	defer c.Connection.AfterCommit(func() { c.state.invalidate() })
+	return c.Connection.TruncateAll()
+}
+
+// Eager will enable load associations of the model. Eager connections are
+// never served from cache.
+func (c *CachingConnection) Eager(fields ...string) Connection {
+	return newCachingConnection(c.Connection.Eager(fields...), c.state, true)
+}
+
+// cachedQuery is the Query returned by CachingConnection.Query
+type cachedQuery struct {
+	Query
+	q    *pop.Query
+	conn *CachingConnection
+}
+
+// Find the first record of the model in the database with a particular id.
+func (q *cachedQuery) Find(model interface{}, id interface{}) error {
+	return q.conn.read(q.q, "find", model, model, []interface{}{id}, func() error {
+		return q.Query.Find(model, id)
+	})
+}
+
+// First record of the model in the database that matches the query.
+func (q *cachedQuery) First(model interface{}) error {
+	return q.conn.read(q.q, "first", model, model, nil, func() error {
+		return q.Query.First(model)
+	})
+}
+
+// Last record of the model in the database that matches the query.
+func (q *cachedQuery) Last(model interface{}) error {
+	return q.conn.read(q.q, "last", model, model, nil, func() error {
+		return q.Query.Last(model)
+	})
+}
+
+// All retrieves all of the records in the database that match the query.
+func (q *cachedQuery) All(models interface{}) error {
+	return q.conn.read(q.q, "all", models, models, nil, func() error {
+		return q.Query.All(models)
+	})
+}
+
+// Exists returns true/false if a record exists in the database that matches
+// the query.
+func (q *cachedQuery) Exists(model interface{}) (bool, error) {
+	var exists bool
+	err := q.conn.read(q.q, "exists", model, &exists, nil, func() error {
+		var err error
+		exists, err = q.Query.Exists(model)
+		return err
+	})
+	return exists, err
+}
+
+// Count the number of records in the database.
+func (q *cachedQuery) Count(model interface{}) (int, error) {
+	var count int
+	err := q.conn.read(q.q, "count", model, &count, nil, func() error {
+		var err error
+		count, err = q.Query.Count(model)
+		return err
+	})
+	return count, err
+}
+
+// UpdateAll sets the given column values on every row matched by the query
+// and drops the cached results of the model's table.
+func (q *cachedQuery) UpdateAll(model interface{}, values map[string]interface{}) (int, error) {
+	defer q.conn.written(model)
+	return q.Query.UpdateAll(model, values)
+}
+
+// DeleteAll deletes every row matched by the query and drops the cached
+// results of the model's table.
+func (q *cachedQuery) DeleteAll(model interface{}) (int, error) {
+	defer q.conn.written(model)
+	return q.Query.DeleteAll(model)
+}
+
+// Exec runs the given query, dropping the whole cache as the tables written
+// to are not known.
+func (q *cachedQuery) Exec() error {
+	defer q.conn.Connection.AfterCommit(func() { q.conn.state.invalidate() })
+	return q.Query.Exec()
+}
+
+// ExecWithCount runs the given query, and returns the amount of affected
+// rows, dropping the whole cache as the tables written to are not known.
+func (q *cachedQuery) ExecWithCount() (int, error) {
+	defer q.conn.Connection.AfterCommit(func() { q.conn.state.invalidate() })
+	return q.Query.ExecWithCount()
+}
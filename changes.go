@@ -0,0 +1,255 @@
+package ipop
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/gobuffalo/validate/v3"
+)
+
+// ChangeOp is the kind of write a ChangeEvent describes
+type ChangeOp string
+
+const (
+	// ChangeCreate is emitted when a row is inserted
+	ChangeCreate ChangeOp = "create"
+	// ChangeUpdate is emitted when a row is updated
+	ChangeUpdate ChangeOp = "update"
+	// ChangeDestroy is emitted when a row is deleted
+	ChangeDestroy ChangeOp = "destroy"
+)
+
+// FieldChange holds the old and new value of a column
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// ChangeEvent describes a single row written through a ChangeStream
+type ChangeEvent struct {
+	Op    ChangeOp
+	Table string
+	ID    interface{}
+	// Before is a copy of the row as it was, nil for ChangeCreate
+	Before interface{}
+	// After is a copy of the row as written, nil for ChangeDestroy
+	After interface{}
+	// Changes holds the columns, by `db` tag, whose value differs
+	// between Before and After
+	Changes map[string]FieldChange
+}
+
+// ChangeStream decorates a Connection, emitting a ChangeEvent to its
+// subscribers for every Create, Update, Save, Upsert and Destroy made
+// through it. Writes made inside a transaction are delivered once the
+// outermost transaction commits, and dropped when it rolls back.
+//
+// Set based writes (Query.UpdateAll, Query.DeleteAll) and raw SQL are not
+// seen. Updates and deletes read the row first to fill in Before.
+type ChangeStream struct {
+	decorator
+	subs *subscribers
+}
+
+type subscribers struct {
+	mu   sync.RWMutex
+	next int
+	fns  map[int]func(ChangeEvent)
+}
+
+// list returns the subscribers in subscription order. They are called
+// without holding the lock, so that they can subscribe and unsubscribe.
+func (s *subscribers) list() []func(ChangeEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]int, 0, len(s.fns))
+	for id := range s.fns {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	fns := make([]func(ChangeEvent), len(ids))
+	for i, id := range ids {
+		fns[i] = s.fns[id]
+	}
+	return fns
+}
+
+// NewChangeStream wraps conn so that writes made through it are emitted
+//
+//	stream := NewChangeStream(conn)
+//	stream.Subscribe(func(ev ChangeEvent) { index.Update(ev) })
+func NewChangeStream(conn Connection) *ChangeStream {
+	return newChangeStream(conn, &subscribers{fns: map[int]func(ChangeEvent){}})
+}
+
+func newChangeStream(conn Connection, subs *subscribers) *ChangeStream {
+	c := &ChangeStream{subs: subs}
+	c.decorator = decorator{Connection: conn, wrap: func(conn Connection) Connection {
+		return newChangeStream(conn, subs)
+	}}
+	return c
+}
+
+// Subscribe registers fn to receive every committed change and returns a
+// function removing it again. fn is called synchronously, in the goroutine
+// that committed the change.
+func (c *ChangeStream) Subscribe(fn func(ChangeEvent)) (unsubscribe func()) {
+	c.subs.mu.Lock()
+	defer c.subs.mu.Unlock()
+	id := c.subs.next
+	c.subs.next++
+	c.subs.fns[id] = fn
+	return func() {
+		c.subs.mu.Lock()
+		defer c.subs.mu.Unlock()
+		delete(c.subs.fns, id)
+	}
+}
+
+func (c *ChangeStream) publish(ev ChangeEvent) {
+	c.Connection.AfterCommit(func() {
+		for _, fn := range c.subs.list() {
+			fn(ev)
+		}
+	})
+}
+
+func (c *ChangeStream) emit(op ChangeOp, model interface{}, before map[interface{}]interface{}) {
+	eachModel(model, func(m interface{}) {
+		ev := ChangeEvent{Op: op, Table: modelTable(m), ID: modelID(m)}
+		if op != ChangeCreate {
+			ev.Before = before[ev.ID]
+		}
+		if op != ChangeDestroy {
+			ev.After = snapshot(m)
+		}
+		ev.Changes = diffFields(ev.Before, ev.After)
+		c.publish(ev)
+	})
+}
+
+// diffFields compares two rows column by column.
+func diffFields(before, after interface{}) map[string]FieldChange {
+	b, a := dbFields(before), dbFields(after)
+	changes := map[string]FieldChange{}
+	for name, av := range a {
+		bv, ok := b[name]
+		if !ok || !sameValue(av, bv) {
+			changes[name] = FieldChange{Before: bv, After: av}
+		}
+	}
+	for name, bv := range b {
+		if _, ok := a[name]; !ok {
+			changes[name] = FieldChange{Before: bv}
+		}
+	}
+	return changes
+}
+
+// Create add a new given entry to the database, excluding the given columns,
+// and emits a ChangeCreate event.
+func (c *ChangeStream) Create(model interface{}, excludeColumns ...string) error {
+	if err := c.Connection.Create(model, excludeColumns...); err != nil {
+		return err
+	}
+	c.emit(ChangeCreate, model, nil)
+	return nil
+}
+
+// ValidateAndCreate applies validation rules on the given entry, then creates
+// it if the validation succeed, emitting a ChangeCreate event.
+func (c *ChangeStream) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	verrs, err := c.Connection.ValidateAndCreate(model, excludeColumns...)
+	if err == nil && !verrs.HasAny() {
+		c.emit(ChangeCreate, model, nil)
+	}
+	return verrs, err
+}
+
+// Update writes changes from an entry to the database, excluding the given
+// columns, and emits a ChangeUpdate event.
+func (c *ChangeStream) Update(model interface{}, excludeColumns ...string) error {
+	before := loadStored(c.Connection, model)
+	if err := c.Connection.Update(model, excludeColumns...); err != nil {
+		return err
+	}
+	c.emit(ChangeUpdate, model, before)
+	return nil
+}
+
+// ValidateAndUpdate applies validation rules on the given entry, then update
+// it if the validation succeed, emitting a ChangeUpdate event.
+func (c *ChangeStream) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	before := loadStored(c.Connection, model)
+	verrs, err := c.Connection.ValidateAndUpdate(model, excludeColumns...)
+	if err == nil && !verrs.HasAny() {
+		c.emit(ChangeUpdate, model, before)
+	}
+	return verrs, err
+}
+
+// Save wraps the Create and Update methods, emitting the matching event.
+func (c *ChangeStream) Save(model interface{}, excludeColumns ...string) error {
+	var err error
+	eachModel(model, func(m interface{}) {
+		if err != nil {
+			return
+		}
+		if hasZeroID(m) {
+			err = c.Create(m, excludeColumns...)
+		} else {
+			err = c.Update(m, excludeColumns...)
+		}
+	})
+	return err
+}
+
+// ValidateAndSave applies validation rules on the given entry, then save it
+// if the validation succeed, emitting the matching event.
+func (c *ChangeStream) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	created := map[interface{}]bool{}
+	eachModel(model, func(m interface{}) {
+		created[m] = hasZeroID(m)
+	})
+	before := loadStored(c.Connection, model)
+
+	verrs, err := c.Connection.ValidateAndSave(model, excludeColumns...)
+	if err != nil || verrs.HasAny() {
+		return verrs, err
+	}
+	eachModel(model, func(m interface{}) {
+		if created[m] {
+			c.emit(ChangeCreate, m, nil)
+		} else {
+			c.emit(ChangeUpdate, m, before)
+		}
+	})
+	return verrs, err
+}
+
+// Upsert inserts or updates the given entry, emitting a ChangeCreate or
+// ChangeUpdate event depending on whether a row matching the conflict
+// columns existed.
+func (c *ChangeStream) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	before, existed := findByColumns(c.Connection, model, conflictColumns)
+	if err := c.Connection.Upsert(model, conflictColumns, updateColumns...); err != nil {
+		return err
+	}
+	if !existed {
+		c.emit(ChangeCreate, model, nil)
+		return nil
+	}
+	c.emit(ChangeUpdate, model, map[interface{}]interface{}{modelID(model): before})
+	return nil
+}
+
+// Destroy deletes a given entry from the database and emits a ChangeDestroy
+// event.
+func (c *ChangeStream) Destroy(model interface{}) error {
+	before := loadStored(c.Connection, model)
+	if err := c.Connection.Destroy(model); err != nil {
+		return err
+	}
+	c.emit(ChangeDestroy, model, before)
+	return nil
+}
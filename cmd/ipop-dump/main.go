@@ -0,0 +1,135 @@
+// Command ipop-dump copies the rows of tables between databases, using the
+// connections of the database.yml file read by pop.
+//
+//	ipop-dump -e production export -format csv -o users.csv users
+//	ipop-dump -e production export -where "created_at > '2025-01-01'" users > users.jsonl
+//	ipop-dump -e development import -conflict skip users.csv
+//
+// Export writes to standard output unless -o is given, import reads from
+// standard input unless a file is given. The sqlite driver is only compiled
+// in with the sqlite build tag.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/kiihela/ipop"
+	"github.com/kiihela/ipop/dump"
+)
+
+const usage = `usage: ipop-dump [-e env] export [-format jsonl|csv] [-batch n] [-where condition] [-o file] table
+       ipop-dump [-e env] import [-table table] [-batch n] [-conflict fail|skip|overwrite] [file]
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "ipop-dump:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("ipop-dump", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	env := fs.String("e", "development", "the connection of database.yml to use")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing command")
+	}
+
+	command, args := fs.Arg(0), fs.Args()[1:]
+	cmd := flag.NewFlagSet(command, flag.ContinueOnError)
+	cmd.SetOutput(stderr)
+	cmd.Usage = fs.Usage
+	batch := cmd.Int("batch", dump.DefaultBatchSize, "the number of rows read or written at once")
+	switch command {
+	case "export":
+		format := cmd.String("format", string(dump.JSONLines), "the format of the dump, jsonl or csv")
+		where := cmd.String("where", "", "a condition selecting the rows to export")
+		out := cmd.String("o", "", "the file to write the dump to")
+		if err := cmd.Parse(args); err != nil {
+			return err
+		}
+		if cmd.NArg() != 1 {
+			cmd.Usage()
+			return fmt.Errorf("export needs a table")
+		}
+		conn, err := connect(*env)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		w := stdout
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		opts := dump.ExportOptions{Format: dump.Format(*format), BatchSize: *batch}
+		var n int
+		if *where == "" {
+			n, err = dump.ExportTable(conn, w, cmd.Arg(0), opts)
+		} else {
+			n, err = dump.ExportQuery(conn, w, ipop.NewQueryAdapter(conn.Where(*where)), cmd.Arg(0), opts)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "exported %d rows of %s\n", n, cmd.Arg(0))
+		return nil
+
+	case "import":
+		table := cmd.String("table", "", "the table to write to, the one of the dump by default")
+		conflict := cmd.String("conflict", string(dump.ConflictFail), "what to do with rows already in the table, fail, skip or overwrite")
+		if err := cmd.Parse(args); err != nil {
+			return err
+		}
+		if cmd.NArg() > 1 {
+			cmd.Usage()
+			return fmt.Errorf("import reads a single file")
+		}
+		r := stdin
+		if cmd.NArg() == 1 {
+			f, err := os.Open(cmd.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		conn, err := connect(*env)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		n, err := dump.Import(conn, r, dump.ImportOptions{Table: *table, BatchSize: *batch, OnConflict: dump.Conflict(*conflict)})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "imported %d rows\n", n)
+		return nil
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func connect(env string) (ipop.Connection, error) {
+	c, err := pop.Connect(env)
+	if err != nil {
+		return nil, err
+	}
+	return ipop.NewConnectionAdapter(c), nil
+}
@@ -0,0 +1,124 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/kiihela/ipop"
+	"github.com/kiihela/ipop/ipoptest"
+	"github.com/kiihela/ipop/testdata/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const migrations = "../../testdata/migrations"
+
+// register makes the database of conn the connection named env of pop, the
+// way database.yml would. run closes the connections it opens, so a new one
+// is registered for each run.
+func register(t *testing.T, env string, conn ipop.Connection) {
+	t.Helper()
+	c, err := pop.NewConnection(&pop.ConnectionDetails{
+		Dialect:  "sqlite3",
+		Database: conn.Q().Connection.Dialect.Details().Database,
+	})
+	require.NoError(t, err)
+	pop.Connections[env] = c
+	t.Cleanup(func() { delete(pop.Connections, env) })
+}
+
+func names(t *testing.T, conn ipop.Connection) []string {
+	var users []models.User
+	require.NoError(t, conn.Order("name").All(&users))
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+func TestRun_Export(t *testing.T) {
+	src := ipoptest.NewSQLite(t, migrations)
+	for _, name := range []string{"mark", "jane"} {
+		require.NoError(t, src.Create(&models.User{Name: name}))
+	}
+	file := filepath.Join(t.TempDir(), "users.csv")
+
+	var stdout, stderr bytes.Buffer
+	register(t, "src", src)
+	require.NoError(t, run([]string{"-e", "src", "export", "-format", "csv", "-batch", "1", "-o", file, "users"}, nil, &stdout, &stderr))
+	assert.Empty(t, stdout.String())
+	assert.Equal(t, "exported 2 rows of users\n", stderr.String())
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), `# {"table":"users"`))
+	assert.Contains(t, string(data), "\nid,name,created_at,updated_at\n")
+
+	stdout.Reset()
+	stderr.Reset()
+	register(t, "src", src)
+	require.NoError(t, run([]string{"-e", "src", "export", "-where", "name = 'jane'", "users"}, nil, &stdout, &stderr))
+	assert.Equal(t, "exported 1 rows of users\n", stderr.String())
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"name":"jane"`)
+
+	stderr.Reset()
+	assert.EqualError(t, run([]string{"-e", "src", "export"}, nil, &stdout, &stderr), "export needs a table")
+	assert.True(t, strings.HasPrefix(stderr.String(), "usage: ipop-dump"))
+	register(t, "src", src)
+	assert.EqualError(t, run([]string{"-e", "src", "export", "-format", "xml", "users"}, nil, &stdout, &stderr), `unknown dump format "xml"`)
+	assert.EqualError(t, run([]string{"-e", "missing", "export", "users"}, nil, &stdout, &stderr), "could not find connection named missing")
+}
+
+func TestRun_Import(t *testing.T) {
+	src := ipoptest.NewSQLite(t, migrations)
+	for _, name := range []string{"mark", "jane"} {
+		require.NoError(t, src.Create(&models.User{Name: name}))
+	}
+	file := filepath.Join(t.TempDir(), "users.jsonl")
+	var stdout, stderr bytes.Buffer
+	register(t, "src", src)
+	require.NoError(t, run([]string{"-e", "src", "export", "-o", file, "users"}, nil, &stdout, &stderr))
+
+	dst := ipoptest.NewSQLite(t, migrations)
+	stderr.Reset()
+	register(t, "dst", dst)
+	require.NoError(t, run([]string{"-e", "dst", "import", file}, nil, &stdout, &stderr))
+	assert.Equal(t, "imported 2 rows\n", stderr.String())
+	assert.Equal(t, []string{"jane", "mark"}, names(t, dst))
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	register(t, "dst", dst)
+	err = run([]string{"-e", "dst", "import", "-batch", "1"}, bytes.NewReader(data), &stdout, &stderr)
+	assert.ErrorIs(t, err, ipop.ErrUniqueViolation)
+	register(t, "dst", dst)
+	require.NoError(t, run([]string{"-e", "dst", "import", "-conflict", "skip"}, bytes.NewReader(data), &stdout, &stderr))
+	assert.Equal(t, []string{"jane", "mark"}, names(t, dst))
+
+	require.NoError(t, dst.RawQuery("CREATE TABLE people AS SELECT * FROM users WHERE 0").Exec())
+	register(t, "dst", dst)
+	require.NoError(t, run([]string{"-e", "dst", "import", "-table", "people", file}, nil, &stdout, &stderr))
+	count, err := dst.RawQuery("SELECT * FROM people").Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.EqualError(t, run([]string{"-e", "dst", "import", file, file}, nil, &stdout, &stderr), "import reads a single file")
+	assert.Error(t, run([]string{"-e", "dst", "import", filepath.Join(t.TempDir(), "missing.jsonl")}, nil, &stdout, &stderr))
+}
+
+func TestRun_Usage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.EqualError(t, run(nil, nil, &stdout, &stderr), "missing command")
+	assert.Equal(t, usage, stderr.String())
+	assert.EqualError(t, run([]string{"copy"}, nil, &stdout, &stderr), `unknown command "copy"`)
+	assert.Error(t, run([]string{"-x"}, nil, &stdout, &stderr))
+}
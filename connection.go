@@ -1,6 +1,8 @@
 package ipop
 
 import (
+	"context"
+
 	"github.com/gobuffalo/pop/v6"
 	"github.com/gobuffalo/validate/v3"
 )
@@ -10,16 +12,16 @@ type popCB func(tx *pop.Connection)
 type cbErr func(tx Connection) error
 type cb func(tx Connection)
 
-func cbConvert(cfn cb) popCB {
+func cbConvert(cfn cb, hooks *txHooks) popCB {
 	return func(tx *pop.Connection) {
-		ctx := NewConnectionAdapter(tx)
+		ctx := &ConnectionAdapter{conn: tx, hooks: hooks}
 		cfn(ctx)
 	}
 }
 
-func cbConvertErr(cfn cbErr) popCBErr {
+func cbConvertErr(cfn cbErr, hooks *txHooks) popCBErr {
 	return func(tx *pop.Connection) error {
-		ctx := NewConnectionAdapter(tx)
+		ctx := &ConnectionAdapter{conn: tx, hooks: hooks}
 		return cfn(ctx)
 	}
 }
@@ -33,19 +35,62 @@ type Connection interface {
 	MigrationURL() string
 	// MigrationTableName returns the name of the table to track migrations
 	MigrationTableName() string
+	// Dialect returns the name of the database dialect, like "postgres",
+	// "mysql" or "sqlite3"
+	Dialect() string
+	// Inspector returns the Inspector reading the schema of the database,
+	// inside the transaction of the connection if there is one.
+	//
+	//	columns, err := c.Inspector().Columns("users")
+	Inspector() Inspector
 	// Open creates a new datasource connection
 	Open() error
 	// Close destroys an active datasource connection
 	Close() error
+	// Context returns the context queries made through the connection run with
+	Context() context.Context
+	// WithContext returns a copy of the connection running its queries with ctx,
+	// inside the same transaction if there is one.
+	WithContext(ctx context.Context) Connection
 	// Transaction will start a new transaction on the connection. If the inner function
 	// returns an error then the transaction will be rolled back, otherwise the transaction
-	// will automatically commit at the end.
+	// will automatically commit at the end. Inside a transaction it runs fn in a
+	// savepoint instead, so an error only rolls back the inner work.
 	Transaction(fn func(tx Connection) error) error
+	// Savepoint runs fn inside a named savepoint of the current transaction. If fn
+	// returns an error, or panics, only the work done since the savepoint is rolled
+	// back, otherwise it is released into the surrounding transaction.
+	Savepoint(name string, fn func(tx Connection) error) error
+	// TransactionWith works like Transaction, using the isolation level, read only
+	// flag and timeout given in opts. Options can not be changed inside a transaction.
+	//
+	//	c.TransactionWith(TxOptions{Isolation: sql.LevelSerializable}, fn)
+	TransactionWith(opts TxOptions, fn func(tx Connection) error) error
 	// NewTransaction starts a new transaction on the connection
 	NewTransaction() (Connection, error)
+	// NewTransactionWith starts a new transaction on the connection using the
+	// isolation level, read only flag and timeout given in opts.
+	NewTransactionWith(opts TxOptions) (Connection, error)
 	// Rollback will open a new transaction and automatically rollback that transaction
 	// when the inner function returns, regardless. This can be useful for tests, etc.
+	// Inside a transaction only a savepoint is rolled back.
 	Rollback(fn func(tx Connection)) error
+	// Commit commits the transaction started with NewTransaction or
+	// NewTransactionWith, then runs the callbacks registered with AfterCommit,
+	// or those registered with AfterRollback when the commit fails.
+	Commit() error
+	// RollbackTransaction rolls back the transaction started with NewTransaction
+	// or NewTransactionWith, then runs the callbacks registered with
+	// AfterRollback, with a nil error.
+	RollbackTransaction() error
+	// AfterCommit registers fn to run once the current transaction has been
+	// committed. Inside a nested transaction it waits for the outermost one;
+	// outside of a transaction fn runs straight away.
+	AfterCommit(fn func())
+	// AfterRollback registers fn to run once the current transaction has been
+	// rolled back, with the error that caused it. The error is nil for Rollback.
+	// Outside of a transaction fn is never run.
+	AfterRollback(fn func(err error))
 	// Q creates a new "empty" query for the current connection.
 	Q() *pop.Query
 	// TruncateAll truncates all data from the datasource
@@ -81,6 +126,16 @@ type Connection interface {
 	// Update writes changes from an entry to the database, excluding the given columns.
 	// It updates the `updated_at` column automatically.
 	Update(model interface{}, excludeColumns ...string) error
+	// Upsert inserts the given entry or, when a row with the same values in
+	// conflictColumns already exists, updates that row instead. Only the
+	// updateColumns are overwritten on conflict; when none are given every
+	// writeable column except the conflict columns and `created_at` is.
+	// The entry is reloaded with the final row afterwards. Unlike Create and
+	// Update, Upsert runs neither the validations nor the callbacks of the
+	// model, such as BeforeSave or AfterCreate.
+	//
+	//	c.Upsert(&user, []string{"email"}, "name")
+	Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error
 	// Destroy deletes a given entry from the database
 	Destroy(model interface{}) error
 
@@ -171,11 +226,23 @@ type Connection interface {
 }
 
 type ConnectionAdapter struct {
-	conn *pop.Connection
+	conn  *pop.Connection
+	hooks *txHooks
+	// cancel is set on the connections returned by NewTransaction and
+	// NewTransactionWith outside of a transaction, ended with Commit or
+	// RollbackTransaction. It releases the context of the transaction.
+	cancel context.CancelFunc
 }
 
+// NewConnectionAdapter wraps the given pop connection. Callbacks registered
+// with AfterCommit and AfterRollback on a transaction that was not started
+// through ipop are never run.
 func NewConnectionAdapter(c *pop.Connection) *ConnectionAdapter {
-	return &ConnectionAdapter{conn: c}
+	a := &ConnectionAdapter{conn: c}
+	if c != nil && c.TX != nil {
+		a.hooks = &txHooks{}
+	}
+	return a
 }
 
 func (c *ConnectionAdapter) String() string {
@@ -197,33 +264,178 @@ func (c *ConnectionAdapter) MigrationTableName() string {
 	return c.conn.MigrationTableName()
 }
 
+// Dialect returns the name of the database dialect, like "postgres",
+// "mysql" or "sqlite3"
+func (c *ConnectionAdapter) Dialect() string {
+	return c.conn.Dialect.Name()
+}
+
+// Inspector returns the Inspector reading the schema of the database,
+// inside the transaction of the connection if there is one.
+func (c *ConnectionAdapter) Inspector() Inspector {
+	return &InspectorAdapter{conn: c.conn}
+}
+
 // Open creates a new datasource connection
 func (c *ConnectionAdapter) Open() error {
-	return c.conn.Open()
+	return mapError(c.conn.Open(), nil)
 }
 
 // Close destroys an active datasource connection
 func (c *ConnectionAdapter) Close() error {
-	return c.conn.Close()
+	return mapError(c.conn.Close(), nil)
+}
+
+// Context returns the context queries made through the connection run with
+func (c *ConnectionAdapter) Context() context.Context {
+	return c.conn.Context()
+}
+
+// WithContext returns a copy of the connection running its queries with ctx,
+// inside the same transaction if there is one.
+func (c *ConnectionAdapter) WithContext(ctx context.Context) Connection {
+	return &ConnectionAdapter{conn: c.conn.WithContext(ctx), hooks: c.hooks, cancel: c.cancel}
 }
 
 // Transaction will start a new transaction on the connection. If the inner function
 // returns an error then the transaction will be rolled back, otherwise the transaction
-// will automatically commit at the end.
+// will automatically commit at the end. Inside a transaction it runs fn in a
+// savepoint instead, so an error only rolls back the inner work.
 func (c *ConnectionAdapter) Transaction(fn func(tx Connection) error) error {
-	return c.conn.Transaction(cbConvertErr(fn))
+	if c.conn.TX != nil {
+		return c.Savepoint(nextSavepointName(), fn)
+	}
+	hooks := &txHooks{}
+	err := mapError(c.conn.Transaction(cbConvertErr(fn, hooks)), nil)
+	hooks.finish(err)
+	return err
+}
+
+// Savepoint runs fn inside a named savepoint of the current transaction. If fn
+// returns an error, or panics, only the work done since the savepoint is rolled
+// back, otherwise it is released into the surrounding transaction.
+func (c *ConnectionAdapter) Savepoint(name string, fn func(tx Connection) error) error {
+	hooks := &txHooks{}
+	err := mapError(savepoint(c.conn, name, cbConvertErr(fn, hooks)), nil)
+	if err != nil {
+		hooks.rolledBack(err)
+	} else if c.hooks != nil {
+		c.hooks.adopt(hooks)
+	}
+	return err
+}
+
+// TransactionWith works like Transaction, using the isolation level, read only
+// flag and timeout given in opts. Options can not be changed inside a transaction.
+//
+//	c.TransactionWith(TxOptions{Isolation: sql.LevelSerializable}, fn)
+func (c *ConnectionAdapter) TransactionWith(opts TxOptions, fn func(tx Connection) error) error {
+	if c.conn.TX != nil {
+		if err := nestedOptions(opts); err != nil {
+			return err
+		}
+		return c.Savepoint(nextSavepointName(), fn)
+	}
+	hooks := &txHooks{}
+	err := mapError(transactionWith(c.conn, opts, cbConvertErr(fn, hooks)), nil)
+	hooks.finish(err)
+	return err
 }
 
 // NewTransaction starts a new transaction on the connection
 func (c *ConnectionAdapter) NewTransaction() (Connection, error) {
+	if c.conn.TX != nil {
+		return &ConnectionAdapter{conn: c.conn, hooks: c.hooks}, nil
+	}
 	conn, err := c.conn.NewTransaction()
-	return NewConnectionAdapter(conn), err
+	if err != nil {
+		return nil, mapError(err, nil)
+	}
+	return &ConnectionAdapter{conn: conn, hooks: &txHooks{}, cancel: func() {}}, nil
+}
+
+// NewTransactionWith starts a new transaction on the connection using the
+// isolation level, read only flag and timeout given in opts. sqlite only
+// enforces ReadOnly for transactions started with TransactionWith, and
+// returns an error for it here.
+func (c *ConnectionAdapter) NewTransactionWith(opts TxOptions) (Connection, error) {
+	if opts.ReadOnly && c.conn.TX == nil && c.conn.Dialect.Name() == "sqlite3" {
+		return nil, errSQLiteReadOnly
+	}
+	conn, cancel, err := beginWith(c.conn, opts)
+	if err != nil {
+		return nil, mapError(err, nil)
+	}
+	if c.conn.TX != nil {
+		return &ConnectionAdapter{conn: conn, hooks: c.hooks}, nil
+	}
+	return &ConnectionAdapter{conn: conn, hooks: &txHooks{}, cancel: cancel}, nil
 }
 
 // Rollback will open a new transaction and automatically rollback that transaction
 // when the inner function returns, regardless. This can be useful for tests, etc.
+// Inside a transaction only a savepoint is rolled back.
 func (c *ConnectionAdapter) Rollback(fn func(tx Connection)) error {
-	return c.conn.Rollback(cbConvert(fn))
+	hooks := &txHooks{}
+	var err error
+	if c.conn.TX != nil {
+		err = mapError(rollbackSavepoint(c.conn, nextSavepointName(), cbConvert(fn, hooks)), nil)
+	} else {
+		err = mapError(c.conn.Rollback(cbConvert(fn, hooks)), nil)
+	}
+	hooks.rolledBack(err)
+	return err
+}
+
+// Commit commits the transaction started with NewTransaction or
+// NewTransactionWith, then runs the callbacks registered with AfterCommit,
+// or those registered with AfterRollback when the commit fails. It returns
+// an error for any other connection, the transactions of Transaction and
+// TransactionWith end with fn, and NewTransaction inside a transaction hands
+// back the surrounding one.
+func (c *ConnectionAdapter) Commit() error {
+	if c.cancel == nil {
+		return errNotNewTransaction
+	}
+	defer c.cancel()
+	err := mapError(c.conn.TX.Commit(), nil)
+	c.hooks.finish(err)
+	return err
+}
+
+// RollbackTransaction rolls back the transaction started with NewTransaction
+// or NewTransactionWith, then runs the callbacks registered with
+// AfterRollback, with a nil error. Like Commit, it returns an error for any
+// other connection.
+func (c *ConnectionAdapter) RollbackTransaction() error {
+	if c.cancel == nil {
+		return errNotNewTransaction
+	}
+	defer c.cancel()
+	err := mapError(c.conn.TX.Rollback(), nil)
+	c.hooks.rolledBack(nil)
+	return err
+}
+
+// AfterCommit registers fn to run once the current transaction has been
+// committed. Inside a nested transaction it waits for the outermost one;
+// outside of a transaction fn runs straight away.
+func (c *ConnectionAdapter) AfterCommit(fn func()) {
+	if c.hooks == nil {
+		fn()
+		return
+	}
+	c.hooks.afterCommit(fn)
+}
+
+// AfterRollback registers fn to run once the current transaction has been
+// rolled back, with the error that caused it. The error is nil for Rollback.
+// Outside of a transaction fn is never run.
+func (c *ConnectionAdapter) AfterRollback(fn func(err error)) {
+	if c.hooks == nil {
+		return
+	}
+	c.hooks.afterRollback(fn)
 }
 
 // Q creates a new "empty" query for the current connection.
@@ -233,7 +445,7 @@ func (c *ConnectionAdapter) Q() *pop.Query {
 
 // TruncateAll truncates all data from the datasource
 func (c *ConnectionAdapter) TruncateAll() error {
-	return c.conn.TruncateAll()
+	return mapError(c.conn.TruncateAll(), nil)
 }
 
 // BelongsTo adds a "where" clause based on the "ID" of the
@@ -256,76 +468,92 @@ func (c *ConnectionAdapter) BelongsToThrough(bt interface{}, thru interface{}) *
 
 // Reload fetch fresh data for a given model, using its ID.
 func (c *ConnectionAdapter) Reload(model interface{}) error {
-	return c.conn.Reload(model)
+	return mapError(c.conn.Reload(model), model)
 }
 
 // ValidateAndSave applies validation rules on the given entry, then save it
 // if the validation succeed, excluding the given columns.
 func (c *ConnectionAdapter) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
-	return c.conn.ValidateAndSave(model, excludeColumns...)
+	verrs, err := c.conn.ValidateAndSave(model, excludeColumns...)
+	return verrs, mapError(err, model)
 }
 
 // Save wraps the Create and Update methods. It executes a Create if no ID is provided with the entry;
 // or issues an Update otherwise.
 func (c *ConnectionAdapter) Save(model interface{}, excludeColumns ...string) error {
-	return c.conn.Save(model, excludeColumns...)
+	return mapError(c.conn.Save(model, excludeColumns...), model)
 }
 
 // ValidateAndCreate applies validation rules on the given entry, then creates it
 // if the validation succeed, excluding the given columns.
 func (c *ConnectionAdapter) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
-	return c.conn.ValidateAndCreate(model, excludeColumns...)
+	verrs, err := c.conn.ValidateAndCreate(model, excludeColumns...)
+	return verrs, mapError(err, model)
 }
 
 // Create add a new given entry to the database, excluding the given columns.
 // It updates `created_at` and `updated_at` columns automatically.
 func (c *ConnectionAdapter) Create(model interface{}, excludeColumns ...string) error {
-	return c.conn.Create(model, excludeColumns...)
+	return mapError(c.conn.Create(model, excludeColumns...), model)
 }
 
 // ValidateAndUpdate applies validation rules on the given entry, then update it
 // if the validation succeed, excluding the given columns.
 func (c *ConnectionAdapter) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
-	return c.conn.ValidateAndUpdate(model, excludeColumns...)
+	verrs, err := c.conn.ValidateAndUpdate(model, excludeColumns...)
+	return verrs, mapError(err, model)
 }
 
 // Update writes changes from an entry to the database, excluding the given columns.
 // It updates the `updated_at` column automatically.
 func (c *ConnectionAdapter) Update(model interface{}, excludeColumns ...string) error {
-	return c.conn.Update(model, excludeColumns...)
+	return mapError(c.conn.Update(model, excludeColumns...), model)
+}
+
+// Upsert inserts the given entry or, when a row with the same values in
+// conflictColumns already exists, updates that row instead. Only the
+// updateColumns are overwritten on conflict; when none are given every
+// writeable column except the conflict columns and `created_at` is.
+// The entry is reloaded with the final row afterwards. Unlike Create and
+// Update, Upsert runs neither the validations nor the callbacks of the
+// model, such as BeforeSave or AfterCreate.
+//
+//	c.Upsert(&user, []string{"email"}, "name")
+func (c *ConnectionAdapter) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	return mapError(upsert(c.conn, model, conflictColumns, updateColumns), model)
 }
 
 // Destroy deletes a given entry from the database
 func (c *ConnectionAdapter) Destroy(model interface{}) error {
-	return c.conn.Destroy(model)
+	return mapError(c.conn.Destroy(model), model)
 }
 
 // Find the first record of the model in the database with a particular id.
 //
 //	c.Find(&User{}, 1)
 func (c *ConnectionAdapter) Find(model interface{}, id interface{}) error {
-	return c.conn.Find(model, id)
+	return mapError(c.conn.Find(model, id), model)
 }
 
 // First record of the model in the database that matches the query.
 //
 //	c.First(&User{})
 func (c *ConnectionAdapter) First(model interface{}) error {
-	return c.conn.First(model)
+	return mapError(c.conn.First(model), model)
 }
 
 // Last record of the model in the database that matches the query.
 //
 //	c.Last(&User{})
 func (c *ConnectionAdapter) Last(model interface{}) error {
-	return c.conn.Last(model)
+	return mapError(c.conn.Last(model), model)
 }
 
 // All retrieves all of the records in the database that match the query.
 //
 //	c.All(&[]User{})
 func (c *ConnectionAdapter) All(models interface{}) error {
-	return c.conn.All(models)
+	return mapError(c.conn.All(models), models)
 }
 
 // Load loads all association or the fields specified in params for
@@ -334,14 +562,15 @@ func (c *ConnectionAdapter) All(models interface{}) error {
 // tx.First(&u)
 // tx.Load(&u)
 func (c *ConnectionAdapter) Load(model interface{}, fields ...string) error {
-	return c.conn.Load(model, fields...)
+	return mapError(c.conn.Load(model, fields...), model)
 }
 
 // Count the number of records in the database.
 //
 //	c.Count(&User{})
 func (c *ConnectionAdapter) Count(model interface{}) (int, error) {
-	return c.conn.Count(model)
+	n, err := c.conn.Count(model)
+	return n, mapError(err, model)
 }
 
 // Select allows to query only fields passed as parameter.
@@ -386,7 +615,7 @@ func (c *ConnectionAdapter) RawQuery(stmt string, args ...interface{}) *pop.Quer
 //	c.Eager("Books").Find(model, 1) // will load only Book association for model.
 func (c *ConnectionAdapter) Eager(fields ...string) Connection {
 	popConn := c.conn.Eager(fields...)
-	return NewConnectionAdapter(popConn)
+	return &ConnectionAdapter{conn: popConn, hooks: c.hooks, cancel: c.cancel}
 }
 
 // Where will append a where clause to the query. You may use `?` in place of
@@ -1,6 +1,9 @@
 package ipop
 
 import (
+	"context"
+	"time"
+
 	"github.com/gobuffalo/pop/v6"
 	"github.com/gobuffalo/validate/v3"
 	"github.com/stretchr/testify/mock"
@@ -8,45 +11,65 @@ import (
 
 // MockConnection is a mock implementation of the Connection interface.
 // You can embed this struct in your tests and override methods as needed.
+// Errors returned by the override functions are mapped the same way
+// ConnectionAdapter maps driver errors, so returning sql.ErrNoRows is seen
+// as ErrNotFound by the code under test. Transaction, TransactionWith and
+// Savepoint run fn with the mock itself unless overridden, then run the
+// callbacks fn registered with AfterCommit, or with AfterRollback when it
+// failed. The transactions of NewTransaction and NewTransactionWith run them
+// on Commit and RollbackTransaction. Like ConnectionAdapter, the mock runs
+// AfterCommit callbacks straight away outside of a transaction.
 type MockConnection struct {
 	mock.Mock
-	StringFunc             func() string
-	URLFunc                func() string
-	MigrationURLFunc       func() string
-	MigrationTableNameFunc func() string
-	OpenFunc               func() error
-	CloseFunc              func() error
-	TransactionFunc        func(fn func(tx Connection) error) error
-	NewTransactionFunc     func() (Connection, error)
-	RollbackFunc           func(fn func(tx Connection)) error
-	QFunc                  func() *pop.Query
-	TruncateAllFunc        func() error
-	BelongsToFunc          func(model interface{}) *pop.Query
-	BelongsToAsFunc        func(model interface{}, as string) *pop.Query
-	BelongsToThroughFunc   func(bt, thru interface{}) *pop.Query
-	ReloadFunc             func(model interface{}) error
-	ValidateAndSaveFunc    func(model interface{}, excludeColumns ...string) (*validate.Errors, error)
-	SaveFunc               func(model interface{}, excludeColumns ...string) error
-	ValidateAndCreateFunc  func(model interface{}, excludeColumns ...string) (*validate.Errors, error)
-	CreateFunc             func(model interface{}, excludeColumns ...string) error
-	ValidateAndUpdateFunc  func(model interface{}, excludeColumns ...string) (*validate.Errors, error)
-	UpdateFunc             func(model interface{}, excludeColumns ...string) error
-	DestroyFunc            func(model interface{}) error
-	FindFunc               func(model interface{}, id interface{}) error
-	FirstFunc              func(model interface{}) error
-	LastFunc               func(model interface{}) error
-	AllFunc                func(models interface{}) error
-	LoadFunc               func(model interface{}, fields ...string) error
-	CountFunc              func(model interface{}) (int, error)
-	SelectFunc             func(fields ...string) *pop.Query
-	PaginateFunc           func(page int, perPage int) *pop.Query
-	PaginateFromParamsFunc func(params pop.PaginationParams) *pop.Query
-	RawQueryFunc           func(stmt string, args ...interface{}) *pop.Query
-	EagerFunc              func(fields ...string) Connection
-	WhereFunc              func(stmt string, args ...interface{}) *pop.Query
-	OrderFunc              func(stmt string) *pop.Query
-	LimitFunc              func(limit int) *pop.Query
-	ScopeFunc              func(sf pop.ScopeFunc) *pop.Query
+	StringFunc              func() string
+	URLFunc                 func() string
+	MigrationURLFunc        func() string
+	MigrationTableNameFunc  func() string
+	DialectFunc             func() string
+	InspectorFunc           func() Inspector
+	OpenFunc                func() error
+	CloseFunc               func() error
+	ContextFunc             func() context.Context
+	WithContextFunc         func(ctx context.Context) Connection
+	TransactionFunc         func(fn func(tx Connection) error) error
+	SavepointFunc           func(name string, fn func(tx Connection) error) error
+	TransactionWithFunc     func(opts TxOptions, fn func(tx Connection) error) error
+	NewTransactionFunc      func() (Connection, error)
+	NewTransactionWithFunc  func(opts TxOptions) (Connection, error)
+	RollbackFunc            func(fn func(tx Connection)) error
+	CommitFunc              func() error
+	RollbackTransactionFunc func() error
+	AfterCommitFunc         func(fn func())
+	AfterRollbackFunc       func(fn func(err error))
+	QFunc                   func() *pop.Query
+	TruncateAllFunc         func() error
+	BelongsToFunc           func(model interface{}) *pop.Query
+	BelongsToAsFunc         func(model interface{}, as string) *pop.Query
+	BelongsToThroughFunc    func(bt, thru interface{}) *pop.Query
+	ReloadFunc              func(model interface{}) error
+	ValidateAndSaveFunc     func(model interface{}, excludeColumns ...string) (*validate.Errors, error)
+	SaveFunc                func(model interface{}, excludeColumns ...string) error
+	ValidateAndCreateFunc   func(model interface{}, excludeColumns ...string) (*validate.Errors, error)
+	CreateFunc              func(model interface{}, excludeColumns ...string) error
+	ValidateAndUpdateFunc   func(model interface{}, excludeColumns ...string) (*validate.Errors, error)
+	UpdateFunc              func(model interface{}, excludeColumns ...string) error
+	UpsertFunc              func(model interface{}, conflictColumns []string, updateColumns ...string) error
+	DestroyFunc             func(model interface{}) error
+	FindFunc                func(model interface{}, id interface{}) error
+	FirstFunc               func(model interface{}) error
+	LastFunc                func(model interface{}) error
+	AllFunc                 func(models interface{}) error
+	LoadFunc                func(model interface{}, fields ...string) error
+	CountFunc               func(model interface{}) (int, error)
+	SelectFunc              func(fields ...string) *pop.Query
+	PaginateFunc            func(page int, perPage int) *pop.Query
+	PaginateFromParamsFunc  func(params pop.PaginationParams) *pop.Query
+	RawQueryFunc            func(stmt string, args ...interface{}) *pop.Query
+	EagerFunc               func(fields ...string) Connection
+	WhereFunc               func(stmt string, args ...interface{}) *pop.Query
+	OrderFunc               func(stmt string) *pop.Query
+	LimitFunc               func(limit int) *pop.Query
+	ScopeFunc               func(sf pop.ScopeFunc) *pop.Query
 }
 
 func (m *MockConnection) String() string {
@@ -73,36 +96,138 @@ func (m *MockConnection) MigrationTableName() string {
 	}
 	return "schema_migrations"
 }
+func (m *MockConnection) Dialect() string {
+	if m.DialectFunc != nil {
+		return m.DialectFunc()
+	}
+	return "mock"
+}
+func (m *MockConnection) Inspector() Inspector {
+	if m.InspectorFunc != nil {
+		return m.InspectorFunc()
+	}
+	return &MockInspector{}
+}
 func (m *MockConnection) Open() error {
 	if m.OpenFunc != nil {
-		return m.OpenFunc()
+		return mapError(m.OpenFunc(), nil)
 	}
 	return nil
 }
 func (m *MockConnection) Close() error {
 	if m.CloseFunc != nil {
-		return m.CloseFunc()
+		return mapError(m.CloseFunc(), nil)
 	}
 	return nil
 }
+func (m *MockConnection) Context() context.Context {
+	if m.ContextFunc != nil {
+		return m.ContextFunc()
+	}
+	return context.Background()
+}
+func (m *MockConnection) WithContext(ctx context.Context) Connection {
+	if m.WithContextFunc != nil {
+		return m.WithContextFunc(ctx)
+	}
+	return m
+}
 func (m *MockConnection) Transaction(fn func(tx Connection) error) error {
-	if m.TransactionFunc != nil {
-		return m.TransactionFunc(fn)
+	run := m.TransactionFunc
+	if run == nil {
+		run = func(fn func(tx Connection) error) error { return fn(m) }
 	}
-	return nil
+	return mockTransaction(run, fn, nil)
+}
+func (m *MockConnection) Savepoint(name string, fn func(tx Connection) error) error {
+	return mockTransaction(m.savepoint(name), fn, nil)
+}
+
+// savepoint runs the functions handed to Savepoint with SavepointFunc, or
+// with the mock itself.
+func (m *MockConnection) savepoint(name string) func(fn func(tx Connection) error) error {
+	if m.SavepointFunc != nil {
+		return func(fn func(tx Connection) error) error { return m.SavepointFunc(name, fn) }
+	}
+	return func(fn func(tx Connection) error) error { return fn(m) }
+}
+func (m *MockConnection) TransactionWith(opts TxOptions, fn func(tx Connection) error) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if opts.ReadOnly {
+		fn = readOnlyTransaction(fn)
+	}
+	run := func(fn func(tx Connection) error) error { return fn(m) }
+	if m.TransactionWithFunc != nil {
+		run = func(fn func(tx Connection) error) error { return m.TransactionWithFunc(opts, fn) }
+	}
+	return mockTransaction(func(fn func(tx Connection) error) error {
+		start := time.Now()
+		err := run(fn)
+		if err == nil && opts.Timeout > 0 && time.Since(start) > opts.Timeout {
+			err = context.DeadlineExceeded
+		}
+		return err
+	}, fn, nil)
 }
 func (m *MockConnection) NewTransaction() (Connection, error) {
 	if m.NewTransactionFunc != nil {
-		return m.NewTransactionFunc()
+		conn, err := m.NewTransactionFunc()
+		if err != nil {
+			return conn, mapError(err, nil)
+		}
+		return newMockTx(conn, &txHooks{}, true), nil
+	}
+	return newMockTx(m, &txHooks{}, true), nil
+}
+func (m *MockConnection) NewTransactionWith(opts TxOptions) (Connection, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	var conn Connection = m
+	if m.NewTransactionWithFunc != nil {
+		var err error
+		if conn, err = m.NewTransactionWithFunc(opts); err != nil {
+			return conn, mapError(err, nil)
+		}
 	}
-	return m, nil
+	conn = newMockTx(conn, &txHooks{}, true)
+	if opts.ReadOnly {
+		conn = newReadOnlyConnection(conn)
+	}
+	return conn, nil
 }
 func (m *MockConnection) Rollback(fn func(tx Connection)) error {
 	if m.RollbackFunc != nil {
-		return m.RollbackFunc(fn)
+		return mapError(m.RollbackFunc(fn), nil)
 	}
 	return nil
 }
+func (m *MockConnection) Commit() error {
+	if m.CommitFunc != nil {
+		return mapError(m.CommitFunc(), nil)
+	}
+	return nil
+}
+func (m *MockConnection) RollbackTransaction() error {
+	if m.RollbackTransactionFunc != nil {
+		return mapError(m.RollbackTransactionFunc(), nil)
+	}
+	return nil
+}
+func (m *MockConnection) AfterCommit(fn func()) {
+	if m.AfterCommitFunc != nil {
+		m.AfterCommitFunc(fn)
+		return
+	}
+	fn()
+}
+func (m *MockConnection) AfterRollback(fn func(err error)) {
+	if m.AfterRollbackFunc != nil {
+		m.AfterRollbackFunc(fn)
+	}
+}
 func (m *MockConnection) Q() *pop.Query {
 	if m.QFunc != nil {
 		return m.QFunc()
@@ -111,7 +236,7 @@ func (m *MockConnection) Q() *pop.Query {
 }
 func (m *MockConnection) TruncateAll() error {
 	if m.TruncateAllFunc != nil {
-		return m.TruncateAllFunc()
+		return mapError(m.TruncateAllFunc(), nil)
 	}
 	return nil
 }
@@ -135,85 +260,95 @@ func (m *MockConnection) BelongsToThrough(bt, thru interface{}) *pop.Query {
 }
 func (m *MockConnection) Reload(model interface{}) error {
 	if m.ReloadFunc != nil {
-		return m.ReloadFunc(model)
+		return mapError(m.ReloadFunc(model), model)
 	}
 	return nil
 }
 func (m *MockConnection) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
 	if m.ValidateAndSaveFunc != nil {
-		return m.ValidateAndSaveFunc(model, excludeColumns...)
+		verrs, err := m.ValidateAndSaveFunc(model, excludeColumns...)
+		return verrs, mapError(err, model)
 	}
 	return nil, nil
 }
 func (m *MockConnection) Save(model interface{}, excludeColumns ...string) error {
 	if m.SaveFunc != nil {
-		return m.SaveFunc(model, excludeColumns...)
+		return mapError(m.SaveFunc(model, excludeColumns...), model)
 	}
 	return nil
 }
 func (m *MockConnection) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
 	if m.ValidateAndCreateFunc != nil {
-		return m.ValidateAndCreateFunc(model, excludeColumns...)
+		verrs, err := m.ValidateAndCreateFunc(model, excludeColumns...)
+		return verrs, mapError(err, model)
 	}
 	return nil, nil
 }
 func (m *MockConnection) Create(model interface{}, excludeColumns ...string) error {
 	if m.CreateFunc != nil {
-		return m.CreateFunc(model, excludeColumns...)
+		return mapError(m.CreateFunc(model, excludeColumns...), model)
 	}
 	return nil
 }
 func (m *MockConnection) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
 	if m.ValidateAndUpdateFunc != nil {
-		return m.ValidateAndUpdateFunc(model, excludeColumns...)
+		verrs, err := m.ValidateAndUpdateFunc(model, excludeColumns...)
+		return verrs, mapError(err, model)
 	}
 	return nil, nil
 }
 func (m *MockConnection) Update(model interface{}, excludeColumns ...string) error {
 	if m.UpdateFunc != nil {
-		return m.UpdateFunc(model, excludeColumns...)
+		return mapError(m.UpdateFunc(model, excludeColumns...), model)
+	}
+	return nil
+}
+func (m *MockConnection) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	if m.UpsertFunc != nil {
+		return mapError(m.UpsertFunc(model, conflictColumns, updateColumns...), model)
 	}
 	return nil
 }
 func (m *MockConnection) Destroy(model interface{}) error {
 	if m.DestroyFunc != nil {
-		return m.DestroyFunc(model)
+		return mapError(m.DestroyFunc(model), model)
 	}
 	return nil
 }
 func (m *MockConnection) Find(model interface{}, id interface{}) error {
 	if m.FindFunc != nil {
-		return m.FindFunc(model, id)
+		return mapError(m.FindFunc(model, id), model)
 	}
 	return nil
 }
 func (m *MockConnection) First(model interface{}) error {
 	if m.FirstFunc != nil {
-		return m.FirstFunc(model)
+		return mapError(m.FirstFunc(model), model)
 	}
 	return nil
 }
 func (m *MockConnection) Last(model interface{}) error {
 	if m.LastFunc != nil {
-		return m.LastFunc(model)
+		return mapError(m.LastFunc(model), model)
 	}
 	return nil
 }
 func (m *MockConnection) All(models interface{}) error {
 	if m.AllFunc != nil {
-		return m.AllFunc(models)
+		return mapError(m.AllFunc(models), models)
 	}
 	return nil
 }
 func (m *MockConnection) Load(model interface{}, fields ...string) error {
 	if m.LoadFunc != nil {
-		return m.LoadFunc(model, fields...)
+		return mapError(m.LoadFunc(model, fields...), model)
 	}
 	return nil
 }
 func (m *MockConnection) Count(model interface{}) (int, error) {
 	if m.CountFunc != nil {
-		return m.CountFunc(model)
+		n, err := m.CountFunc(model)
+		return n, mapError(err, model)
 	}
 	return 0, nil
 }
@@ -271,3 +406,129 @@ func (m *MockConnection) Scope(sf pop.ScopeFunc) *pop.Query {
 	}
 	return &pop.Query{}
 }
+
+// mockTransaction runs fn through run, the mocked transaction, handing it a
+// connection that collects the callbacks registered with AfterCommit and
+// AfterRollback. Once run returns the rollback callbacks run if it failed,
+// otherwise the commit callbacks run, or are handed to parent for a nested
+// transaction.
+func mockTransaction(run func(fn func(tx Connection) error) error, fn func(tx Connection) error, parent *txHooks) error {
+	hooks := &txHooks{}
+	err := mapError(run(func(tx Connection) error {
+		return fn(newMockTx(tx, hooks, false))
+	}), nil)
+	switch {
+	case err != nil:
+		hooks.rolledBack(err)
+	case parent != nil:
+		parent.adopt(hooks)
+	default:
+		hooks.committed()
+	}
+	return err
+}
+
+// mockTx is the connection MockConnection hands to the functions run in a
+// transaction, or returns from NewTransaction and NewTransactionWith, then
+// manual, ended with Commit or RollbackTransaction.
+type mockTx struct {
+	decorator
+	hooks  *txHooks
+	manual bool
+}
+
+func newMockTx(conn Connection, hooks *txHooks, manual bool) *mockTx {
+	return &mockTx{
+		decorator: decorator{Connection: conn, wrap: func(conn Connection) Connection {
+			return newMockTx(conn, hooks, manual)
+		}},
+		hooks:  hooks,
+		manual: manual,
+	}
+}
+
+func (tx *mockTx) Transaction(fn func(tx Connection) error) error {
+	return mockTransaction(tx.Connection.Transaction, fn, tx.hooks)
+}
+func (tx *mockTx) Savepoint(name string, fn func(tx Connection) error) error {
+	return mockTransaction(func(fn func(tx Connection) error) error {
+		return tx.Connection.Savepoint(name, fn)
+	}, fn, tx.hooks)
+}
+func (tx *mockTx) TransactionWith(opts TxOptions, fn func(tx Connection) error) error {
+	return mockTransaction(func(fn func(tx Connection) error) error {
+		return tx.Connection.TransactionWith(opts, fn)
+	}, fn, tx.hooks)
+}
+func (tx *mockTx) Commit() error {
+	err := tx.Connection.Commit()
+	if tx.manual {
+		tx.hooks.finish(err)
+	}
+	return err
+}
+func (tx *mockTx) RollbackTransaction() error {
+	err := tx.Connection.RollbackTransaction()
+	if tx.manual {
+		tx.hooks.rolledBack(nil)
+	}
+	return err
+}
+func (tx *mockTx) AfterCommit(fn func()) {
+	tx.hooks.afterCommit(fn)
+}
+func (tx *mockTx) AfterRollback(fn func(err error)) {
+	tx.hooks.afterRollback(fn)
+}
+
+// readOnlyTransaction hands fn a connection failing every write with
+// ErrReadOnly, the way the database does inside a read only transaction.
+func readOnlyTransaction(fn func(tx Connection) error) func(tx Connection) error {
+	return func(tx Connection) error {
+		return fn(newReadOnlyConnection(tx))
+	}
+}
+
+// readOnlyConnection fails the writes made in a MockConnection transaction
+// started with TxOptions.ReadOnly.
+type readOnlyConnection struct {
+	decorator
+}
+
+func newReadOnlyConnection(conn Connection) *readOnlyConnection {
+	return &readOnlyConnection{decorator{Connection: conn, wrap: func(conn Connection) Connection {
+		return newReadOnlyConnection(conn)
+	}}}
+}
+
+func readOnlyError(model interface{}) error {
+	return &Error{Kind: ErrReadOnly, Table: modelTable(model)}
+}
+
+func (c *readOnlyConnection) TruncateAll() error {
+	return &Error{Kind: ErrReadOnly}
+}
+func (c *readOnlyConnection) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	return validate.NewErrors(), readOnlyError(model)
+}
+func (c *readOnlyConnection) Save(model interface{}, excludeColumns ...string) error {
+	return readOnlyError(model)
+}
+func (c *readOnlyConnection) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	return validate.NewErrors(), readOnlyError(model)
+}
+func (c *readOnlyConnection) Create(model interface{}, excludeColumns ...string) error {
+	return readOnlyError(model)
+}
+func (c *readOnlyConnection) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	return validate.NewErrors(), readOnlyError(model)
+}
+func (c *readOnlyConnection) Update(model interface{}, excludeColumns ...string) error {
+	return readOnlyError(model)
+}
+func (c *readOnlyConnection) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	return readOnlyError(model)
+}
+func (c *readOnlyConnection) Destroy(model interface{}) error {
+	return readOnlyError(model)
+}
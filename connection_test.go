@@ -1,13 +1,20 @@
 package ipop
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gobuffalo/pop/v6"
 	"log"
 	"net/url"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/kiihela/ipop/testdata/models"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,7 +35,10 @@ func init() {
 		log.Panic(err)
 	}
 
-	migrator, err := pop.NewFileMigrator("testdata/migrations", connection)
+	popConn = connection
+	db = NewConnectionAdapter(connection)
+
+	migrator, err := NewFileMigrator("testdata/migrations", db)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -37,9 +47,6 @@ func init() {
 	if err != nil {
 		log.Panic(err)
 	}
-
-	popConn = connection
-	db = NewConnectionAdapter(connection)
 }
 
 func ExampleNewConnectionAdapter() {
@@ -221,6 +228,1164 @@ func TestConnectionAdapter_Callback(t *testing.T) {
 	assert.True(t, called)
 }
 
+func TestConnectionAdapter_Upsert(t *testing.T) {
+	// the shared migrations have no unique index on users.name to conflict on
+	assert.NoError(t, db.RawQuery("CREATE UNIQUE INDEX users_name_idx ON users (name)").Exec())
+	t.Cleanup(func() {
+		assert.NoError(t, db.RawQuery("DROP INDEX users_name_idx").Exec())
+	})
+	user := models.User{Name: "Upserted"}
+	assert.NoError(t, db.Upsert(&user, []string{"name"}))
+	assert.False(t, user.CreatedAt.IsZero())
+	firstID := user.ID
+
+	again := models.User{Name: "Upserted"}
+	assert.NoError(t, db.Upsert(&again, []string{"name"}))
+	assert.Equal(t, firstID, again.ID)
+
+	count, err := db.Where("name = ?", "Upserted").Count(&models.User{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.Error(t, db.Upsert(&models.User{Name: "No conflict"}, nil))
+	assert.NoError(t, db.Destroy(&again))
+}
+
+func TestQueryAdapter_UpdateAllAndDeleteAll(t *testing.T) {
+	for _, name := range []string{"Bulk A", "Bulk B", "Bulk C"} {
+		assert.NoError(t, db.Create(&models.User{Name: name}))
+	}
+
+	_, err := NewQueryAdapter(db.Q()).UpdateAll(&models.User{}, map[string]interface{}{"name": "x"})
+	assert.Equal(t, ErrFullTable, err)
+	_, err = NewQueryAdapter(db.Q()).DeleteAll(&models.User{})
+	assert.Equal(t, ErrFullTable, err)
+	_, err = NewQueryAdapter(db.Q().Join("teams", "teams.name = ' WHERE '")).DeleteAll(&models.User{})
+	assert.Equal(t, ErrFullTable, err, "a WHERE in a join is not a where clause")
+	deleted, err := NewQueryAdapter(db.Q().Join("teams", "teams.id = users.id").Where("teams.name = ?", "Bulk")).DeleteAll(&models.User{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	q := NewQueryAdapter(db.Where("name in (?)", "Bulk A", "Bulk B"))
+	updated, err := q.UpdateAll(&models.User{}, map[string]interface{}{"id": "00000000-0000-0000-0000-000000000001"})
+	assert.Error(t, err, "the primary key must reject the second row")
+	assert.Equal(t, 0, updated)
+
+	updated, err = NewQueryAdapter(db.Where("name = ?", "Bulk A")).UpdateAll(&models.User{}, map[string]interface{}{"name": "Bulk renamed"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, updated)
+
+	deleted, err = NewQueryAdapter(db.Where("name like ?", "Bulk%")).DeleteAll(&models.User{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+
+	deleted, err = NewQueryAdapter(db.Q()).AllowFullTable().DeleteAll(&models.User{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestConnectionAdapter_Errors(t *testing.T) {
+	err := db.Find(&models.User{}, "00000000-0000-0000-0000-000000000000")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.True(t, errors.Is(err, sql.ErrNoRows))
+
+	var ipopErr *Error
+	assert.True(t, errors.As(err, &ipopErr))
+	assert.Equal(t, "users", ipopErr.Table)
+
+	user := models.User{Name: "Duplicate"}
+	assert.NoError(t, db.Create(&user))
+	err = db.Create(&models.User{ID: user.ID, Name: "Duplicate"})
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+	assert.True(t, errors.As(err, &ipopErr))
+	assert.Equal(t, "users", ipopErr.Table)
+	assert.Equal(t, "id", ipopErr.Column)
+	assert.NoError(t, db.Destroy(&user))
+
+	mock := &MockConnection{FirstFunc: func(model interface{}) error {
+		return sql.ErrNoRows
+	}}
+	assert.True(t, errors.Is(mock.First(&models.User{}), ErrNotFound))
+
+	err = db.Transaction(func(tx Connection) error {
+		dup := models.User{Name: "Duplicate"}
+		if err := tx.Create(&dup); err != nil {
+			return err
+		}
+		return fmt.Errorf("charging card: %w", tx.Create(&models.User{ID: dup.ID, Name: "Duplicate"}))
+	})
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+	assert.True(t, strings.HasPrefix(err.Error(), "charging card: "), err.Error())
+}
+
+func TestConnectionAdapter_NestedTransactionUsesSavepoint(t *testing.T) {
+	err := db.Transaction(func(tx Connection) error {
+		assert.NoError(t, tx.Create(&models.User{Name: "Outer"}))
+
+		err := tx.Transaction(func(inner Connection) error {
+			assert.NoError(t, inner.Create(&models.User{Name: "Inner"}))
+			return errors.New("ooops")
+		})
+		assert.Error(t, err)
+
+		assert.NoError(t, tx.Savepoint("kept", func(inner Connection) error {
+			return inner.Create(&models.User{Name: "Kept"})
+		}))
+
+		assert.NoError(t, tx.Rollback(func(inner Connection) {
+			assert.NoError(t, inner.Create(&models.User{Name: "Rolled back"}))
+		}))
+
+		var names []models.User
+		assert.NoError(t, tx.Where("name in (?)", "Outer", "Inner", "Kept", "Rolled back").Order("name").All(&names))
+		assert.Equal(t, 2, len(names))
+		return errors.New("discard everything")
+	})
+	assert.Error(t, err)
+
+	count, err := db.Where("name in (?)", "Outer", "Kept").Count(&models.User{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.Equal(t, ErrNoTransaction, db.Savepoint("outside", func(tx Connection) error { return nil }))
+}
+
+func TestConnectionAdapter_TransactionWith(t *testing.T) {
+	err := db.TransactionWith(TxOptions{ReadOnly: true}, func(tx Connection) error {
+		return tx.Create(&models.User{Name: "Read only"})
+	})
+	assert.True(t, errors.Is(err, ErrReadOnly))
+
+	_, err = db.NewTransactionWith(TxOptions{ReadOnly: true})
+	assert.Error(t, err)
+
+	err = db.TransactionWith(TxOptions{Isolation: sql.LevelSerializable}, func(tx Connection) error {
+		return tx.Create(&models.User{Name: "Serializable"})
+	})
+	assert.NoError(t, err)
+
+	err = db.TransactionWith(TxOptions{Timeout: time.Millisecond}, func(tx Connection) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	assert.NoError(t, db.Transaction(func(tx Connection) error {
+		return tx.TransactionWith(TxOptions{}, func(inner Connection) error { return nil })
+	}))
+	assert.Error(t, db.Transaction(func(tx Connection) error {
+		return tx.TransactionWith(TxOptions{ReadOnly: true}, func(inner Connection) error { return nil })
+	}))
+	assert.Error(t, db.TransactionWith(TxOptions{Timeout: -1}, func(tx Connection) error { return nil }))
+
+	var user models.User
+	assert.NoError(t, db.Where("name = ?", "Serializable").First(&user))
+	assert.NoError(t, db.Destroy(&user))
+}
+
+func TestMockConnection_Transaction(t *testing.T) {
+	mock := &MockConnection{}
+	var calls []string
+	err := mock.Transaction(func(tx Connection) error {
+		tx.AfterCommit(func() { calls = append(calls, "commit 1") })
+		tx.AfterRollback(func(err error) { calls = append(calls, "never") })
+		assert.NoError(t, tx.Transaction(func(inner Connection) error {
+			inner.AfterCommit(func() { calls = append(calls, "commit 2") })
+			return nil
+		}))
+		assert.Error(t, tx.Transaction(func(inner Connection) error {
+			inner.AfterRollback(func(err error) { calls = append(calls, "rollback inner: "+err.Error()) })
+			return errors.New("ooops")
+		}))
+		assert.Equal(t, []string{"rollback inner: ooops"}, calls)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rollback inner: ooops", "commit 1", "commit 2"}, calls)
+
+	calls = nil
+	err = mock.TransactionWith(TxOptions{}, func(tx Connection) error {
+		tx.AfterCommit(func() { calls = append(calls, "never") })
+		tx.AfterRollback(func(err error) { calls = append(calls, "rollback 1: "+err.Error()) })
+		tx.AfterRollback(func(err error) { calls = append(calls, "rollback 2") })
+		return errors.New("ooops")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"rollback 1: ooops", "rollback 2"}, calls)
+
+	calls = nil
+	err = mock.Savepoint("work", func(tx Connection) error {
+		tx.AfterCommit(func() { calls = append(calls, "savepoint released") })
+		return tx.Create(&models.User{Name: "Saved"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"savepoint released"}, calls)
+
+	calls = nil
+	err = mock.Transaction(func(tx Connection) error {
+		assert.Error(t, tx.Savepoint("work", func(inner Connection) error {
+			inner.AfterRollback(func(err error) { calls = append(calls, "savepoint rolled back") })
+			return errors.New("ooops")
+		}))
+		return tx.Savepoint("more", func(inner Connection) error {
+			inner.AfterCommit(func() { calls = append(calls, "committed") })
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"savepoint rolled back", "committed"}, calls)
+}
+
+func TestMockConnection_TransactionWith(t *testing.T) {
+	mock := &MockConnection{TransactionWithFunc: func(opts TxOptions, fn func(tx Connection) error) error {
+		return fn(&MockConnection{})
+	}}
+	err := mock.TransactionWith(TxOptions{ReadOnly: true}, func(tx Connection) error {
+		return tx.Create(&models.User{Name: "Read only"})
+	})
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	assert.NoError(t, mock.TransactionWith(TxOptions{}, func(tx Connection) error {
+		return tx.Create(&models.User{Name: "Writable"})
+	}))
+
+	tx, err := (&MockConnection{}).NewTransactionWith(TxOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(tx.Eager().Update(&models.User{}), ErrReadOnly))
+}
+
+func TestConnectionAdapter_AfterCommitAndRollback(t *testing.T) {
+	var calls []string
+
+	err := db.Transaction(func(tx Connection) error {
+		tx.AfterCommit(func() { calls = append(calls, "commit 1") })
+		tx.AfterRollback(func(err error) { calls = append(calls, "rollback outer") })
+
+		assert.NoError(t, tx.Transaction(func(inner Connection) error {
+			inner.AfterCommit(func() { calls = append(calls, "commit 2") })
+			return nil
+		}))
+		assert.Error(t, tx.Transaction(func(inner Connection) error {
+			inner.AfterCommit(func() { calls = append(calls, "never") })
+			inner.AfterRollback(func(err error) { calls = append(calls, "rollback inner: "+err.Error()) })
+			return errors.New("ooops")
+		}))
+
+		assert.Empty(t, calls[1:])
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rollback inner: ooops", "commit 1", "commit 2"}, calls)
+
+	calls = nil
+	err = db.Transaction(func(tx Connection) error {
+		tx.AfterCommit(func() { calls = append(calls, "never") })
+		tx.AfterRollback(func(err error) { calls = append(calls, "rollback: "+err.Error()) })
+		return errors.New("ooops")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"rollback: ooops"}, calls)
+
+	calls = nil
+	db.AfterCommit(func() { calls = append(calls, "immediately") })
+	assert.Equal(t, []string{"immediately"}, calls)
+
+	mock := &MockConnection{}
+	mock.AfterCommit(func() { calls = append(calls, "mock immediately") })
+	mock.AfterRollback(func(err error) { calls = append(calls, "never") })
+	assert.Equal(t, []string{"immediately", "mock immediately"}, calls)
+
+	for _, conn := range []Connection{db, mock} {
+		calls = nil
+		tx, err := conn.NewTransaction()
+		assert.NoError(t, err)
+		user := models.User{Name: "Committed by hand"}
+		assert.NoError(t, tx.Create(&user))
+		tx.AfterCommit(func() { calls = append(calls, "commit") })
+		tx.AfterRollback(func(err error) { calls = append(calls, "never") })
+		assert.NoError(t, tx.Transaction(func(inner Connection) error {
+			inner.AfterCommit(func() { calls = append(calls, "inner commit") })
+			return nil
+		}))
+		assert.Empty(t, calls)
+		assert.NoError(t, tx.Commit())
+		assert.Equal(t, []string{"commit", "inner commit"}, calls)
+
+		calls = nil
+		tx, err = conn.NewTransactionWith(TxOptions{Timeout: time.Minute})
+		assert.NoError(t, err)
+		tx.AfterCommit(func() { calls = append(calls, "never") })
+		tx.AfterRollback(func(err error) { calls = append(calls, fmt.Sprintf("rollback: %v", err)) })
+		assert.NoError(t, tx.Destroy(&user))
+		assert.NoError(t, tx.RollbackTransaction())
+		assert.Equal(t, []string{"rollback: <nil>"}, calls)
+		assert.NoError(t, conn.Destroy(&user))
+	}
+
+	tx, err := db.NewTransactionWith(TxOptions{Timeout: time.Minute})
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, context.Canceled, tx.Q().Connection.Context().Err())
+
+	assert.Error(t, db.Commit())
+	assert.Error(t, db.RollbackTransaction())
+	assert.NoError(t, db.Transaction(func(tx Connection) error {
+		assert.Error(t, tx.Commit())
+		return nil
+	}))
+}
+
+func TestChangeStream(t *testing.T) {
+	stream := NewChangeStream(db)
+	var events []ChangeEvent
+	unsubscribe := stream.Subscribe(func(ev ChangeEvent) { events = append(events, ev) })
+	defer unsubscribe()
+
+	user := models.User{Name: "Streamed"}
+	assert.NoError(t, stream.Create(&user))
+	assert.Len(t, events, 1)
+	assert.Equal(t, ChangeCreate, events[0].Op)
+	assert.Equal(t, "users", events[0].Table)
+	assert.Equal(t, user.ID, events[0].ID)
+	assert.Nil(t, events[0].Before)
+	assert.Equal(t, FieldChange{After: "Streamed"}, events[0].Changes["name"])
+
+	err := stream.Transaction(func(tx Connection) error {
+		user.Name = "Renamed"
+		assert.NoError(t, tx.Update(&user))
+		assert.Len(t, events, 1, "buffered until commit")
+
+		assert.Error(t, tx.Transaction(func(inner Connection) error {
+			assert.NoError(t, inner.Create(&models.User{Name: "Dropped"}))
+			return errors.New("ooops")
+		}))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, ChangeUpdate, events[1].Op)
+	assert.Equal(t, FieldChange{Before: "Streamed", After: "Renamed"}, events[1].Changes["name"])
+	assert.Equal(t, "Streamed", events[1].Before.(models.User).Name)
+	assert.NotContains(t, events[1].Changes, "id")
+
+	assert.Error(t, stream.Transaction(func(tx Connection) error {
+		assert.NoError(t, tx.Destroy(&user))
+		return errors.New("ooops")
+	}))
+	assert.Len(t, events, 2)
+
+	assert.NoError(t, stream.Destroy(&user))
+	assert.Len(t, events, 3)
+	assert.Equal(t, ChangeDestroy, events[2].Op)
+	assert.Nil(t, events[2].After)
+	assert.Equal(t, "Renamed", events[2].Before.(models.User).Name)
+
+	calls := 0
+	var unsubscribeOnce func()
+	unsubscribeOnce = stream.Subscribe(func(ChangeEvent) {
+		calls++
+		unsubscribeOnce()
+	})
+	upserted := models.User{Name: "Upserted"}
+	assert.NoError(t, stream.Upsert(&upserted, []string{"id"}))
+	upserted.Name = "Upserted again"
+	assert.NoError(t, stream.Upsert(&upserted, []string{"id"}))
+	assert.Equal(t, 1, calls)
+	assert.Len(t, events, 5)
+	assert.Equal(t, ChangeCreate, events[3].Op)
+	assert.Equal(t, ChangeUpdate, events[4].Op)
+	assert.Equal(t, "Upserted", events[4].Before.(models.User).Name)
+	assert.Equal(t, FieldChange{Before: "Upserted", After: "Upserted again"}, events[4].Changes["name"])
+	assert.NoError(t, db.Destroy(&upserted))
+
+	mocked := NewChangeStream(&MockConnection{})
+	var mockEvents []ChangeEvent
+	mocked.Subscribe(func(ev ChangeEvent) { mockEvents = append(mockEvents, ev) })
+	assert.NoError(t, mocked.Upsert(&models.User{Name: "Mocked"}, []string{"name"}))
+	assert.Len(t, mockEvents, 1)
+	assert.Equal(t, ChangeCreate, mockEvents[0].Op)
+	assert.NoError(t, Audited(&MockConnection{}, nil).Upsert(&models.User{Name: "Mocked"}, []string{"name"}))
+}
+
+func TestAudited(t *testing.T) {
+	migrator, err := NewMigrationBox(AuditMigrations, db)
+	assert.NoError(t, err)
+	assert.NoError(t, migrator.Up())
+	t.Cleanup(func() { assert.NoError(t, migrator.Down(1)) })
+
+	type actorKey struct{}
+	audited := Audited(db, func(ctx context.Context) string {
+		actor, _ := ctx.Value(actorKey{}).(string)
+		return actor
+	})
+	ctx := WithRequestID(context.WithValue(context.Background(), actorKey{}, "alice"), "req-1")
+	conn := audited.WithContext(ctx)
+
+	user := models.User{Name: "Audited"}
+	assert.NoError(t, conn.Create(&user))
+	user.Name = "Audited renamed"
+	assert.NoError(t, conn.Save(&user))
+
+	assert.Error(t, conn.Transaction(func(tx Connection) error {
+		assert.NoError(t, tx.Destroy(&user))
+		return errors.New("ooops")
+	}))
+	assert.NoError(t, audited.Destroy(&user))
+
+	history, err := AuditHistory(db, &user)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	ops := []ChangeOp{}
+	for _, entry := range history {
+		ops = append(ops, entry.Op)
+		assert.Equal(t, "users", entry.Table)
+		assert.Equal(t, user.ID.String(), entry.RowID)
+	}
+	assert.Equal(t, []ChangeOp{ChangeCreate, ChangeUpdate, ChangeDestroy}, ops)
+
+	assert.Equal(t, "alice", history[1].Actor)
+	assert.Equal(t, "req-1", history[1].RequestID)
+	assert.Equal(t, "", history[2].Actor)
+	changes, err := history[1].FieldChanges()
+	assert.NoError(t, err)
+	assert.Equal(t, FieldChange{Before: "Audited", After: "Audited renamed"}, changes["name"])
+	assert.NotContains(t, changes, "id")
+
+	// entries written within the resolution of created_at keep their order
+	busy := models.User{Name: "Busy"}
+	assert.NoError(t, audited.Transaction(func(tx Connection) error {
+		assert.NoError(t, tx.Create(&busy))
+		for _, name := range []string{"Busy 1", "Busy 2", "Busy 3"} {
+			busy.Name = name
+			assert.NoError(t, tx.Update(&busy))
+		}
+		return nil
+	}))
+	assert.NoError(t, db.RawQuery("UPDATE ipop_audit SET created_at = ? WHERE row_id = ?", time.Now(), busy.ID.String()).Exec())
+	history, err = AuditHistory(db, &busy)
+	assert.NoError(t, err)
+	var names []interface{}
+	for _, entry := range history {
+		changes, err := entry.FieldChanges()
+		assert.NoError(t, err)
+		names = append(names, changes["name"].After)
+	}
+	assert.Equal(t, []interface{}{"Busy", "Busy 1", "Busy 2", "Busy 3"}, names)
+	assert.NoError(t, db.Destroy(&busy))
+}
+
+func TestCachingConnection(t *testing.T) {
+	cached := NewCachingConnection(db, nil)
+
+	user := models.User{Name: "Cached"}
+	assert.NoError(t, cached.Create(&user))
+
+	for i := 0; i < 2; i++ {
+		found := models.User{}
+		assert.NoError(t, cached.Find(&found, user.ID))
+		assert.Equal(t, "Cached", found.Name)
+	}
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, cached.Stats())
+
+	// writes outside of the decorator are not seen
+	_, err := NewQueryAdapter(db.Where("id = ?", user.ID)).UpdateAll(&models.User{}, map[string]interface{}{"name": "Sneaky"})
+	assert.NoError(t, err)
+	found := models.User{}
+	assert.NoError(t, cached.Find(&found, user.ID))
+	assert.Equal(t, "Cached", found.Name)
+
+	assert.NoError(t, cached.Transaction(func(tx Connection) error {
+		found := models.User{}
+		assert.NoError(t, tx.Find(&found, user.ID))
+		assert.Equal(t, "Sneaky", found.Name, "transactions bypass the cache")
+		found.Name = "Renamed"
+		return tx.Update(&found)
+	}))
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1}, cached.Stats())
+
+	assert.NoError(t, cached.Find(&found, user.ID))
+	assert.Equal(t, "Renamed", found.Name)
+
+	var users []models.User
+	q := cached.Query(cached.Where("name = ?", "Renamed"))
+	assert.NoError(t, q.All(&users))
+	users[0].Name = "Mutated"
+	users = nil
+	assert.NoError(t, q.All(&users))
+	assert.Len(t, users, 1)
+	assert.Equal(t, "Renamed", users[0].Name)
+	assert.Equal(t, CacheStats{Hits: 3, Misses: 3}, cached.Stats())
+
+	assert.NoError(t, cached.Destroy(&user))
+	count, err := cached.Query(cached.Where("name = ?", "Renamed")).Count(&models.User{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestCachingConnection_ReadTables(t *testing.T) {
+	assert.NoError(t, db.RawQuery("CREATE TABLE cached_notes (id INTEGER PRIMARY KEY, user_id TEXT NOT NULL)").Exec())
+	t.Cleanup(func() {
+		assert.NoError(t, db.RawQuery("DROP TABLE cached_notes").Exec())
+	})
+	type cachedNote struct {
+		ID     int    `db:"id"`
+		UserID string `db:"user_id"`
+	}
+
+	cached := NewCachingConnection(db, nil)
+	user := models.User{Name: "Noted"}
+	assert.NoError(t, cached.Create(&user))
+	defer func() { assert.NoError(t, cached.Destroy(&user)) }()
+
+	joined := cached.Query(cached.Q().Join("cached_notes", "cached_notes.user_id = users.id"))
+	subquery := cached.Query(cached.Where("(SELECT COUNT(*) FROM cached_notes) > ?", 1))
+	for i := 0; i < 2; i++ {
+		count, err := joined.Count(&models.User{})
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+		count, err = subquery.Count(&models.User{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+
+		assert.NoError(t, cached.Create(&cachedNote{UserID: user.ID.String()}))
+	}
+
+	count, err := subquery.Count(&models.User{})
+	assert.NoError(t, err)
+	assert.NotZero(t, count)
+
+	tables, ok := readTables(db.Q().Join("cached_notes AS n", "n.user_id = users.id").Where("name = ?", "Noted"), "users")
+	assert.True(t, ok, "the clauses of pop.Query are found")
+	assert.Equal(t, []string{"users", "cached_notes"}, tables)
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Now()
+	cache := NewLRUCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+	cache.Set("c", 3)
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok, "least recently used entry is evicted")
+	assert.Equal(t, 2, cache.Len())
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.Get("a")
+	assert.False(t, ok, "entries expire")
+}
+
+type fakeT struct {
+	errors   []string
+	cleanups []func()
+}
+
+func (f *fakeT) Helper() {}
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+func (f *fakeT) Cleanup(fn func()) { f.cleanups = append(f.cleanups, fn) }
+
+// mentor is a user whose mentees are the users sharing its id, an
+// association pop can load without another table.
+type mentor struct {
+	ID        uuid.UUID     `db:"id"`
+	CreatedAt time.Time     `db:"created_at"`
+	UpdatedAt time.Time     `db:"updated_at"`
+	Name      string        `db:"name"`
+	Mentees   []models.User `has_many:"users" fk_id:"id"`
+}
+
+func (mentor) TableName() string {
+	return "users"
+}
+
+func TestNPlusOneDetector(t *testing.T) {
+	users := []models.User{}
+	for i := 0; i < 4; i++ {
+		user := models.User{Name: fmt.Sprintf("N+1 #%d", i)}
+		assert.NoError(t, db.Create(&user))
+		users = append(users, user)
+	}
+	defer func() { assert.NoError(t, db.Destroy(&users)) }()
+
+	detector := DetectNPlusOne(db, 3)
+	assert.NoError(t, detector.Transaction(func(tx Connection) error {
+		for _, user := range users {
+			assert.NoError(t, tx.Find(&models.User{}, user.ID))
+		}
+		return nil
+	}))
+	assert.NoError(t, detector.First(&models.User{}))
+
+	offenders := detector.End()
+	assert.Len(t, offenders, 1)
+	assert.Equal(t, 4, offenders[0].Count)
+	assert.Contains(t, offenders[0].Shape, "find: SELECT")
+	assert.Contains(t, offenders[0].Stack, "TestNPlusOneDetector")
+	assert.Empty(t, detector.End())
+
+	mentors := []mentor{}
+	assert.NoError(t, detector.Query(detector.Where("name LIKE ?", "N+1 #%")).All(&mentors))
+	for _, m := range mentors {
+		assert.NoError(t, detector.Query(detector.Where("id = ?", m.ID)).First(&models.User{}))
+	}
+	offenders = detector.End()
+	assert.Len(t, offenders, 1)
+	assert.Contains(t, offenders[0].Suggestion, `Eager("Mentees") on the query loading the users rows`)
+
+	ft := &fakeT{}
+	conn := DetectNPlusOneT(ft, db, 1)
+	for _, user := range users[:2] {
+		assert.NoError(t, conn.Load(&mentor{ID: user.ID}))
+	}
+	ft.cleanups[0]()
+	assert.Len(t, ft.errors, 1)
+	assert.Contains(t, ft.errors[0], `Eager("Mentees")`)
+
+	assert.Equal(t, "SELECT * FROM users WHERE id IN (?) AND name = ?",
+		normalizeSQL("SELECT *  FROM users\n WHERE id IN ($1, $2, 3) AND name = 'it''s'"))
+}
+
+func TestBudgetedConnection(t *testing.T) {
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+
+	strict := WithBudget(db, Budget{MaxQueries: 2, MaxRows: 1, Strict: true, Logf: logf})
+	user := models.User{Name: "Budgeted"}
+	other := models.User{Name: "Budgeted too"}
+	assert.NoError(t, strict.Create(&user))
+	assert.NoError(t, db.Create(&other))
+	defer func() { assert.NoError(t, db.Destroy(&[]models.User{user, other})) }()
+
+	err := strict.All(&[]models.User{})
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	err = strict.Find(&models.User{}, user.ID)
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	assert.Equal(t, 2, strict.Usage().Queries)
+
+	scope := strict.Begin()
+	assert.NoError(t, scope.Transaction(func(tx Connection) error {
+		return tx.Find(&models.User{}, user.ID)
+	}))
+	assert.Equal(t, BudgetUsage{Queries: 1, Duration: scope.Usage().Duration}, scope.Usage())
+	assert.Empty(t, logged)
+
+	lenient := WithBudget(db, Budget{MaxQueries: 1, SlowQuery: time.Nanosecond, Logf: logf})
+	assert.NoError(t, lenient.Find(&models.User{}, user.ID))
+	assert.NoError(t, lenient.Query(lenient.Where("name = ?", "Budgeted")).First(&models.User{}))
+	assert.Len(t, logged, 3)
+	assert.Contains(t, logged[0], "slow query")
+	assert.Contains(t, logged[0], "connection_test.go")
+	assert.Contains(t, logged[0], "WHERE users.id = ?")
+	assert.Contains(t, logged[0], user.ID.String())
+	assert.Contains(t, logged[1], ErrBudgetExceeded.Error())
+	assert.Contains(t, logged[2], "name = ?")
+	assert.Contains(t, logged[2], "[Budgeted]")
+
+	logged = nil
+	writes := WithBudget(db, Budget{SlowQuery: time.Nanosecond, Logf: logf})
+	assert.NoError(t, writes.Update(&user))
+	assert.Len(t, logged, 1)
+	assert.Contains(t, logged[0], `/* approximate */ UPDATE "users" SET "name" = ?, "updated_at" = ? WHERE "id" = ?`)
+	assert.Contains(t, logged[0], "Budgeted")
+	assert.Contains(t, logged[0], user.ID.String())
+
+	logged = nil
+	assert.NoError(t, writes.Update(&user, "name"))
+	assert.Len(t, logged, 1)
+	assert.Contains(t, logged[0], `/* approximate */ UPDATE "users" SET "updated_at" = ? WHERE "id" = ?`)
+}
+
+func TestQueryAdapter_Explain(t *testing.T) {
+	plan, err := NewQueryAdapter(db.Where("id = ?", "00000000-0000-0000-0000-000000000000")).Explain(&models.User{})
+	assert.NoError(t, err)
+	assert.Empty(t, plan.FullScans())
+	assert.Contains(t, plan.String(), "sqlite_autoindex_users_1")
+
+	plan, err = NewQueryAdapter(db.Where("created_at > ?", time.Now())).Explain(&models.User{})
+	assert.NoError(t, err)
+	assert.Len(t, plan.FullScans(), 1)
+
+	nodes, err := parsePostgresPlan(`[{"Plan": {"Node Type": "Nested Loop", "Plans": [
+		{"Node Type": "Seq Scan", "Relation Name": "teams"},
+		{"Node Type": "Index Scan", "Relation Name": "users", "Index Name": "users_pkey"}]}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, "teams", Plan{Nodes: nodes}.FullScans()[0].Table)
+	assert.Equal(t, "users_pkey", nodes[0].Children[1].Index)
+
+	nodes, err = parseMySQLPlan(`{"query_block": {"nested_loop": [
+		{"table": {"table_name": "teams", "access_type": "ALL"}},
+		{"table": {"table_name": "users", "access_type": "ref", "key": "users_name_idx"}}]}}`)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	assert.Equal(t, "teams", Plan{Nodes: nodes}.FullScans()[0].Table)
+}
+
+func TestLinter(t *testing.T) {
+	linter := Linter{MaxSelectStarColumns: 3}
+	rules := func(stmt string, args ...interface{}) []LintRule {
+		found := []LintRule{}
+		for _, issue := range linter.Lint(stmt, args, 5) {
+			found = append(found, issue.Rule)
+		}
+		return found
+	}
+
+	assert.Empty(t, rules("SELECT 'where x = 1' AS s FROM users WHERE name = ? LIMIT 1", "mark"))
+	assert.Equal(t, []LintRule{LintLiteral}, rules("SELECT id FROM users WHERE name = 'mark'"))
+	assert.Equal(t, []LintRule{LintLiteral}, rules("SELECT id FROM users WHERE id IN (1, 2)"))
+	assert.Equal(t, []LintRule{LintPlaceholders}, rules("SELECT id FROM users WHERE name = ? AND id = ?", "mark"))
+	assert.Equal(t, []LintRule{LintPlaceholders}, rules("SELECT id FROM users WHERE name = $1", "mark", 2))
+	assert.Equal(t, []LintRule{LintUnboundedWrite}, rules("DELETE FROM users"))
+	assert.Equal(t, []LintRule{LintUnboundedWrite}, rules("update users set name = ?", "x"))
+	assert.Equal(t, []LintRule{LintSelectStar}, rules("SELECT * FROM users"))
+	assert.Equal(t, []LintRule{LintLeadingWildcard}, rules("SELECT id FROM users WHERE name LIKE ?", "%mark"))
+	assert.Equal(t, []LintRule{LintLeadingWildcard}, rules("SELECT id FROM users WHERE name LIKE $1", "_ark"))
+	assert.Equal(t, []LintRule{LintLiteral, LintLeadingWildcard}, rules("SELECT id FROM users WHERE name LIKE '%mark'"))
+	assert.Empty(t, rules("SELECT id FROM users WHERE name LIKE ?", "mark%"))
+	assert.Equal(t, []LintRule{LintLiteral, LintLeadingWildcard}, rules("SELECT id FROM users WHERE data #>> '{a}' = ? AND name LIKE '%x'", 1))
+	assert.Equal(t, []LintRule{LintLeadingWildcard}, rules("SELECT id FROM users WHERE name LIKE ? # 'comment'", "%x"))
+
+	var warnings []string
+	conn := Linted(db, Linter{
+		Actions: map[LintRule]LintAction{LintUnboundedWrite: LintReject, LintSelectStar: LintIgnore},
+		Warnf: func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		},
+		MaxSelectStarColumns: 1,
+	})
+
+	err := conn.Query(conn.RawQuery("DELETE FROM users")).Exec()
+	assert.True(t, errors.Is(err, ErrQueryRejected))
+
+	assert.NoError(t, conn.Transaction(func(tx Connection) error {
+		users := []models.User{}
+		return tx.(*LintedConnection).Query(tx.RawQuery("SELECT * FROM users WHERE name = 'mark'")).All(&users)
+	}))
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], string(LintLiteral))
+
+	assert.NoError(t, conn.All(&[]models.User{}))
+	assert.Len(t, warnings, 1)
+}
+
+func TestFaultyConnection(t *testing.T) {
+	user := models.User{Name: "Faulty"}
+	assert.NoError(t, db.Create(&user))
+	defer func() { assert.NoError(t, db.Destroy(&user)) }()
+
+	conn := Faulty(db, []FaultRule{
+		{Method: "Update", Model: models.User{}, Scope: InTransaction, Nth: 2},
+		{Method: "Find", Scope: OutsideTransaction, Nth: 1, Err: sql.ErrNoRows},
+		{Method: "Count", Scope: InTransaction, Kind: FaultDrop},
+	})
+
+	err := conn.Transaction(func(tx Connection) error {
+		user.Name = "Faulty once"
+		assert.NoError(t, tx.Update(&user))
+		user.Name = "Faulty twice"
+		return tx.Update(&user)
+	})
+	assert.True(t, errors.Is(err, ErrInjectedFault))
+
+	err = conn.Find(&user, user.ID)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.NoError(t, conn.Find(&user, user.ID))
+	assert.Equal(t, "Faulty", user.Name, "the transaction was rolled back")
+
+	err = conn.Transaction(func(tx Connection) error {
+		_, err := tx.Count(&models.User{})
+		assert.True(t, errors.Is(err, ErrConnectionLost))
+		return tx.Find(&models.User{}, user.ID)
+	})
+	assert.True(t, errors.Is(err, ErrConnectionLost))
+	assert.Equal(t, 3, conn.Injected())
+
+	conn = Faulty(db, []FaultRule{
+		{Method: "Savepoint"},
+		{Method: "NewTransaction", Nth: 1, Kind: FaultPartial},
+		{Method: "Commit"},
+	})
+	err = conn.Transaction(func(tx Connection) error {
+		return tx.Savepoint("faulty", func(Connection) error {
+			t.Error("the savepoint must not run")
+			return nil
+		})
+	})
+	assert.True(t, errors.Is(err, ErrInjectedFault))
+	_, err = conn.NewTransaction()
+	assert.True(t, errors.Is(err, ErrInjectedFault))
+	tx, err := conn.NewTransaction()
+	assert.NoError(t, err, "the partly started transaction was rolled back")
+	uncommitted := models.User{Name: "Uncommitted"}
+	assert.NoError(t, tx.Create(&uncommitted))
+	assert.True(t, errors.Is(tx.Commit(), ErrInjectedFault))
+	assert.True(t, errors.Is(db.Find(&models.User{}, uncommitted.ID), ErrNotFound))
+	assert.Equal(t, 3, conn.Injected())
+	assert.Nil(t, baseType(nil))
+
+	pattern := func() []bool {
+		conn := Faulty(db, []FaultRule{{Method: "Count", Probability: 0.5, Seed: 7}})
+		failed := []bool{}
+		for i := 0; i < 10; i++ {
+			_, err := conn.Count(&models.User{})
+			failed = append(failed, err != nil)
+		}
+		return failed
+	}
+	first := pattern()
+	assert.Equal(t, first, pattern())
+	assert.Contains(t, first, true)
+	assert.Contains(t, first, false)
+}
+
+func TestMigratorAdapter(t *testing.T) {
+	var m Migrator
+	m, err := NewFileMigrator(t.TempDir(), db)
+	assert.NoError(t, err)
+	m.(*MigratorAdapter).SetSchemaPath("")
+
+	assert.NoError(t, m.Create("Create Notes!", "sql",
+		[]byte("CREATE TABLE ipop_notes (id TEXT PRIMARY KEY);"),
+		[]byte("DROP TABLE ipop_notes;")))
+	assert.Error(t, m.Create("notes", "yaml", nil, nil))
+
+	status, err := m.Status()
+	assert.NoError(t, err)
+	assert.Len(t, status, 1)
+	assert.Equal(t, "create_notes", status[0].Name)
+	assert.False(t, status[0].Applied)
+
+	assert.NoError(t, m.Up())
+	status, err = m.Status()
+	assert.NoError(t, err)
+	assert.True(t, status[0].Applied)
+	assert.NoError(t, db.RawQuery("SELECT count(*) FROM ipop_notes").Exec())
+
+	assert.NoError(t, m.Down(1))
+	status, err = m.Status()
+	assert.NoError(t, err)
+	assert.False(t, status[0].Applied)
+	assert.Error(t, db.RawQuery("SELECT count(*) FROM ipop_notes").Exec())
+
+	box, err := NewMigrationBox(AuditMigrations, db)
+	assert.NoError(t, err)
+	status, err = box.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, []MigrationStatus{{Version: "20250320120000", Name: "create_ipop_audit"}}, status)
+	assert.Error(t, box.Create("notes", "sql", nil, nil))
+
+	mock := &MockMigrator{DownFunc: func(step int) error { return fmt.Errorf("down %d", step) }}
+	m = mock
+	assert.NoError(t, m.Up())
+	assert.EqualError(t, m.Down(2), "down 2")
+}
+
+func TestNewFSMigrator(t *testing.T) {
+	_, err := NewFSMigrator(fstest.MapFS{
+		"README.md":                         {Data: []byte("# migrations")},
+		"1_create_notes.up.sql":             {Data: []byte("")},
+		"1_create_tags.up.sql":              {Data: []byte("")},
+		"1_create_tags.down.sql":            {Data: []byte("")},
+		"2_drop_notes.down.fizz":            {Data: []byte("")},
+		"create_labels.up.fizz":             {Data: []byte("")},
+		"old/3_create_labels.down.fizz":     {Data: []byte("")},
+		"3_create_labels.up.fizz":           {Data: []byte("")},
+		"3_create_labels.down.fizz":         {Data: []byte("")},
+		"4_create_labels.oracle.up.sql":     {Data: []byte("")},
+		"4_create_labels.postgres.down.sql": {Data: []byte("")},
+	}, db)
+	assert.True(t, errors.Is(err, ErrInvalidMigrations))
+	assert.EqualError(t, err, "invalid migrations: "+strings.Join([]string{
+		"1_create_notes.up.sql has no down migration",
+		"2_drop_notes.down.fizz has no up migration",
+		"3_create_labels.down.fizz and old/3_create_labels.down.fizz are the same migration",
+		"4_create_labels.oracle.up.sql: unsupported dialect oracle",
+		"4_create_labels.postgres.down.sql has no up migration",
+		"create_labels.up.fizz is not named <version>_<name>.(up|down).(fizz|sql)",
+		"version 1 is used by create_notes and create_tags",
+	}, "; "))
+
+	m, err := NewFSMigrator(fstest.MapFS{
+		"migrations/20250401120000_create_notes.up.sql":   {Data: []byte("CREATE TABLE ipop_fs_notes (id TEXT PRIMARY KEY);")},
+		"migrations/20250401120000_create_notes.down.sql": {Data: []byte("DROP TABLE ipop_fs_notes;")},
+		"migrations/schema.sql":                           {Data: []byte("")},
+	}, db)
+	assert.NoError(t, err)
+
+	status, err := m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, []MigrationStatus{{Version: "20250401120000", Name: "create_notes"}}, status)
+
+	// the files are read again each time the migrations run
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, m.Up())
+		status, err = m.Status()
+		assert.NoError(t, err)
+		assert.True(t, status[0].Applied)
+		assert.NoError(t, db.RawQuery("SELECT count(*) FROM ipop_fs_notes").Exec())
+		assert.NoError(t, m.Down(1))
+	}
+	assert.Error(t, m.Create("notes", "sql", nil, nil))
+}
+
+func TestParseSchemaDump(t *testing.T) {
+	pgDump, err := ParseSchemaDump(`
+-- Name: users; Type: TABLE; Schema: public
+CREATE TABLE public.users (
+    id uuid NOT NULL,
+    name character varying(255) NOT NULL,
+    score numeric(10,2),
+    created_at timestamp without time zone NOT NULL
+);
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+CREATE UNIQUE INDEX users_name_idx ON public.users USING btree (name);
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, Schema{Tables: []TableSchema{{
+		Name: "users",
+		Columns: []Column{
+			{Name: "id", Type: "uuid", PrimaryKey: true},
+			{Name: "name", Type: "character varying(255)"},
+			{Name: "score", Type: "numeric(10,2)", Nullable: true},
+			{Name: "created_at", Type: "timestamp without time zone"},
+		},
+		Indexes: []Index{{Name: "users_name_idx", Columns: []string{"name"}, Unique: true}},
+	}}}, pgDump)
+
+	mysqlDump, err := ParseSchemaDump("/*!40101 SET NAMES utf8 */;\n" +
+		"CREATE TABLE `users` (\n" +
+		"  `id` char(36) NOT NULL,\n" +
+		"  `name` varchar(255) NOT NULL DEFAULT '',\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  UNIQUE KEY `users_name_idx` (`name`),\n" +
+		"  KEY `users_name_id_idx` (`name`(10),`id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;")
+	assert.NoError(t, err)
+	assert.Equal(t, Schema{Tables: []TableSchema{{
+		Name: "users",
+		Columns: []Column{
+			{Name: "id", Type: "char(36)", PrimaryKey: true},
+			{Name: "name", Type: "varchar(255)"},
+		},
+		Indexes: []Index{
+			{Name: "users_name_idx", Columns: []string{"name"}, Unique: true},
+			{Name: "users_name_id_idx", Columns: []string{"name", "id"}},
+		},
+	}}}, mysqlDump)
+}
+
+func TestSchemaDiff(t *testing.T) {
+	assert.NoError(t, db.RawQuery("CREATE INDEX users_created_at_idx ON users (created_at)").Exec())
+	t.Cleanup(func() {
+		assert.NoError(t, db.RawQuery("DROP INDEX users_created_at_idx").Exec())
+	})
+	expected, err := ParseSchemaDump(`
+CREATE TABLE IF NOT EXISTS "users"
+(
+    "id"         TEXT PRIMARY KEY,
+    "name"       VARCHAR(255) NOT NULL,
+    "created_at" DATETIME NOT NULL,
+    "updated_at" DATETIME NOT NULL
+);
+CREATE INDEX "users_created_at_idx" ON "users" (created_at);
+`)
+	assert.NoError(t, err)
+	diffs, err := SchemaDiff(db, expected)
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaDifference{{Kind: ExtraTable, Table: "projects"}, {Kind: ExtraTable, Table: "teams"}}, diffs)
+
+	drifted, err := ParseSchemaDump(`
+CREATE TABLE "users" (
+    "id"         TEXT PRIMARY KEY,
+    "name"       INTEGER,
+    "email"      TEXT NOT NULL,
+    "created_at" DATETIME NOT NULL
+);
+CREATE INDEX "users_created_at_idx" ON "users" (created_at, name);
+CREATE INDEX "users_email_idx" ON "users" (email);
+CREATE TABLE "tasks" ("id" TEXT PRIMARY KEY);
+`)
+	assert.NoError(t, err)
+	drifted.Partial = true
+	diffs, err = SchemaDiff(db, drifted)
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaDifference{
+		{Kind: MissingTable, Table: "tasks"},
+		{Kind: TypeMismatch, Table: "users", Column: "name", Expected: "INTEGER", Actual: "TEXT"},
+		{Kind: NullabilityMismatch, Table: "users", Column: "name", Expected: "NULL", Actual: "NOT NULL"},
+		{Kind: MissingColumn, Table: "users", Column: "email", Expected: "TEXT"},
+		{Kind: IndexMismatch, Table: "users", Index: "users_created_at_idx", Expected: "(created_at, name)", Actual: "(created_at)"},
+		{Kind: MissingIndex, Table: "users", Index: "users_email_idx", Expected: "(email)"},
+	}, diffs)
+
+	out, err := json.Marshal(diffs[:2])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"kind": "missing_table", "table": "tasks"},
+		{"kind": "type_mismatch", "table": "users", "column": "name", "expected": "INTEGER", "actual": "TEXT"}
+	]`, string(out))
+
+	diffs, err = SchemaDiff(db, SchemaFromModels(&models.User{}, &models.Team{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "type_mismatch: teams.leader, expected models.User, got user", diffs[0].String())
+	assert.Len(t, diffs, 2)
+}
+
+type invalidUser struct {
+	Name  int         `db:"name"`
+	Email string      `db:"email"`
+	Team  models.Team `belongs_to:"teams" db:"-"`
+}
+
+func (invalidUser) TableName() string { return "users" }
+
+type timestamps struct {
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type embeddingUser struct {
+	ID   uuid.UUID `db:"id"`
+	Name string    `db:"name"`
+	timestamps
+}
+
+func (embeddingUser) TableName() string { return "users" }
+
+func TestValidateModels(t *testing.T) {
+	report, err := ValidateModels(db, &models.User{})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	report, err = ValidateModels(db, &mentor{}, &embeddingUser{})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	diffs, err := SchemaDiff(db, SchemaFromModels(&mentor{}, &embeddingUser{}))
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+	var names []string
+	for _, col := range SchemaFromModels(&embeddingUser{}).Tables[0].Columns {
+		names = append(names, col.Name)
+	}
+	assert.Equal(t, []string{"id", "name", "created_at", "updated_at"}, names)
+
+	_, err = ValidateModels(db, nil)
+	assert.EqualError(t, err, "model <nil> is not a struct")
+	_, err = ValidateModels(db, &models.User{}, new(string))
+	assert.EqualError(t, err, "model *string is not a struct")
+
+	report, err = ValidateModels(db, &models.User{}, &models.Team{}, &invalidUser{})
+	assert.ErrorIs(t, err, ErrInvalidModels)
+	var kinds []string
+	for _, p := range report.Problems {
+		kinds = append(kinds, fmt.Sprintf("%s %s %s", p.Kind, p.Model, p.Field))
+	}
+	assert.Equal(t, []string{
+		"unsupported_field models.Team Leader",
+		"unsupported_field models.Team Members",
+		"missing_id ipop.invalidUser ",
+		"type_mismatch ipop.invalidUser Name",
+		"missing_column ipop.invalidUser Email",
+		"missing_foreign_key ipop.invalidUser Team",
+	}, kinds)
+	assert.Equal(t, "missing_foreign_key: ipop.invalidUser.Team: belongs_to needs a TeamID field in ipop.invalidUser, or an fk_id tag naming it", report.Problems[5].String())
+	assert.Contains(t, report.String(), "unsupported_field: models.Team.Members: []models.User can not be stored in a column")
+}
+
+func TestInspector(t *testing.T) {
+	err := db.Rollback(func(tx Connection) {
+		assert.NoError(t, tx.RawQuery(`CREATE TABLE memberships (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			team_id TEXT NOT NULL,
+			FOREIGN KEY (team_id) REFERENCES teams
+		)`).Exec())
+		assert.NoError(t, tx.RawQuery("CREATE INDEX memberships_team_id_idx ON memberships (team_id)").Exec())
+		inspector := tx.Inspector()
+
+		tables, err := inspector.Tables()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"memberships", "projects", "schema_migration", "teams", "users"}, tables)
+
+		columns, err := inspector.Columns("memberships")
+		assert.NoError(t, err)
+		assert.Equal(t, []Column{
+			{Name: "id", Type: "TEXT", Nullable: true, PrimaryKey: true},
+			{Name: "user_id", Type: "TEXT"},
+			{Name: "team_id", Type: "TEXT"},
+		}, columns)
+
+		pk, err := inspector.PrimaryKey("memberships")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"id"}, pk)
+
+		assert.NoError(t, tx.RawQuery("CREATE TABLE pairs (a TEXT, b TEXT, PRIMARY KEY (b, a))").Exec())
+		assert.NoError(t, tx.RawQuery("CREATE TABLE pair_notes (a TEXT, b TEXT, FOREIGN KEY (b, a) REFERENCES pairs)").Exec())
+		pk, err = inspector.PrimaryKey("pairs")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b", "a"}, pk)
+		keys, err := inspector.ForeignKeys("pair_notes")
+		assert.NoError(t, err)
+		assert.Equal(t, []ForeignKey{
+			{Columns: []string{"b", "a"}, ReferencedTable: "pairs", ReferencedColumns: []string{"b", "a"}, OnUpdate: "NO ACTION", OnDelete: "NO ACTION"},
+		}, keys)
+
+		indexes, err := inspector.Indexes("memberships")
+		assert.NoError(t, err)
+		assert.Equal(t, []Index{{Name: "memberships_team_id_idx", Columns: []string{"team_id"}}}, indexes)
+
+		keys, err = inspector.ForeignKeys("memberships")
+		assert.NoError(t, err)
+		assert.Equal(t, []ForeignKey{
+			{Columns: []string{"user_id"}, ReferencedTable: "users", ReferencedColumns: []string{"id"}, OnUpdate: "NO ACTION", OnDelete: "CASCADE"},
+			{Columns: []string{"team_id"}, ReferencedTable: "teams", ReferencedColumns: []string{"id"}, OnUpdate: "NO ACTION", OnDelete: "NO ACTION"},
+		}, keys)
+	})
+	assert.NoError(t, err)
+
+	tables, err := db.Inspector().Tables()
+	assert.NoError(t, err)
+	assert.NotContains(t, tables, "memberships")
+
+	inspector := &MockInspector{
+		Schema: Schema{Tables: []TableSchema{
+			{Name: "users", Columns: []Column{{Name: "id", Type: "uuid", PrimaryKey: true}, {Name: "name", Type: "text"}}},
+			{Name: "teams", Columns: []Column{{Name: "id", Type: "uuid", PrimaryKey: true}}},
+		}},
+		ForeignKeysByTable: map[string][]ForeignKey{
+			"users": {{Name: "users_team_fk", Columns: []string{"team_id"}, ReferencedTable: "teams", ReferencedColumns: []string{"id"}}},
+		},
+	}
+	mock := &MockConnection{InspectorFunc: func() Inspector { return inspector }}
+	tables, err = mock.Inspector().Tables()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"teams", "users"}, tables)
+	pk, err := mock.Inspector().PrimaryKey("users")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id"}, pk)
+	keys, err := mock.Inspector().ForeignKeys("users")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	columns, err := (&MockConnection{}).Inspector().Columns("users")
+	assert.NoError(t, err)
+	assert.Empty(t, columns)
+
+	report, err := ValidateModels(mock, &models.User{})
+	assert.ErrorIs(t, err, ErrInvalidModels)
+	assert.Equal(t, "missing_column: models.User.CreatedAt: column created_at does not exist\n"+
+		"missing_column: models.User.UpdatedAt: column updated_at does not exist", report.String())
+}
+
 func TestConnectionAdapter_Connections(t *testing.T) {
 	err := db.Open()
 	assert.NoError(t, err)
@@ -0,0 +1,93 @@
+package ipop
+
+import "context"
+
+// decorator is embedded by the Connection decorators. It passes everything on
+// to the decorated Connection, and wraps the connections handed out by
+// transactions, Eager and WithContext again so that the decorator keeps
+// seeing the calls made through them.
+type decorator struct {
+	Connection
+	wrap func(conn Connection) Connection
+	// wrapTx, when set, is used instead of wrap for the connections bound to
+	// a transaction
+	wrapTx func(tx Connection) Connection
+}
+
+func (d decorator) wrapTransaction(tx Connection) Connection {
+	if d.wrapTx != nil {
+		return d.wrapTx(tx)
+	}
+	return d.wrap(tx)
+}
+
+// WithContext returns a copy of the connection running its queries with ctx,
+// inside the same transaction if there is one.
+func (d decorator) WithContext(ctx context.Context) Connection {
+	return d.wrap(d.Connection.WithContext(ctx))
+}
+
+// Transaction will start a new transaction on the connection. If the inner function
+// returns an error then the transaction will be rolled back, otherwise the transaction
+// will automatically commit at the end. Inside a transaction it runs fn in a
+// savepoint instead, so an error only rolls back the inner work.
+func (d decorator) Transaction(fn func(tx Connection) error) error {
+	return d.Connection.Transaction(func(tx Connection) error {
+		return fn(d.wrapTransaction(tx))
+	})
+}
+
+// Savepoint runs fn inside a named savepoint of the current transaction. If fn
+// returns an error, or panics, only the work done since the savepoint is rolled
+// back, otherwise it is released into the surrounding transaction.
+func (d decorator) Savepoint(name string, fn func(tx Connection) error) error {
+	return d.Connection.Savepoint(name, func(tx Connection) error {
+		return fn(d.wrapTransaction(tx))
+	})
+}
+
+// TransactionWith works like Transaction, using the isolation level, read only
+// flag and timeout given in opts. Options can not be changed inside a transaction.
+func (d decorator) TransactionWith(opts TxOptions, fn func(tx Connection) error) error {
+	return d.Connection.TransactionWith(opts, func(tx Connection) error {
+		return fn(d.wrapTransaction(tx))
+	})
+}
+
+// NewTransaction starts a new transaction on the connection
+func (d decorator) NewTransaction() (Connection, error) {
+	tx, err := d.Connection.NewTransaction()
+	if err != nil {
+		return tx, err
+	}
+	return d.wrapTransaction(tx), nil
+}
+
+// NewTransactionWith starts a new transaction on the connection using the
+// isolation level, read only flag and timeout given in opts.
+func (d decorator) NewTransactionWith(opts TxOptions) (Connection, error) {
+	tx, err := d.Connection.NewTransactionWith(opts)
+	if err != nil {
+		return tx, err
+	}
+	return d.wrapTransaction(tx), nil
+}
+
+// Rollback will open a new transaction and automatically rollback that transaction
+// when the inner function returns, regardless. This can be useful for tests, etc.
+// Inside a transaction only a savepoint is rolled back.
+func (d decorator) Rollback(fn func(tx Connection)) error {
+	return d.Connection.Rollback(func(tx Connection) {
+		fn(d.wrapTransaction(tx))
+	})
+}
+
+// Eager will enable load associations of the model.
+// by defaults loads all the associations on the model,
+// but can take a variadic list of associations to load.
+//
+//	c.Eager().Find(model, 1) // will load all associations for model.
+//	c.Eager("Books").Find(model, 1) // will load only Book association for model.
+func (d decorator) Eager(fields ...string) Connection {
+	return d.wrap(d.Connection.Eager(fields...))
+}
@@ -0,0 +1,177 @@
+// Package dump copies the rows of tables between databases through an
+// ipop.Connection. Rows are exported to JSON Lines or CSV files starting with
+// a schema header, and imported back in batches inside a transaction.
+//
+// Both formats start with a line holding the Header as JSON, prefixed with
+// "# " in CSV files, so that a dump can be imported without knowing its
+// format. JSON Lines files then hold an object per row. CSV files hold a
+// record with the column names, then a record per row, with NULL written as
+// \N, and a backslash added to the strings \N, \\N and so on. Timestamps are
+// written in RFC 3339 format in UTC, binary values in base64, and UUIDs as
+// they are stored, so that they survive the round trip.
+package dump
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiihela/ipop"
+)
+
+// Format is the file format of a dump
+type Format string
+
+const (
+	// JSONLines writes a JSON object per row
+	JSONLines Format = "jsonl"
+	// CSV writes a comma separated record per row
+	CSV Format = "csv"
+)
+
+// Conflict is what Import does with rows whose primary key is already in
+// the table
+type Conflict string
+
+const (
+	// ConflictFail rolls the import back with ipop.ErrUniqueViolation
+	ConflictFail Conflict = "fail"
+	// ConflictSkip keeps the row of the table
+	ConflictSkip Conflict = "skip"
+	// ConflictOverwrite replaces the row of the table with the one of the dump
+	ConflictOverwrite Conflict = "overwrite"
+)
+
+// DefaultBatchSize is the number of rows read or written at once when the
+// options do not say
+const DefaultBatchSize = 500
+
+// csvNull is how NULL is written in CSV dumps, the way Postgres COPY does
+const csvNull = `\N`
+
+// csvNullLike reports whether s is made of backslashes followed by N, the
+// strings written with one more backslash in CSV dumps so that they can not
+// be read as csvNull.
+func csvNullLike(s string) bool {
+	return len(s) > 1 && strings.HasSuffix(s, "N") && strings.Trim(s[:len(s)-1], `\`) == ""
+}
+
+// csvHeaderPrefix starts the header line of CSV dumps
+const csvHeaderPrefix = "# "
+
+// Header is the first line of a dump, describing the rows that follow
+type Header struct {
+	// Table is the table the rows were read from
+	Table string `json:"table"`
+	// Dialect is the dialect of the database the rows were read from
+	Dialect string        `json:"dialect"`
+	Columns []ipop.Column `json:"columns"`
+}
+
+func (h Header) columnNames() []string {
+	names := make([]string, len(h.Columns))
+	for i, c := range h.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// readHeader reads the header line of a dump, and tells its format.
+func readHeader(r *bufio.Reader) (Header, Format, error) {
+	var h Header
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return h, "", fmt.Errorf("reading the dump header: %w", err)
+	}
+	format := JSONLines
+	if strings.HasPrefix(line, csvHeaderPrefix) {
+		format, line = CSV, strings.TrimPrefix(line, csvHeaderPrefix)
+	}
+	if err := json.Unmarshal([]byte(line), &h); err != nil {
+		return h, "", fmt.Errorf("reading the dump header: %w", err)
+	}
+	if h.Table == "" || len(h.Columns) == 0 {
+		return h, "", errors.New("the dump header has no table or columns")
+	}
+	return h, format, nil
+}
+
+// encodeValue turns a value read from the database into the one written to
+// the dump: a string, a number, a bool or nil.
+func encodeValue(c ipop.Column, v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		switch c.Kind() {
+		case "blob":
+			return base64.StdEncoding.EncodeToString(v)
+		case "integer", "float":
+			// MySQL returns numbers as text
+			return json.Number(v)
+		}
+		return string(v)
+	}
+	return v
+}
+
+// csvValue writes an encoded value as a CSV field.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return csvNull
+	case string:
+		if csvNullLike(v) {
+			return `\` + v
+		}
+		return v
+	case json.Number:
+		return v.String()
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// decodeValue turns a value of a dump, as decoded from JSON or read from a
+// CSV field, into the one written to the column c.
+func decodeValue(c ipop.Column, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s := fmt.Sprint(v)
+	switch c.Kind() {
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			// dates and times of day are written as read
+			return s, nil
+		}
+		return t, nil
+	case "blob":
+		return base64.StdEncoding.DecodeString(s)
+	case "integer":
+		return strconv.ParseInt(s, 10, 64)
+	case "float":
+		if t := strings.ToLower(c.Type); strings.Contains(t, "numeric") || strings.Contains(t, "decimal") {
+			// keep the precision of exact numbers
+			return s, nil
+		}
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return strconv.ParseBool(s)
+	}
+	return s, nil
+}
@@ -0,0 +1,180 @@
+//go:build sqlite
+// +build sqlite
+
+package dump
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiihela/ipop"
+	"github.com/kiihela/ipop/ipoptest"
+	"github.com/kiihela/ipop/testdata/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const migrations = "../testdata/migrations"
+
+func createUsers(t *testing.T, conn ipop.Connection, names ...string) []models.User {
+	var users []models.User
+	for _, name := range names {
+		u := models.User{Name: name}
+		require.NoError(t, conn.Create(&u))
+		users = append(users, u)
+	}
+	return users
+}
+
+func TestExportImport(t *testing.T) {
+	src := ipoptest.NewSQLite(t, migrations)
+	users := createUsers(t, src, "mark", "jane", "john")
+	require.NoError(t, src.RawQuery("UPDATE users SET created_at = ? WHERE name = ?", time.Date(2020, 2, 29, 12, 30, 0, 123456000, time.UTC), "jane").Exec())
+	require.NoError(t, src.Reload(&users[1]))
+
+	for _, format := range []Format{JSONLines, CSV} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := ExportTable(src, &buf, "users", ExportOptions{Format: format, BatchSize: 2})
+			require.NoError(t, err)
+			assert.Equal(t, 3, n)
+
+			dst := ipoptest.NewSQLite(t, migrations)
+			n, err = Import(dst, &buf, ImportOptions{BatchSize: 2})
+			require.NoError(t, err)
+			assert.Equal(t, 3, n)
+
+			for _, u := range users {
+				var got models.User
+				require.NoError(t, dst.Find(&got, u.ID))
+				assert.Equal(t, u.Name, got.Name)
+				assert.True(t, u.CreatedAt.Equal(got.CreatedAt), "%s created at %s, got %s", u.Name, u.CreatedAt, got.CreatedAt)
+				assert.True(t, u.UpdatedAt.Equal(got.UpdatedAt))
+			}
+		})
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	conn := ipoptest.NewSQLite(t, migrations)
+	users := createUsers(t, conn, "mark")
+	require.NoError(t, conn.RawQuery("CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT, data BLOB, score REAL)").Exec())
+	require.NoError(t, conn.RawQuery("INSERT INTO notes (id, body, data, score) VALUES (1, NULL, ?, 2.5), (2, 'a, \"quoted\" body', NULL, NULL), (3, '\\N', NULL, NULL), (4, '\\\\N', NULL, NULL)", []byte{0, 1, 2}).Exec())
+
+	var buf bytes.Buffer
+	_, err := ExportTable(conn, &buf, "users", ExportOptions{})
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"table": "users", "dialect": "sqlite3", "columns": [
+		{"name": "id", "type": "TEXT", "nullable": true, "primary_key": true},
+		{"name": "name", "type": "TEXT", "nullable": false},
+		{"name": "created_at", "type": "DATETIME", "nullable": false},
+		{"name": "updated_at", "type": "DATETIME", "nullable": false}
+	]}`, lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], `{"id":"`+users[0].ID.String()+`","name":"mark","created_at":"`))
+
+	buf.Reset()
+	_, err = ExportTable(conn, &buf, "notes", ExportOptions{Format: CSV})
+	require.NoError(t, err)
+	csv := buf.String()
+	assert.Equal(t, `# {"table":"notes","dialect":"sqlite3","columns":[`+
+		`{"name":"id","type":"INTEGER","nullable":true,"primary_key":true},`+
+		`{"name":"body","type":"TEXT","nullable":true},`+
+		`{"name":"data","type":"BLOB","nullable":true},`+
+		`{"name":"score","type":"REAL","nullable":true}]}
+id,body,data,score
+1,\N,AAEC,2.5
+2,"a, ""quoted"" body",\N,\N
+3,\\N,\N,\N
+4,\\\N,\N,\N
+`, csv)
+
+	dst := ipoptest.NewSQLite(t, migrations)
+	require.NoError(t, dst.RawQuery("CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT, data BLOB, score REAL)").Exec())
+	_, err = Import(dst, strings.NewReader(csv), ImportOptions{})
+	require.NoError(t, err)
+	buf.Reset()
+	_, err = ExportTable(dst, &buf, "notes", ExportOptions{Format: CSV})
+	require.NoError(t, err)
+	assert.Equal(t, csv, buf.String())
+	var bodies []struct {
+		Body *string `db:"body"`
+	}
+	require.NoError(t, dst.RawQuery("SELECT body FROM notes WHERE id > 2 ORDER BY id").All(&bodies))
+	require.Len(t, bodies, 2)
+	require.NotNil(t, bodies[0].Body)
+	assert.Equal(t, `\N`, *bodies[0].Body)
+	require.NotNil(t, bodies[1].Body)
+	assert.Equal(t, `\\N`, *bodies[1].Body)
+
+	_, err = ExportTable(conn, &buf, "users", ExportOptions{Format: "xml"})
+	assert.EqualError(t, err, `unknown dump format "xml"`)
+}
+
+func TestExportQuery(t *testing.T) {
+	conn := ipoptest.NewSQLite(t, migrations)
+	createUsers(t, conn, "mark", "jane", "john")
+
+	var buf bytes.Buffer
+	q := ipop.NewQueryAdapter(conn.Where("name LIKE ?", "j%").Order("name"))
+	n, err := ExportQuery(conn, &buf, q, "users", ExportOptions{BatchSize: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	dst := ipoptest.NewSQLite(t, migrations)
+	_, err = Import(dst, &buf, ImportOptions{})
+	require.NoError(t, err)
+	var names []string
+	var users []models.User
+	require.NoError(t, dst.Order("name").All(&users))
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	assert.Equal(t, []string{"jane", "john"}, names)
+}
+
+func TestImportConflicts(t *testing.T) {
+	src := ipoptest.NewSQLite(t, migrations)
+	users := createUsers(t, src, "mark", "jane")
+	var buf bytes.Buffer
+	_, err := ExportTable(src, &buf, "users", ExportOptions{})
+	require.NoError(t, err)
+	dump := buf.Bytes()
+
+	dst := ipoptest.NewSQLite(t, migrations)
+	existing := models.User{ID: users[0].ID, Name: "marko"}
+	require.NoError(t, dst.Create(&existing))
+	name := func() string {
+		var u models.User
+		require.NoError(t, dst.Find(&u, users[0].ID))
+		return u.Name
+	}
+
+	_, err = Import(dst, bytes.NewReader(dump), ImportOptions{})
+	assert.ErrorIs(t, err, ipop.ErrUniqueViolation)
+	count, err := dst.Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "a failed import writes nothing")
+
+	n, err := Import(dst, bytes.NewReader(dump), ImportOptions{OnConflict: ConflictSkip})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "marko", name())
+	count, err = dst.Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, err = Import(dst, bytes.NewReader(dump), ImportOptions{OnConflict: ConflictOverwrite})
+	require.NoError(t, err)
+	assert.Equal(t, "mark", name())
+
+	_, err = Import(dst, bytes.NewReader(dump), ImportOptions{OnConflict: "merge"})
+	assert.EqualError(t, err, `unknown conflict handling "merge"`)
+	_, err = Import(dst, bytes.NewReader(dump), ImportOptions{Table: "schema_migration"})
+	assert.EqualError(t, err, "column id of the dump is not in table schema_migration")
+	_, err = Import(dst, strings.NewReader("id,name\n"), ImportOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/kiihela/ipop"
+)
+
+// ExportOptions configures ExportTable and ExportQuery
+type ExportOptions struct {
+	// Format defaults to JSONLines
+	Format Format
+	// BatchSize is the number of rows read at once, DefaultBatchSize when
+	// zero
+	BatchSize int
+}
+
+// ExportTable writes every row of table to w, ordered by primary key, and
+// returns the number of rows written.
+//
+//	f, _ := os.Create("users.jsonl")
+//	n, err := dump.ExportTable(db, f, "users", dump.ExportOptions{})
+func ExportTable(conn ipop.Connection, w io.Writer, table string, opts ExportOptions) (int, error) {
+	pk, err := conn.Inspector().PrimaryKey(table)
+	if err != nil {
+		return 0, err
+	}
+	q := conn.Q()
+	if len(pk) > 0 {
+		order := make([]string, len(pk))
+		for i, c := range pk {
+			order[i] = q.Connection.Dialect.Quote(c)
+		}
+		q = q.Order(strings.Join(order, ", "))
+	}
+	return ExportQuery(conn, w, ipop.NewQueryAdapter(q), table, opts)
+}
+
+// ExportQuery writes the rows of table selected by q to w, and returns the
+// number of rows written. Every column of the table is written, whatever q
+// selects. The rows are read in batches, give q an order for them to be
+// read consistently.
+//
+//	q := ipop.NewQueryAdapter(db.Where("created_at > ?", since).Order("id"))
+//	n, err := dump.ExportQuery(db, f, q, "users", dump.ExportOptions{Format: dump.CSV})
+func ExportQuery(conn ipop.Connection, w io.Writer, q ipop.Query, table string, opts ExportOptions) (int, error) {
+	if opts.Format == "" {
+		opts.Format = JSONLines
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	columns, err := conn.Inspector().Columns(table)
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("table %s has no columns", table)
+	}
+	h := Header{Table: table, Dialect: conn.Dialect(), Columns: columns}
+
+	var write func(values []interface{}) error
+	var flush func() error
+	switch opts.Format {
+	case JSONLines:
+		write = func(values []interface{}) error { return writeJSONLine(w, h, values) }
+		flush = func() error { return nil }
+		err = json.NewEncoder(w).Encode(h)
+	case CSV:
+		cw := csv.NewWriter(w)
+		write = func(values []interface{}) error {
+			record := make([]string, len(values))
+			for i, v := range values {
+				record[i] = csvValue(v)
+			}
+			return cw.Write(record)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		var line []byte
+		if line, err = json.Marshal(h); err == nil {
+			if _, err = fmt.Fprintf(w, "%s%s\n", csvHeaderPrefix, line); err == nil {
+				err = cw.Write(h.columnNames())
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unknown dump format %q", opts.Format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	c := conn.Q().Connection
+	rowType := rowStruct(columns)
+	selected := make([]string, len(columns))
+	for i, col := range columns {
+		selected[i] = c.Dialect.Quote(col.Name)
+	}
+	count := 0
+	for page := 1; ; page++ {
+		stmt, args := q.Paginate(page, opts.BatchSize).ToSQL(&pop.Model{Value: table}, selected...)
+		rows := reflect.New(reflect.SliceOf(rowType))
+		if err := c.Store.Select(rows.Interface(), stmt, args...); err != nil {
+			return count, fmt.Errorf("reading %s: %w", table, err)
+		}
+		n := rows.Elem().Len()
+		for i := 0; i < n; i++ {
+			row := rows.Elem().Index(i)
+			values := make([]interface{}, len(columns))
+			for j, col := range columns {
+				values[j] = encodeValue(col, row.Field(j).Interface())
+			}
+			if err := write(values); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err := flush(); err != nil {
+			return count, err
+		}
+		if n < opts.BatchSize {
+			return count, nil
+		}
+	}
+}
+
+// rowStruct returns a struct type with a field per column, that the rows of
+// a table can be selected into whatever their columns.
+func rowStruct(columns []ipop.Column) reflect.Type {
+	fields := make([]reflect.StructField, len(columns))
+	for i, c := range columns {
+		fields[i] = reflect.StructField{
+			Name: fmt.Sprintf("C%d", i),
+			Type: reflect.TypeOf((*interface{})(nil)).Elem(),
+			Tag:  reflect.StructTag(fmt.Sprintf("db:%q", c.Name)),
+		}
+	}
+	return reflect.StructOf(fields)
+}
+
+// writeJSONLine writes a row as a JSON object, its keys in column order.
+func writeJSONLine(w io.Writer, h Header, values []interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(h.Columns[i].Name)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("writing %s.%s: %w", h.Table, h.Columns[i].Name, err)
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
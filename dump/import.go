@@ -0,0 +1,271 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/kiihela/ipop"
+)
+
+// maxParams bounds the arguments of an INSERT statement, to the lowest limit
+// of the supported databases, the one of older sqlite versions
+const maxParams = 999
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	// Table is the table the rows are written to, the one of the dump header
+	// when empty
+	Table string
+	// BatchSize is the number of rows written at once, DefaultBatchSize when
+	// zero
+	BatchSize int
+	// OnConflict defaults to ConflictFail
+	OnConflict Conflict
+}
+
+// Import writes the rows of the dump read from r, in either format, to the
+// database of conn, and returns the number of rows read. The rows are
+// written inside a single transaction, nothing is written when an error is
+// returned. Conflicts are detected on the primary key of the table.
+//
+//	f, _ := os.Open("users.jsonl")
+//	n, err := dump.Import(db, f, dump.ImportOptions{OnConflict: dump.ConflictSkip})
+func Import(conn ipop.Connection, r io.Reader, opts ImportOptions) (int, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	switch opts.OnConflict {
+	case "":
+		opts.OnConflict = ConflictFail
+	case ConflictFail, ConflictSkip, ConflictOverwrite:
+	default:
+		return 0, fmt.Errorf("unknown conflict handling %q", opts.OnConflict)
+	}
+	br := bufio.NewReader(r)
+	h, format, err := readHeader(br)
+	if err != nil {
+		return 0, err
+	}
+	if opts.Table == "" {
+		opts.Table = h.Table
+	}
+
+	var next func() ([]interface{}, error)
+	switch format {
+	case JSONLines:
+		next = jsonRows(br, h)
+	case CSV:
+		if next, err = csvRows(br, h); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	err = conn.Transaction(func(tx ipop.Connection) error {
+		insert, err := newInserter(tx, opts, h)
+		if err != nil {
+			return err
+		}
+		for {
+			values, err := next()
+			if err == io.EOF {
+				return insert.flush()
+			}
+			if err != nil {
+				return fmt.Errorf("reading row %d: %w", count+1, err)
+			}
+			for i, c := range h.Columns {
+				if values[i], err = decodeValue(c, values[i]); err != nil {
+					return fmt.Errorf("reading row %d, column %s: %w", count+1, c.Name, err)
+				}
+			}
+			count++
+			if err := insert.add(values); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// jsonRows reads the rows of a JSON Lines dump.
+func jsonRows(r io.Reader, h Header) func() ([]interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return func() ([]interface{}, error) {
+		row := map[string]interface{}{}
+		if err := dec.Decode(&row); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(h.Columns))
+		for i, c := range h.Columns {
+			values[i] = row[c.Name]
+		}
+		return values, nil
+	}
+}
+
+// csvRows reads the rows of a CSV dump, after checking the record of column
+// names.
+func csvRows(r io.Reader, h Header) (func() ([]interface{}, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(h.Columns)
+	names, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the column names: %w", err)
+	}
+	if strings.Join(names, ",") != strings.Join(h.columnNames(), ",") {
+		return nil, errors.New("the column names do not match the dump header")
+	}
+	return func() ([]interface{}, error) {
+		record, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(record))
+		for i, field := range record {
+			switch {
+			case field == csvNull:
+				// NULL
+			case csvNullLike(field):
+				values[i] = field[1:]
+			default:
+				values[i] = field
+			}
+		}
+		return values, nil
+	}, nil
+}
+
+// inserter writes rows to a table with multi-row INSERT statements.
+type inserter struct {
+	tx      ipop.Connection
+	prefix  string
+	row     string
+	suffix  string
+	perStmt int
+	rows    int
+	args    []interface{}
+}
+
+func newInserter(tx ipop.Connection, opts ImportOptions, h Header) (*inserter, error) {
+	c := tx.Q().Connection
+	inspector := tx.Inspector()
+	columns, err := inspector.Columns(opts.Table)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, col := range columns {
+		existing[col.Name] = true
+	}
+	names := h.columnNames()
+	quoted := make([]string, len(names))
+	marks := make([]string, len(names))
+	for i, name := range names {
+		if !existing[name] {
+			return nil, fmt.Errorf("column %s of the dump is not in table %s", name, opts.Table)
+		}
+		quoted[i] = c.Dialect.Quote(name)
+		marks[i] = "?"
+	}
+
+	ins := &inserter{
+		tx:      tx,
+		prefix:  fmt.Sprintf("INSERT INTO %s (%s) VALUES ", c.Dialect.Quote(opts.Table), strings.Join(quoted, ", ")),
+		row:     "(" + strings.Join(marks, ", ") + ")",
+		perStmt: opts.BatchSize,
+	}
+	if max := maxParams / len(names); ins.perStmt > max {
+		ins.perStmt = max
+	}
+	if opts.OnConflict != ConflictFail {
+		pk, err := inspector.PrimaryKey(opts.Table)
+		if err != nil {
+			return nil, err
+		}
+		if len(pk) == 0 {
+			return nil, fmt.Errorf("table %s has no primary key to detect conflicts with", opts.Table)
+		}
+		ins.suffix = " " + conflictClause(c, opts.OnConflict, pk, names)
+	}
+	return ins, nil
+}
+
+// conflictClause builds the dialect specific conflict handling part of the
+// INSERT statements.
+func conflictClause(c *pop.Connection, conflict Conflict, pk, names []string) string {
+	var update []string
+	if conflict == ConflictOverwrite {
+		for _, name := range names {
+			if !contains(pk, name) {
+				update = append(update, name)
+			}
+		}
+	}
+	q := c.Dialect.Quote
+	sets := make([]string, 0, len(update))
+	switch c.Dialect.Name() {
+	case "mysql", "mariadb":
+		for _, name := range update {
+			sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", q(name), q(name)))
+		}
+		if len(sets) == 0 {
+			sets = append(sets, fmt.Sprintf("%s = %s", q(pk[0]), q(pk[0])))
+		}
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	default:
+		keys := make([]string, len(pk))
+		for i, name := range pk {
+			keys[i] = q(name)
+		}
+		if len(update) == 0 {
+			return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(keys, ", "))
+		}
+		for _, name := range update {
+			sets = append(sets, fmt.Sprintf("%s = excluded.%s", q(name), q(name)))
+		}
+		return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(sets, ", "))
+	}
+}
+
+func (ins *inserter) add(values []interface{}) error {
+	ins.args = append(ins.args, values...)
+	ins.rows++
+	if ins.rows < ins.perStmt {
+		return nil
+	}
+	return ins.flush()
+}
+
+func (ins *inserter) flush() error {
+	if ins.rows == 0 {
+		return nil
+	}
+	rows := make([]string, ins.rows)
+	for i := range rows {
+		rows[i] = ins.row
+	}
+	stmt := ins.prefix + strings.Join(rows, ", ") + ins.suffix
+	err := ipop.NewQueryAdapter(ins.tx.RawQuery(stmt, ins.args...)).Exec()
+	ins.rows, ins.args = 0, nil
+	return err
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
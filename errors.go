@@ -0,0 +1,225 @@
+package ipop
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/jackc/pgconn"
+)
+
+// These errors are returned, wrapped in an *Error, by every Connection and
+// Query implementation in this package regardless of the database behind
+// it. Check for them with errors.Is.
+var (
+	// ErrNotFound is returned when no record matches a lookup.
+	ErrNotFound = errors.New("record not found")
+	// ErrUniqueViolation is returned when a write collides with a unique
+	// index or primary key.
+	ErrUniqueViolation = errors.New("unique constraint violation")
+	// ErrForeignKeyViolation is returned when a write references a missing
+	// row, or deletes a row that is still referenced.
+	ErrForeignKeyViolation = errors.New("foreign key constraint violation")
+	// ErrCheckViolation is returned when a write fails a check constraint.
+	ErrCheckViolation = errors.New("check constraint violation")
+	// ErrConnectionLost is returned when the connection to the database
+	// broke while running a statement.
+	ErrConnectionLost = errors.New("database connection lost")
+	// ErrSerialization is returned when the database aborted a transaction
+	// because of a concurrent one, retrying it may succeed.
+	ErrSerialization = errors.New("transaction serialization failure")
+	// ErrReadOnly is returned by writes made inside a read only transaction.
+	ErrReadOnly = errors.New("write in a read only transaction")
+
+	// ErrFullTable is returned by UpdateAll and DeleteAll when the query has no
+	// where clause and AllowFullTable has not been called.
+	ErrFullTable = errors.New("refusing to modify every row of the table, use AllowFullTable")
+	// ErrNoTransaction is returned by Savepoint when the connection is not
+	// inside a transaction.
+	ErrNoTransaction = errors.New("savepoints need a transaction")
+	// ErrBudgetExceeded is returned by a strict BudgetedConnection once a
+	// scope used more database work than its Budget allows.
+	ErrBudgetExceeded = errors.New("query budget exceeded")
+	// ErrQueryRejected is returned by a LintedConnection for a statement
+	// breaking a rule its Linter rejects.
+	ErrQueryRejected = errors.New("query rejected by linter")
+	// ErrInvalidMigrations is returned by NewFSMigrator for misnamed or
+	// unpaired migration files.
+	ErrInvalidMigrations = errors.New("invalid migrations")
+	// ErrInvalidModels is returned by ValidateModels for models that can not
+	// be stored in their tables.
+	ErrInvalidModels = errors.New("invalid models")
+)
+
+// Error carries the details of a database error that was mapped onto one of
+// the sentinel errors. errors.Is matches both Kind and the original error.
+type Error struct {
+	// Kind is one of the sentinel errors of this package
+	Kind error
+	// Table, Column and Constraint are filled in as far as the driver
+	// reports them
+	Table      string
+	Column     string
+	Constraint string
+	// Err is the original error returned by pop or the driver
+	Err error
+}
+
+func (e *Error) Error() string {
+	var details []string
+	if e.Table != "" {
+		details = append(details, "table "+e.Table)
+	}
+	if e.Column != "" {
+		details = append(details, "column "+e.Column)
+	}
+	if e.Constraint != "" {
+		details = append(details, "constraint "+e.Constraint)
+	}
+
+	msg := e.Kind.Error()
+	if len(details) > 0 {
+		msg = fmt.Sprintf("%s (%s)", msg, strings.Join(details, ", "))
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %s", msg, e.Err)
+	}
+	return msg
+}
+
+// Unwrap makes both the sentinel and the original error reachable through
+// errors.Is and errors.As.
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// errorMappers translate driver specific errors. Drivers that need a build
+// tag register theirs from init.
+var errorMappers = []func(err error) *Error{
+	mapPostgresError,
+	mapMySQLError,
+}
+
+// mapError translates err into an *Error when it matches one of the known
+// failure kinds. model, when not nil, is used to fill in the table name the
+// driver did not report. Errors already holding an *Error are returned as
+// they are, keeping the context they were wrapped with.
+func mapError(err error, model interface{}) error {
+	if err == nil {
+		return nil
+	}
+
+	var mapped *Error
+	if errors.As(err, &mapped) {
+		return err
+	}
+	mapped = classifyError(err)
+	if mapped == nil {
+		return err
+	}
+	if mapped.Table == "" && model != nil {
+		mapped.Table = pop.NewModel(model, nil).TableName()
+	}
+	return mapped
+}
+
+func classifyError(err error) *Error {
+	for _, kind := range []error{ErrNotFound, ErrUniqueViolation, ErrForeignKeyViolation, ErrCheckViolation, ErrConnectionLost, ErrSerialization, ErrReadOnly} {
+		if errors.Is(err, kind) {
+			return &Error{Kind: kind, Err: err}
+		}
+	}
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return &Error{Kind: ErrNotFound, Err: err}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone):
+		return &Error{Kind: ErrConnectionLost, Err: err}
+	}
+
+	for _, m := range errorMappers {
+		if mapped := m(err); mapped != nil {
+			return mapped
+		}
+	}
+	return nil
+}
+
+func mapPostgresError(err error) *Error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return nil
+	}
+
+	e := &Error{Table: pgErr.TableName, Column: pgErr.ColumnName, Constraint: pgErr.ConstraintName, Err: err}
+	switch code := pgErr.Code; {
+	case code == "23505":
+		e.Kind = ErrUniqueViolation
+	case code == "23503":
+		e.Kind = ErrForeignKeyViolation
+	case code == "23514":
+		e.Kind = ErrCheckViolation
+	case code == "40001", code == "40P01":
+		e.Kind = ErrSerialization
+	case code == "25006":
+		e.Kind = ErrReadOnly
+	case strings.HasPrefix(code, "08"), code == "57P01":
+		e.Kind = ErrConnectionLost
+	default:
+		return nil
+	}
+	return e
+}
+
+var (
+	mysqlDuplicateKey = regexp.MustCompile("for key '(?:([^'.]+)\\.)?([^']+)'")
+	mysqlForeignKey   = regexp.MustCompile("`([^`]+)`, CONSTRAINT `([^`]+)`")
+	mysqlCheck        = regexp.MustCompile("[Cc]heck constraint '([^']+)'")
+)
+
+func mapMySQLError(err error) *Error {
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return &Error{Kind: ErrConnectionLost, Err: err}
+	}
+
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return nil
+	}
+
+	e := &Error{Err: err}
+	switch myErr.Number {
+	case 1062, 1586:
+		e.Kind = ErrUniqueViolation
+		if m := mysqlDuplicateKey.FindStringSubmatch(myErr.Message); m != nil {
+			e.Table, e.Constraint = m[1], m[2]
+		}
+	case 1216, 1217, 1451, 1452:
+		e.Kind = ErrForeignKeyViolation
+		if m := mysqlForeignKey.FindStringSubmatch(myErr.Message); m != nil {
+			e.Table, e.Constraint = m[1], m[2]
+		}
+	case 3819:
+		e.Kind = ErrCheckViolation
+		if m := mysqlCheck.FindStringSubmatch(myErr.Message); m != nil {
+			e.Constraint = m[1]
+		}
+	case 1213, 1205:
+		e.Kind = ErrSerialization
+	case 1792:
+		e.Kind = ErrReadOnly
+	case 2006, 2013:
+		e.Kind = ErrConnectionLost
+	default:
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,66 @@
+//go:build sqlite
+// +build sqlite
+
+package ipop
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	errorMappers = append(errorMappers, mapSQLiteError)
+}
+
+func mapSQLiteError(err error) *Error {
+	var liteErr sqlite3.Error
+	if !errors.As(err, &liteErr) {
+		return nil
+	}
+
+	e := &Error{Err: err}
+	switch liteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		e.Kind = ErrUniqueViolation
+		e.Table, e.Column = sqliteConstraintColumns(liteErr.Error())
+	case sqlite3.ErrConstraintForeignKey:
+		e.Kind = ErrForeignKeyViolation
+	case sqlite3.ErrConstraintCheck:
+		e.Kind = ErrCheckViolation
+		if i := strings.LastIndex(liteErr.Error(), ": "); i >= 0 {
+			e.Constraint = liteErr.Error()[i+2:]
+		}
+	default:
+		switch liteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			e.Kind = ErrSerialization
+		case sqlite3.ErrReadonly:
+			e.Kind = ErrReadOnly
+		default:
+			return nil
+		}
+	}
+	return e
+}
+
+// sqliteConstraintColumns reads the table and columns out of messages like
+// "UNIQUE constraint failed: users.name, users.email".
+func sqliteConstraintColumns(msg string) (table string, column string) {
+	i := strings.LastIndex(msg, ": ")
+	if i < 0 {
+		return "", ""
+	}
+
+	var cols []string
+	for _, c := range strings.Split(msg[i+2:], ", ") {
+		parts := strings.SplitN(c, ".", 2)
+		if len(parts) != 2 {
+			return "", ""
+		}
+		table = parts[0]
+		cols = append(cols, parts[1])
+	}
+	return table, strings.Join(cols, ",")
+}
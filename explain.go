@@ -0,0 +1,237 @@
+package ipop
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// Plan is the query plan the database chose for a query, as returned by
+// Query.Explain.
+type Plan struct {
+	// Dialect is the name of the database that produced the plan
+	Dialect string
+	// SQL is the statement that was explained
+	SQL string
+	// Nodes are the steps of the plan, with their sub steps as children
+	Nodes []PlanNode
+	// Raw is the output of EXPLAIN as returned by the database
+	Raw string
+}
+
+// PlanNode is a step of a Plan
+type PlanNode struct {
+	// Operation is the kind of step, such as "SCAN" or "SEARCH" on sqlite,
+	// "Seq Scan" on Postgres, or the access type on MySQL
+	Operation string
+	// Table and Index are the table read by the step and the index used, if any
+	Table string
+	Index string
+	// FullScan is true when the step reads every row of Table
+	FullScan bool
+	// Detail is the description of the step given by the database
+	Detail   string
+	Children []PlanNode
+}
+
+// FullScans returns the steps of the plan reading every row of a table
+func (p Plan) FullScans() []PlanNode {
+	var scans []PlanNode
+	var walk func(nodes []PlanNode)
+	walk = func(nodes []PlanNode) {
+		for _, n := range nodes {
+			if n.FullScan {
+				scans = append(scans, n)
+			}
+			walk(n.Children)
+		}
+	}
+	walk(p.Nodes)
+	return scans
+}
+
+func (p Plan) String() string {
+	var b strings.Builder
+	var walk func(nodes []PlanNode, depth int)
+	walk = func(nodes []PlanNode, depth int) {
+		for _, n := range nodes {
+			fmt.Fprintf(&b, "%s%s\n", strings.Repeat("  ", depth), n.Detail)
+			walk(n.Children, depth+1)
+		}
+	}
+	walk(p.Nodes, 0)
+	return b.String()
+}
+
+// explain runs the EXPLAIN statement of the dialect of q for the SQL q
+// builds for model.
+func explain(q *pop.Query, model interface{}) (Plan, error) {
+	conn := q.Connection
+	stmt, args := q.ToSQL(pop.NewModel(model, conn.Context()))
+	plan := Plan{Dialect: conn.Dialect.Name(), SQL: stmt}
+
+	switch plan.Dialect {
+	case "sqlite3":
+		rows := []struct {
+			ID      int    `db:"id"`
+			Parent  int    `db:"parent"`
+			NotUsed int    `db:"notused"`
+			Detail  string `db:"detail"`
+		}{}
+		if err := conn.Store.Select(&rows, "EXPLAIN QUERY PLAN "+stmt, args...); err != nil {
+			return plan, err
+		}
+		nodes := map[int]*PlanNode{}
+		parents := map[int]int{}
+		order := []int{}
+		lines := []string{}
+		for _, r := range rows {
+			n := parseSQLitePlan(r.Detail)
+			nodes[r.ID] = &n
+			parents[r.ID] = r.Parent
+			order = append(order, r.ID)
+			lines = append(lines, fmt.Sprintf("%d|%d|%s", r.ID, r.Parent, r.Detail))
+		}
+		plan.Raw = strings.Join(lines, "\n")
+		plan.Nodes = buildPlanTree(nodes, parents, order, 0)
+	case "postgres", "cockroach":
+		out := []string{}
+		if err := conn.Store.Select(&out, "EXPLAIN (FORMAT JSON) "+stmt, args...); err != nil {
+			return plan, err
+		}
+		plan.Raw = strings.Join(out, "\n")
+		nodes, err := parsePostgresPlan(plan.Raw)
+		if err != nil {
+			return plan, err
+		}
+		plan.Nodes = nodes
+	case "mysql", "mariadb":
+		out := []string{}
+		if err := conn.Store.Select(&out, "EXPLAIN FORMAT=JSON "+stmt, args...); err != nil {
+			return plan, err
+		}
+		plan.Raw = strings.Join(out, "\n")
+		nodes, err := parseMySQLPlan(plan.Raw)
+		if err != nil {
+			return plan, err
+		}
+		plan.Nodes = nodes
+	default:
+		return plan, fmt.Errorf("explain is not supported for %s", plan.Dialect)
+	}
+	return plan, nil
+}
+
+func buildPlanTree(nodes map[int]*PlanNode, parents map[int]int, order []int, parent int) []PlanNode {
+	var tree []PlanNode
+	for _, id := range order {
+		if parents[id] != parent || id == parent {
+			continue
+		}
+		n := *nodes[id]
+		n.Children = buildPlanTree(nodes, parents, order, id)
+		tree = append(tree, n)
+	}
+	return tree
+}
+
+var sqlitePlanStep = regexp.MustCompile(`^(SCAN|SEARCH)\s+(?:TABLE\s+)?(\S+)(.*)$`)
+var sqlitePlanIndex = regexp.MustCompile(`USING (?:COVERING )?INDEX (\S+)|USING (INTEGER PRIMARY KEY|PRIMARY KEY)`)
+
+// parseSQLitePlan reads a line of EXPLAIN QUERY PLAN, such as
+// "SEARCH users USING INDEX users_name_idx (name=?)".
+func parseSQLitePlan(detail string) PlanNode {
+	n := PlanNode{Detail: detail, Operation: strings.SplitN(detail, " ", 2)[0]}
+	m := sqlitePlanStep.FindStringSubmatch(detail)
+	if m == nil {
+		return n
+	}
+	n.Table = m[2]
+	if idx := sqlitePlanIndex.FindStringSubmatch(m[3]); idx != nil {
+		n.Index = idx[1] + idx[2]
+	}
+	n.FullScan = m[1] == "SCAN" && n.Index == "" && n.Table != "CONSTANT"
+	return n
+}
+
+type postgresPlanNode struct {
+	NodeType     string             `json:"Node Type"`
+	RelationName string             `json:"Relation Name"`
+	IndexName    string             `json:"Index Name"`
+	Plans        []postgresPlanNode `json:"Plans"`
+}
+
+func (p postgresPlanNode) node() PlanNode {
+	n := PlanNode{
+		Operation: p.NodeType,
+		Table:     p.RelationName,
+		Index:     p.IndexName,
+		FullScan:  p.NodeType == "Seq Scan",
+		Detail:    strings.TrimSpace(fmt.Sprintf("%s %s", p.NodeType, p.RelationName)),
+	}
+	for _, c := range p.Plans {
+		n.Children = append(n.Children, c.node())
+	}
+	return n
+}
+
+// parsePostgresPlan reads the output of EXPLAIN (FORMAT JSON).
+func parsePostgresPlan(raw string) ([]PlanNode, error) {
+	var out []struct {
+		Plan postgresPlanNode `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(raw), &out); err != nil {
+		return nil, err
+	}
+	var nodes []PlanNode
+	for _, o := range out {
+		nodes = append(nodes, o.Plan.node())
+	}
+	return nodes, nil
+}
+
+// parseMySQLPlan reads the output of EXPLAIN FORMAT=JSON, where every table
+// read is an object under a "table" key, nested in query blocks and loops.
+func parseMySQLPlan(raw string) ([]PlanNode, error) {
+	var out interface{}
+	if err := json.Unmarshal([]byte(raw), &out); err != nil {
+		return nil, err
+	}
+	var nodes []PlanNode
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if t, ok := v["table"].(map[string]interface{}); ok {
+				access, _ := t["access_type"].(string)
+				table, _ := t["table_name"].(string)
+				index, _ := t["key"].(string)
+				nodes = append(nodes, PlanNode{
+					Operation: access,
+					Table:     table,
+					Index:     index,
+					FullScan:  access == "ALL",
+					Detail:    strings.TrimSpace(fmt.Sprintf("%s %s %s", access, table, index)),
+				})
+			}
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(v[k])
+			}
+		case []interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		}
+	}
+	walk(out)
+	return nodes, nil
+}
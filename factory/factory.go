@@ -0,0 +1,169 @@
+// Package factory builds models for tests, numbering them with a sequence
+// so that each one is unique.
+//
+//	users := factory.Define(func(seq int) models.User {
+//		return models.User{Name: fmt.Sprintf("User #%d", seq)}
+//	}).Trait("admin", func(u *models.User) { u.Name = "Admin " + u.Name })
+//
+//	user := users.Build()                              // in memory
+//	admin, err := users.Create(db, users.With("admin")) // stored through db
+package factory
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kiihela/ipop"
+)
+
+// Factory builds models of type T
+type Factory[T any] struct {
+	seq     *sequence
+	build   func(seq int) T
+	traits  map[string]func(*T)
+	assocs  []func(v *T, conn ipop.Connection) error
+	orphans bool
+}
+
+// sequence numbers the models of a factory, shared with its Orphans view
+type sequence struct {
+	mu sync.Mutex
+	n  int
+}
+
+// Define creates a Factory building its models with build, called with the
+// next number of the sequence, from 1.
+func Define[T any](build func(seq int) T) *Factory[T] {
+	return &Factory[T]{seq: &sequence{}, build: build, traits: map[string]func(*T){}}
+}
+
+// Trait registers a named set of changes, applied with With.
+func (f *Factory[T]) Trait(name string, fn func(*T)) *Factory[T] {
+	f.traits[name] = fn
+	return f
+}
+
+// With returns an override applying the named traits, in order. It panics
+// when a trait is not registered.
+func (f *Factory[T]) With(traits ...string) func(*T) {
+	fns := make([]func(*T), len(traits))
+	for i, name := range traits {
+		fn, ok := f.traits[name]
+		if !ok {
+			panic(fmt.Sprintf("factory: no trait named %q for %T", name, *new(T)))
+		}
+		fns[i] = fn
+	}
+	return func(v *T) {
+		for _, fn := range fns {
+			fn(v)
+		}
+	}
+}
+
+// BelongsTo makes f build a parent with the parent factory for each model,
+// set on it with set. Create stores the parent before the model. Use Orphans
+// for models whose overrides set the parent themselves.
+//
+//	factory.BelongsTo(teams, users, func(t *models.Team, u *models.User) { t.Leader = *u })
+func BelongsTo[T, P any](f *Factory[T], parent *Factory[P], set func(v *T, parent *P)) *Factory[T] {
+	f.assocs = append(f.assocs, func(v *T, conn ipop.Connection) error {
+		if conn == nil {
+			p := parent.Build()
+			set(v, &p)
+			return nil
+		}
+		p, err := parent.Create(conn)
+		if err != nil {
+			return err
+		}
+		set(v, &p)
+		return nil
+	})
+	return f
+}
+
+// Orphans returns a view of f building its models without the parents
+// registered with BelongsTo, sharing the sequence and traits of f.
+//
+//	projects.Orphans().Create(db, func(p *models.Project) { p.OwnerID = owner.ID })
+func (f *Factory[T]) Orphans() *Factory[T] {
+	orphans := *f
+	orphans.orphans = true
+	return &orphans
+}
+
+// Sequence returns the last number of the sequence handed out
+func (f *Factory[T]) Sequence() int {
+	f.seq.mu.Lock()
+	defer f.seq.mu.Unlock()
+	return f.seq.n
+}
+
+// ResetSequence starts the sequence over from 1
+func (f *Factory[T]) ResetSequence() {
+	f.seq.mu.Lock()
+	defer f.seq.mu.Unlock()
+	f.seq.n = 0
+}
+
+func (f *Factory[T]) next() int {
+	f.seq.mu.Lock()
+	defer f.seq.mu.Unlock()
+	f.seq.n++
+	return f.seq.n
+}
+
+// make builds a model, creating its parents through conn unless nil. The
+// overrides run last, so that they can see and change the parents.
+func (f *Factory[T]) make(conn ipop.Connection, overrides []func(*T)) (T, error) {
+	v := f.build(f.next())
+	if !f.orphans {
+		for _, assoc := range f.assocs {
+			if err := assoc(&v, conn); err != nil {
+				return v, err
+			}
+		}
+	}
+	for _, o := range overrides {
+		o(&v)
+	}
+	return v, nil
+}
+
+// Build returns a new model without storing it, nor its parents.
+func (f *Factory[T]) Build(overrides ...func(*T)) T {
+	v, _ := f.make(nil, overrides)
+	return v
+}
+
+// BuildList returns n new models without storing them.
+func (f *Factory[T]) BuildList(n int, overrides ...func(*T)) []T {
+	list := make([]T, n)
+	for i := range list {
+		list[i] = f.Build(overrides...)
+	}
+	return list
+}
+
+// Create builds a new model and stores it through conn, after its parents.
+func (f *Factory[T]) Create(conn ipop.Connection, overrides ...func(*T)) (T, error) {
+	v, err := f.make(conn, overrides)
+	if err != nil {
+		return v, err
+	}
+	return v, conn.Create(&v)
+}
+
+// CreateList builds n new models and stores them through conn.
+func (f *Factory[T]) CreateList(conn ipop.Connection, n int, overrides ...func(*T)) ([]T, error) {
+	list := make([]T, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := f.Create(conn, overrides...)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
@@ -0,0 +1,91 @@
+//go:build sqlite
+// +build sqlite
+
+package factory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/kiihela/ipop"
+	"github.com/kiihela/ipop/ipoptest"
+	"github.com/kiihela/ipop/testdata/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFactories() (*Factory[models.User], *Factory[models.Project]) {
+	users := Define(func(seq int) models.User {
+		return models.User{Name: fmt.Sprintf("User #%d", seq)}
+	}).Trait("admin", func(u *models.User) {
+		u.Name = "Admin " + u.Name
+	})
+	projects := BelongsTo(Define(func(seq int) models.Project {
+		return models.Project{Name: fmt.Sprintf("Project #%d", seq)}
+	}), users, func(p *models.Project, u *models.User) {
+		p.OwnerID = u.ID
+		p.Owner = *u
+	}).Trait("owned", func(p *models.Project) {
+		p.Name = p.Owner.Name + "'s project"
+	})
+	return users, projects
+}
+
+func TestFactory_Build(t *testing.T) {
+	users, projects := newFactories()
+
+	assert.Equal(t, "User #1", users.Build().Name)
+	assert.Equal(t, "Admin User #2", users.Build(users.With("admin")).Name)
+	assert.Equal(t, "Bob", users.Build(users.With("admin"), func(u *models.User) { u.Name = "Bob" }).Name)
+	assert.Equal(t, 3, users.Sequence())
+
+	list := users.BuildList(2)
+	assert.Equal(t, []string{"User #4", "User #5"}, []string{list[0].Name, list[1].Name})
+
+	users.ResetSequence()
+	p := projects.Build()
+	assert.Equal(t, "Project #1", p.Name)
+	assert.Equal(t, "User #1", p.Owner.Name)
+	assert.Equal(t, uuid.Nil, p.OwnerID)
+	assert.Equal(t, "User #2's project", projects.Build(projects.With("owned")).Name)
+	bob := models.User{Name: "Bob"}
+	assert.Equal(t, "Bob", projects.Orphans().Build(func(p *models.Project) { p.Owner = bob }).Owner.Name)
+	assert.Equal(t, 2, users.Sequence())
+	assert.Equal(t, 3, projects.Sequence())
+
+	assert.Panics(t, func() { users.With("deleted") })
+}
+
+func TestFactory_Create(t *testing.T) {
+	db := ipoptest.NewSQLite(t, "../testdata/migrations")
+	users, projects := newFactories()
+
+	p, err := projects.Create(db)
+	require.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, p.OwnerID)
+
+	owner := models.User{}
+	require.NoError(t, db.Find(&owner, p.OwnerID))
+	assert.Equal(t, "User #1", owner.Name)
+
+	list, err := users.CreateList(db, 2, users.With("admin"))
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+	count, err := db.Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	p, err = projects.Orphans().Create(db, func(p *models.Project) {
+		p.Owner = list[0]
+		p.OwnerID = list[0].ID
+	})
+	require.NoError(t, err)
+	assert.Equal(t, list[0].ID, p.OwnerID)
+	count, err = db.Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count, "orphans are created without parents")
+
+	_, err = users.Create(db, func(u *models.User) { u.ID = list[0].ID })
+	assert.ErrorIs(t, err, ipop.ErrUniqueViolation)
+}
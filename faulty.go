@@ -0,0 +1,432 @@
+package ipop
+
+import (
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/validate/v3"
+)
+
+// ErrInjectedFault is returned by a FaultyConnection for a FaultError rule
+// that does not set its own error.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultKind is the failure a FaultRule injects
+type FaultKind int
+
+const (
+	// FaultError makes the call fail with the rule's error without running it
+	FaultError FaultKind = iota
+	// FaultLatency delays the call by the rule's latency, then runs it
+	FaultLatency
+	// FaultDrop makes the call fail with ErrConnectionLost, and every later
+	// call in the same transaction too
+	FaultDrop
+	// FaultPartial runs the call, then fails with the rule's error anyway, as
+	// when the connection breaks before the result is read
+	FaultPartial
+)
+
+// FaultScope restricts a FaultRule to calls made inside or outside of a
+// transaction
+type FaultScope int
+
+const (
+	// AnyTransaction matches every call
+	AnyTransaction FaultScope = iota
+	// InTransaction only matches calls made inside a transaction
+	InTransaction
+	// OutsideTransaction only matches calls made outside of a transaction
+	OutsideTransaction
+)
+
+// FaultRule describes which calls of a FaultyConnection fail, and how. The
+// zero value of every matcher matches any call.
+type FaultRule struct {
+	// Method is the name of the Connection method, such as "Create",
+	// "Transaction" or "Commit"
+	Method string
+	// Model matches calls on models of the same type, pointers and slices
+	// aside
+	Model interface{}
+	// Scope matches calls inside or outside of a transaction
+	Scope FaultScope
+	// Nth only fires on the nth matching call, counting from 1
+	Nth int
+	// Probability is the chance for a matching call to fail, drawn from a
+	// random source seeded with Seed so that runs are repeatable. Zero
+	// means always.
+	Probability float64
+	Seed        int64
+
+	Kind FaultKind
+	// Err is returned by FaultError and FaultPartial, ErrInjectedFault when
+	// nil. It is mapped like a driver error, so sql.ErrNoRows is seen as
+	// ErrNotFound.
+	Err error
+	// Latency is the delay added by FaultLatency
+	Latency time.Duration
+}
+
+func (r FaultRule) err() error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return ErrInjectedFault
+}
+
+// FaultyConnection decorates a Connection, injecting failures into the
+// calls matching its rules, so that retry and rollback paths can be tested.
+type FaultyConnection struct {
+	decorator
+	state *faultState
+	tx    *faultTx
+}
+
+type faultState struct {
+	mu       sync.Mutex
+	rules    []FaultRule
+	calls    []int
+	rand     []*rand.Rand
+	injected int
+}
+
+type faultTx struct {
+	mu      sync.Mutex
+	dropped bool
+}
+
+// Faulty wraps conn so that the calls matching rules fail. The first rule
+// firing for a call wins.
+//
+//	conn := Faulty(db, []FaultRule{
+//		{Method: "Update", Model: &User{}, Scope: InTransaction, Nth: 2},
+//		{Method: "Find", Probability: 0.1, Seed: 42, Kind: FaultDrop},
+//	})
+func Faulty(conn Connection, rules []FaultRule) *FaultyConnection {
+	state := &faultState{rules: rules, calls: make([]int, len(rules))}
+	for _, r := range rules {
+		state.rand = append(state.rand, rand.New(rand.NewSource(r.Seed)))
+	}
+	return newFaultyConnection(conn, state, nil)
+}
+
+func newFaultyConnection(conn Connection, state *faultState, tx *faultTx) *FaultyConnection {
+	c := &FaultyConnection{state: state, tx: tx}
+	c.decorator = decorator{
+		Connection: conn,
+		wrap: func(conn Connection) Connection {
+			return newFaultyConnection(conn, state, tx)
+		},
+		wrapTx: func(conn Connection) Connection {
+			if tx == nil {
+				return newFaultyConnection(conn, state, &faultTx{})
+			}
+			return newFaultyConnection(conn, state, tx)
+		},
+	}
+	return c
+}
+
+// Injected returns how many faults have been injected so far
+func (c *FaultyConnection) Injected() int {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	return c.state.injected
+}
+
+// match returns the rule firing for the call, if any.
+func (s *faultState) match(method string, model interface{}, inTx bool) *FaultRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.rules {
+		if r.Method != "" && r.Method != method {
+			continue
+		}
+		if r.Model != nil && (model == nil || baseType(r.Model) != baseType(model)) {
+			continue
+		}
+		if (r.Scope == InTransaction && !inTx) || (r.Scope == OutsideTransaction && inTx) {
+			continue
+		}
+		s.calls[i]++
+		if r.Nth > 0 && s.calls[i] != r.Nth {
+			continue
+		}
+		if r.Probability > 0 && s.rand[i].Float64() >= r.Probability {
+			continue
+		}
+		s.injected++
+		return &s.rules[i]
+	}
+	return nil
+}
+
+// baseType returns the type of model with pointers and slices stripped.
+func baseType(model interface{}) reflect.Type {
+	t := reflect.TypeOf(model)
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		t = t.Elem()
+	}
+	return t
+}
+
+// call runs fn unless a rule makes the call fail.
+func (c *FaultyConnection) call(method string, model interface{}, fn func() error) error {
+	if c.tx != nil {
+		c.tx.mu.Lock()
+		dropped := c.tx.dropped
+		c.tx.mu.Unlock()
+		if dropped {
+			return mapError(driver.ErrBadConn, model)
+		}
+	}
+
+	rule := c.state.match(method, model, c.tx != nil)
+	if rule == nil {
+		return fn()
+	}
+	switch rule.Kind {
+	case FaultLatency:
+		time.Sleep(rule.Latency)
+		return fn()
+	case FaultDrop:
+		if c.tx != nil {
+			c.tx.mu.Lock()
+			c.tx.dropped = true
+			c.tx.mu.Unlock()
+		}
+		return mapError(driver.ErrBadConn, model)
+	case FaultPartial:
+		if err := fn(); err != nil {
+			return err
+		}
+		return mapError(rule.err(), model)
+	default:
+		return mapError(rule.err(), model)
+	}
+}
+
+// Transaction will start a new transaction on the connection. Rules on
+// "Transaction" fail it before it starts, or after it committed for
+// FaultPartial.
+func (c *FaultyConnection) Transaction(fn func(tx Connection) error) error {
+	return c.call("Transaction", nil, func() error {
+		return c.decorator.Transaction(fn)
+	})
+}
+
+// TransactionWith works like Transaction, using the given options.
+func (c *FaultyConnection) TransactionWith(opts TxOptions, fn func(tx Connection) error) error {
+	return c.call("TransactionWith", nil, func() error {
+		return c.decorator.TransactionWith(opts, fn)
+	})
+}
+
+// Savepoint runs fn inside a named savepoint of the current transaction.
+func (c *FaultyConnection) Savepoint(name string, fn func(tx Connection) error) error {
+	return c.call("Savepoint", nil, func() error {
+		return c.decorator.Savepoint(name, fn)
+	})
+}
+
+// Rollback will open a new transaction and automatically rollback that
+// transaction when the inner function returns.
+func (c *FaultyConnection) Rollback(fn func(tx Connection)) error {
+	return c.call("Rollback", nil, func() error {
+		return c.decorator.Rollback(fn)
+	})
+}
+
+// NewTransaction starts a new transaction on the connection. A transaction
+// started by a call failing with FaultPartial is rolled back.
+func (c *FaultyConnection) NewTransaction() (Connection, error) {
+	return c.begin("NewTransaction", c.Connection.NewTransaction)
+}
+
+// NewTransactionWith starts a new transaction on the connection using the
+// given options.
+func (c *FaultyConnection) NewTransactionWith(opts TxOptions) (Connection, error) {
+	return c.begin("NewTransactionWith", func() (Connection, error) {
+		return c.Connection.NewTransactionWith(opts)
+	})
+}
+
+func (c *FaultyConnection) begin(method string, fn func() (Connection, error)) (Connection, error) {
+	var tx Connection
+	err := c.call(method, nil, func() error {
+		var err error
+		tx, err = fn()
+		return err
+	})
+	if err != nil {
+		if tx != nil {
+			_ = tx.RollbackTransaction()
+		}
+		return nil, err
+	}
+	return c.wrapTransaction(tx), nil
+}
+
+// Commit commits the transaction started with NewTransaction or
+// NewTransactionWith. When a rule fails it before it runs, the transaction
+// is rolled back, as the database does with a failed commit.
+func (c *FaultyConnection) Commit() error {
+	return c.end("Commit", c.Connection.Commit)
+}
+
+// RollbackTransaction rolls back the transaction started with NewTransaction
+// or NewTransactionWith. The transaction is rolled back even when a rule
+// fails the call.
+func (c *FaultyConnection) RollbackTransaction() error {
+	return c.end("RollbackTransaction", c.Connection.RollbackTransaction)
+}
+
+func (c *FaultyConnection) end(method string, fn func() error) error {
+	ran := false
+	err := c.call(method, nil, func() error {
+		ran = true
+		return fn()
+	})
+	if !ran {
+		_ = c.Connection.RollbackTransaction()
+	}
+	return err
+}
+
+// Reload fetch fresh data for a given model, using its ID.
+func (c *FaultyConnection) Reload(model interface{}) error {
+	return c.call("Reload", model, func() error {
+		return c.Connection.Reload(model)
+	})
+}
+
+// ValidateAndSave applies validation rules on the given entry, then save it
+// if the validation succeed, excluding the given columns.
+func (c *FaultyConnection) ValidateAndSave(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.call("ValidateAndSave", model, func() error {
+		var err error
+		verrs, err = c.Connection.ValidateAndSave(model, excludeColumns...)
+		return err
+	})
+	return verrs, err
+}
+
+// Save wraps the Create and Update methods. It executes a Create if no ID is provided with the entry;
+// or issues an Update otherwise.
+func (c *FaultyConnection) Save(model interface{}, excludeColumns ...string) error {
+	return c.call("Save", model, func() error {
+		return c.Connection.Save(model, excludeColumns...)
+	})
+}
+
+// ValidateAndCreate applies validation rules on the given entry, then creates it
+// if the validation succeed, excluding the given columns.
+func (c *FaultyConnection) ValidateAndCreate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.call("ValidateAndCreate", model, func() error {
+		var err error
+		verrs, err = c.Connection.ValidateAndCreate(model, excludeColumns...)
+		return err
+	})
+	return verrs, err
+}
+
+// Create add a new given entry to the database, excluding the given columns.
+func (c *FaultyConnection) Create(model interface{}, excludeColumns ...string) error {
+	return c.call("Create", model, func() error {
+		return c.Connection.Create(model, excludeColumns...)
+	})
+}
+
+// ValidateAndUpdate applies validation rules on the given entry, then update it
+// if the validation succeed, excluding the given columns.
+func (c *FaultyConnection) ValidateAndUpdate(model interface{}, excludeColumns ...string) (*validate.Errors, error) {
+	var verrs *validate.Errors
+	err := c.call("ValidateAndUpdate", model, func() error {
+		var err error
+		verrs, err = c.Connection.ValidateAndUpdate(model, excludeColumns...)
+		return err
+	})
+	return verrs, err
+}
+
+// Update writes changes from an entry to the database, excluding the given columns.
+func (c *FaultyConnection) Update(model interface{}, excludeColumns ...string) error {
+	return c.call("Update", model, func() error {
+		return c.Connection.Update(model, excludeColumns...)
+	})
+}
+
+// Upsert inserts the given entry, or updates the row it conflicts with.
+func (c *FaultyConnection) Upsert(model interface{}, conflictColumns []string, updateColumns ...string) error {
+	return c.call("Upsert", model, func() error {
+		return c.Connection.Upsert(model, conflictColumns, updateColumns...)
+	})
+}
+
+// Destroy deletes a given entry from the database.
+func (c *FaultyConnection) Destroy(model interface{}) error {
+	return c.call("Destroy", model, func() error {
+		return c.Connection.Destroy(model)
+	})
+}
+
+// Find the first record of the model in the database with a particular id.
+func (c *FaultyConnection) Find(model interface{}, id interface{}) error {
+	return c.call("Find", model, func() error {
+		return c.Connection.Find(model, id)
+	})
+}
+
+// First record of the model in the database that matches the query.
+func (c *FaultyConnection) First(model interface{}) error {
+	return c.call("First", model, func() error {
+		return c.Connection.First(model)
+	})
+}
+
+// Last record of the model in the database that matches the query.
+func (c *FaultyConnection) Last(model interface{}) error {
+	return c.call("Last", model, func() error {
+		return c.Connection.Last(model)
+	})
+}
+
+// All retrieves all of the records in the database that match the query.
+func (c *FaultyConnection) All(models interface{}) error {
+	return c.call("All", models, func() error {
+		return c.Connection.All(models)
+	})
+}
+
+// Load loads all association or the fields specified in params for
+// an already loaded model.
+func (c *FaultyConnection) Load(model interface{}, fields ...string) error {
+	return c.call("Load", model, func() error {
+		return c.Connection.Load(model, fields...)
+	})
+}
+
+// Count the number of records in the database.
+func (c *FaultyConnection) Count(model interface{}) (int, error) {
+	var count int
+	err := c.call("Count", model, func() error {
+		var err error
+		count, err = c.Connection.Count(model)
+		return err
+	})
+	return count, err
+}
+
+// TruncateAll truncates all data from the datasource
+func (c *FaultyConnection) TruncateAll() error {
+	return c.call("TruncateAll", nil, func() error {
+		return c.Connection.TruncateAll()
+	})
+}
@@ -0,0 +1,206 @@
+package fixtures
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// timeLayouts are the layouts tried, in order, to read a time from a string
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+// funcs returns the template helpers of a load, referring to the fixtures
+// already created in reg.
+func (l *Loader) funcs(reg *Registry) template.FuncMap {
+	uuids := map[string]string{}
+	now := l.Now()
+	format := func(t time.Time) string { return t.Format(time.RFC3339Nano) }
+	return template.FuncMap{
+		"ref": func(name string, field ...string) (interface{}, error) {
+			model, ok := reg.Get(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown fixture %s", name)
+			}
+			if len(field) == 0 {
+				return idOf(model), nil
+			}
+			v, ok := fieldByColumn(reflect.ValueOf(model).Elem(), field[0])
+			if !ok {
+				return nil, fmt.Errorf("%s has no field %s", name, field[0])
+			}
+			if t, ok := v.Interface().(time.Time); ok {
+				return format(t), nil
+			}
+			return v.Interface(), nil
+		},
+		"uuid": func(key ...string) (string, error) {
+			if len(key) > 0 {
+				if id, ok := uuids[key[0]]; ok {
+					return id, nil
+				}
+			}
+			id, err := uuid.NewV4()
+			if err != nil {
+				return "", err
+			}
+			if len(key) > 0 {
+				uuids[key[0]] = id.String()
+			}
+			return id.String(), nil
+		},
+		"now": func() string { return format(now) },
+		"ago": func(d string) (string, error) {
+			dur, err := parseDuration(d)
+			return format(now.Add(-dur)), err
+		},
+		"fromNow": func(d string) (string, error) {
+			dur, err := parseDuration(d)
+			return format(now.Add(dur)), err
+		},
+	}
+}
+
+// parseDuration works like time.ParseDuration, also accepting days as "7d".
+func parseDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+var wholeRef = regexp.MustCompile(`^\{\{\s*ref\s+"([^"]+)"\s*\}\}$`)
+
+// setFields fills model with the fields of f, rendering the templates they
+// contain.
+func setFields(model interface{}, f *fixture, reg *Registry, funcs template.FuncMap) error {
+	v := reflect.ValueOf(model).Elem()
+	for column, value := range f.fields {
+		field, ok := fieldByColumn(v, column)
+		if !ok {
+			return fmt.Errorf("fixtures: %s: %s has no column %s", f.name, v.Type(), column)
+		}
+		if err := setField(field, value, reg, funcs); err != nil {
+			return fmt.Errorf("fixtures: %s: %s: %w", f.name, column, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value interface{}, reg *Registry, funcs template.FuncMap) error {
+	if list, ok := value.([]interface{}); ok && field.Kind() == reflect.Slice {
+		s := reflect.MakeSlice(field.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := setField(s.Index(i), item, reg, funcs); err != nil {
+				return err
+			}
+		}
+		field.Set(s)
+		return nil
+	}
+
+	s, isString := value.(string)
+	if !isString || !strings.Contains(s, "{{") {
+		return assign(field, value)
+	}
+	// a field holding a model, such as a team's leader, takes the referenced
+	// fixture itself
+	if m := wholeRef.FindStringSubmatch(s); m != nil {
+		if model, ok := reg.Get(m[1]); ok && reflect.TypeOf(model).Elem() == field.Type() {
+			field.Set(reflect.ValueOf(model).Elem())
+			return nil
+		}
+	}
+	tmpl, err := template.New("").Funcs(funcs).Parse(s)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, nil); err != nil {
+		return err
+	}
+	return assign(field, b.String())
+}
+
+// assign sets field to value, converting it as needed.
+func assign(field reflect.Value, value interface{}) error {
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	if field.Kind() == reflect.Ptr {
+		p := reflect.New(field.Type().Elem())
+		if err := assign(p.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(p)
+		return nil
+	}
+
+	if s, ok := value.(string); ok {
+		if t, ok := parseTime(s); ok && isTime(field.Type()) {
+			value = t
+		}
+	}
+	if scanner, ok := field.Addr().Interface().(sql.Scanner); ok && field.Type() != reflect.TypeOf(time.Time{}) {
+		return scanner.Scan(value)
+	}
+
+	v := reflect.ValueOf(value)
+	switch {
+	case field.Kind() == reflect.String && v.Kind() != reflect.String:
+		field.SetString(fmt.Sprint(value))
+	case v.Type().ConvertibleTo(field.Type()):
+		field.Set(v.Convert(field.Type()))
+	default:
+		return fmt.Errorf("can not set %s from %T", field.Type(), value)
+	}
+	return nil
+}
+
+// isTime reports whether t is a time.Time, or wraps one like nulls.Time.
+func isTime(t reflect.Type) bool {
+	if t == reflect.TypeOf(time.Time{}) {
+		return true
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := t.FieldByName("Time")
+	return ok && f.Type == reflect.TypeOf(time.Time{})
+}
+
+func parseTime(s string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// fieldByColumn returns the field of the struct v tagged with column, or
+// named column.
+func fieldByColumn(v reflect.Value, column string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("db"), ",")[0]
+		if tag == column {
+			return v.Field(i), true
+		}
+	}
+	if f := v.FieldByName(column); f.IsValid() {
+		return f, true
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,267 @@
+// Package fixtures loads rows described in YAML or JSON files into any
+// ipop.Connection.
+//
+// A file maps table names to named rows, whose columns are given by their
+// `db` tag:
+//
+//	users:
+//	  mark:
+//	    name: Mark
+//	    created_at: '{{ ago "48h" }}'
+//	projects:
+//	  website:
+//	    name: Website
+//	    owner_id: '{{ ref "users.mark" }}'
+//
+// String values are templates, with the helpers:
+//
+//	ref "table.fixture"          the ID of a fixture
+//	ref "table.fixture" "column" a column of a fixture
+//	uuid                         a new UUID
+//	uuid "key"                   the same UUID for the same key in a load
+//	now                          the current time
+//	ago "36h", fromNow "7d"      a time relative to now
+//
+// A field holding a model, such as a team's leader, takes the referenced
+// fixture itself when its value is only a ref. Rows are created after the
+// rows they reference, whatever the order of the files.
+package fixtures
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/kiihela/ipop"
+	"gopkg.in/yaml.v3"
+)
+
+// Loader reads fixture files and creates their rows
+type Loader struct {
+	models map[string]reflect.Type
+	// Now is the time relative times are computed from, it defaults to
+	// time.Now
+	Now func() time.Time
+}
+
+// New creates a Loader for the tables of the given models. Every table used
+// in a fixture file needs its model registered.
+//
+//	loader := fixtures.New(&models.User{}, &models.Team{})
+func New(models ...interface{}) *Loader {
+	l := &Loader{models: map[string]reflect.Type{}, Now: time.Now}
+	for _, m := range models {
+		t := reflect.TypeOf(m)
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		table := pop.NewModel(reflect.New(t).Interface(), nil).TableName()
+		l.models[table] = t
+	}
+	return l
+}
+
+// Registry holds the loaded fixtures by name, "table.fixture"
+type Registry struct {
+	fixtures map[string]interface{}
+	order    []string
+}
+
+// Get returns a pointer to the model created for the named fixture
+func (r *Registry) Get(name string) (interface{}, bool) {
+	f, ok := r.fixtures[name]
+	return f, ok
+}
+
+// MustGet works like Get and panics when the fixture does not exist
+func (r *Registry) MustGet(name string) interface{} {
+	f, ok := r.Get(name)
+	if !ok {
+		panic(fmt.Sprintf("fixtures: no fixture named %q", name))
+	}
+	return f
+}
+
+// Names returns the names of the loaded fixtures, in the order they were
+// created
+func (r *Registry) Names() []string {
+	return append([]string(nil), r.order...)
+}
+
+type fixture struct {
+	name   string
+	table  string
+	fields map[string]interface{}
+	deps   []string
+}
+
+var refPattern = regexp.MustCompile(`\bref\s+"([^"]+)"`)
+
+// LoadFiles reads the given YAML or JSON files and creates their rows
+// through conn. Wrap the call in a transaction to get all or nothing.
+func (l *Loader) LoadFiles(conn ipop.Connection, paths ...string) (*Registry, error) {
+	docs := make([][]byte, 0, len(paths))
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, b)
+	}
+	return l.Load(conn, docs...)
+}
+
+// LoadFS works like LoadFiles, reading the files matching the glob patterns
+// from fsys.
+//
+//	//go:embed testdata/fixtures
+//	var fixtureFiles embed.FS
+//
+//	loader.LoadFS(tx, fixtureFiles, "testdata/fixtures/*.yml")
+func (l *Loader) LoadFS(conn ipop.Connection, fsys fs.FS, patterns ...string) (*Registry, error) {
+	var docs [][]byte
+	for _, pattern := range patterns {
+		paths, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("fixtures: no file matches %s", pattern)
+		}
+		for _, p := range paths {
+			b, err := fs.ReadFile(fsys, p)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, b)
+		}
+	}
+	return l.Load(conn, docs...)
+}
+
+// Load creates the rows described by the given YAML or JSON documents
+// through conn.
+func (l *Loader) Load(conn ipop.Connection, docs ...[]byte) (*Registry, error) {
+	fixtures := map[string]*fixture{}
+	for _, doc := range docs {
+		tables := map[string]map[string]map[string]interface{}{}
+		if err := yaml.Unmarshal(doc, &tables); err != nil {
+			return nil, fmt.Errorf("fixtures: %w", err)
+		}
+		for table, rows := range tables {
+			if _, ok := l.models[table]; !ok {
+				return nil, fmt.Errorf("fixtures: no model registered for table %s", table)
+			}
+			for name, fields := range rows {
+				f := &fixture{name: table + "." + name, table: table, fields: fields}
+				if _, dup := fixtures[f.name]; dup {
+					return nil, fmt.Errorf("fixtures: %s is defined twice", f.name)
+				}
+				for _, v := range fields {
+					f.deps = append(f.deps, refs(v)...)
+				}
+				fixtures[f.name] = f
+			}
+		}
+	}
+
+	order, err := sortFixtures(fixtures)
+	if err != nil {
+		return nil, err
+	}
+
+	reg := &Registry{fixtures: map[string]interface{}{}}
+	funcs := l.funcs(reg)
+	for _, f := range order {
+		model := reflect.New(l.models[f.table]).Interface()
+		if err := setFields(model, f, reg, funcs); err != nil {
+			return nil, err
+		}
+		if err := conn.Create(model); err != nil {
+			return nil, fmt.Errorf("fixtures: creating %s: %w", f.name, err)
+		}
+		reg.fixtures[f.name] = model
+		reg.order = append(reg.order, f.name)
+	}
+	return reg, nil
+}
+
+// sortFixtures orders fixtures so that each comes after the ones it
+// references, and by name otherwise.
+func sortFixtures(fixtures map[string]*fixture) ([]*fixture, error) {
+	names := make([]string, 0, len(fixtures))
+	for name := range fixtures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var order []*fixture
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		f, ok := fixtures[name]
+		if !ok {
+			return fmt.Errorf("fixtures: %s references unknown fixture %s", path[len(path)-1], name)
+		}
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("fixtures: reference cycle %s", strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		for _, dep := range f.deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, f)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// refs returns the fixtures referenced by a field value.
+func refs(value interface{}) []string {
+	var names []string
+	switch v := value.(type) {
+	case string:
+		for _, m := range refPattern.FindAllStringSubmatch(v, -1) {
+			names = append(names, m[1])
+		}
+	case []interface{}:
+		for _, item := range v {
+			names = append(names, refs(item)...)
+		}
+	}
+	return names
+}
+
+// idOf returns the value of the ID field of a loaded fixture.
+func idOf(model interface{}) interface{} {
+	v := reflect.Indirect(reflect.ValueOf(model)).FieldByName("ID")
+	if !v.IsValid() {
+		return nil
+	}
+	if id, ok := v.Interface().(uuid.UUID); ok {
+		return id.String()
+	}
+	return v.Interface()
+}
@@ -0,0 +1,62 @@
+//go:build sqlite
+// +build sqlite
+
+package fixtures
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kiihela/ipop/ipoptest"
+	"github.com/kiihela/ipop/testdata/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoader_LoadFiles(t *testing.T) {
+	db := ipoptest.NewSQLite(t, "../testdata/migrations")
+	now := time.Date(2025, 3, 20, 12, 0, 0, 0, time.UTC)
+	loader := New(&models.User{}, &models.Project{})
+	loader.Now = func() time.Time { return now }
+
+	reg, err := loader.LoadFiles(db, "testdata/projects.json", "testdata/users.yml")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users.mark", "users.jane", "projects.website"}, reg.Names())
+
+	mark := reg.MustGet("users.mark").(*models.User)
+	assert.Equal(t, now.Add(-48*time.Hour), mark.CreatedAt.UTC())
+
+	website := reg.MustGet("projects.website").(*models.Project)
+	assert.Equal(t, mark.ID, website.OwnerID)
+	assert.Equal(t, "Mark", website.Owner.Name)
+	assert.Equal(t, []string{"Mark", "Jane"}, []string{website.Members[0].Name, website.Members[1].Name})
+	assert.Equal(t, now.Add(36*time.Hour), website.DueAt.UTC())
+
+	stored := &models.Project{}
+	require.NoError(t, db.Find(stored, website.ID))
+	assert.Equal(t, mark.ID, stored.OwnerID)
+
+	_, ok := reg.Get("users.bob")
+	assert.False(t, ok)
+}
+
+func TestLoader_Load_Errors(t *testing.T) {
+	db := ipoptest.NewSQLite(t, "../testdata/migrations")
+	loader := New(&models.User{}, &models.Project{})
+
+	_, err := loader.Load(db, []byte(`teams: {core: {name: Core}}`))
+	assert.EqualError(t, err, "fixtures: no model registered for table teams")
+
+	_, err = loader.Load(db, []byte(`projects: {website: {owner_id: '{{ ref "users.bob" }}'}}`))
+	assert.EqualError(t, err, "fixtures: projects.website references unknown fixture users.bob")
+
+	_, err = loader.Load(db, []byte(`
+projects:
+  a: {name: '{{ ref "projects.b" "name" }}'}
+  b: {name: '{{ ref "projects.a" "name" }}'}
+`))
+	assert.EqualError(t, err, "fixtures: reference cycle projects.a -> projects.b -> projects.a")
+
+	_, err = loader.Load(db, []byte(`users: {mark: {nickname: Mark}}`))
+	assert.EqualError(t, err, "fixtures: users.mark: models.User has no column nickname")
+}
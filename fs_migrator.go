@@ -0,0 +1,123 @@
+package ipop
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// NewFSMigrator reads the .fizz and .sql migrations of fsys, such as an
+// embed.FS, run on conn. Unlike NewMigrationBox, it checks the migrations
+// when called, returning ErrInvalidMigrations for files not named like
+// "20250301120000_create_users.up.fizz", migrations missing their up or down
+// half and versions shared by different migrations. Other files, such as
+// README.md or the schema.sql dump, are ignored.
+//
+//	//go:embed migrations
+//	var migrations embed.FS
+//
+//	sub, _ := fs.Sub(migrations, "migrations")
+//	m, err := NewFSMigrator(sub, db)
+func NewFSMigrator(fsys fs.FS, conn Connection) (*MigratorAdapter, error) {
+	c := popConnection(conn)
+	m := pop.NewMigrator(c)
+	m.SchemaPath = ""
+
+	var problems []string
+	halves := map[string]map[string]string{}
+	versions := map[string]string{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		ext := path.Ext(name)
+		if d.IsDir() || (ext != ".fizz" && ext != ".sql") || name == "schema.sql" {
+			return nil
+		}
+		match, err := pop.ParseMigrationFilename(name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", p, err))
+			return nil
+		}
+		if match == nil {
+			problems = append(problems, fmt.Sprintf("%s is not named <version>_<name>.(up|down).(fizz|sql)", p))
+			return nil
+		}
+
+		key := fmt.Sprintf("%s_%s.%s.%s", match.Version, match.Name, match.DBType, match.Type)
+		if halves[key] == nil {
+			halves[key] = map[string]string{}
+		}
+		if other, ok := halves[key][match.Direction]; ok {
+			problems = append(problems, fmt.Sprintf("%s and %s are the same migration", other, p))
+			return nil
+		}
+		halves[key][match.Direction] = p
+		version := match.Version + "." + match.DBType
+		if other, ok := versions[version]; ok && other != match.Name {
+			problems = append(problems, fmt.Sprintf("version %s is used by %s and %s", match.Version, other, match.Name))
+		}
+		versions[version] = match.Name
+
+		mi := pop.Migration{
+			Path:      p,
+			Version:   match.Version,
+			Name:      match.Name,
+			DBType:    match.DBType,
+			Direction: match.Direction,
+			Type:      match.Type,
+			Runner:    fsMigrationRunner(fsys),
+		}
+		if match.Direction == "up" {
+			m.UpMigrations.Migrations = append(m.UpMigrations.Migrations, mi)
+		} else {
+			m.DownMigrations.Migrations = append(m.DownMigrations.Migrations, mi)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range halves {
+		switch {
+		case h["up"] == "":
+			problems = append(problems, fmt.Sprintf("%s has no up migration", h["down"]))
+		case h["down"] == "":
+			problems = append(problems, fmt.Sprintf("%s has no down migration", h["up"]))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMigrations, strings.Join(problems, "; "))
+	}
+	return &MigratorAdapter{m: m, conn: conn}, nil
+}
+
+// fsMigrationRunner returns a runner opening the migration file each time it
+// runs, so that a migration can run again after being rolled back.
+func fsMigrationRunner(fsys fs.FS) func(mi pop.Migration, tx *pop.Connection) error {
+	return func(mi pop.Migration, tx *pop.Connection) error {
+		f, err := fsys.Open(mi.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		content, err := pop.MigrationContent(mi, tx, f, true)
+		if err != nil {
+			return fmt.Errorf("error processing %s: %w", mi.Path, err)
+		}
+		if content == "" {
+			return nil
+		}
+		if err := tx.RawQuery(content).Exec(); err != nil {
+			return fmt.Errorf("error executing %s, sql: %s: %w", mi.Path, content, err)
+		}
+		return nil
+	}
+}
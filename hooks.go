@@ -0,0 +1,67 @@
+package ipop
+
+import "sync"
+
+// txHooks collects the callbacks registered with AfterCommit and
+// AfterRollback while a transaction runs.
+type txHooks struct {
+	mu       sync.Mutex
+	commit   []func()
+	rollback []func(err error)
+}
+
+func (h *txHooks) afterCommit(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commit = append(h.commit, fn)
+}
+
+func (h *txHooks) afterRollback(fn func(err error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rollback = append(h.rollback, fn)
+}
+
+// take empties the hooks, so that every callback runs at most once.
+func (h *txHooks) take() ([]func(), []func(err error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	commit, rollback := h.commit, h.rollback
+	h.commit, h.rollback = nil, nil
+	return commit, rollback
+}
+
+// committed runs the commit callbacks in registration order.
+func (h *txHooks) committed() {
+	commit, _ := h.take()
+	for _, fn := range commit {
+		fn()
+	}
+}
+
+// rolledBack runs the rollback callbacks in registration order.
+func (h *txHooks) rolledBack(err error) {
+	_, rollback := h.take()
+	for _, fn := range rollback {
+		fn(err)
+	}
+}
+
+// adopt moves the callbacks of a released savepoint into the surrounding
+// transaction, they run when that one ends.
+func (h *txHooks) adopt(child *txHooks) {
+	commit, rollback := child.take()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commit = append(h.commit, commit...)
+	h.rollback = append(h.rollback, rollback...)
+}
+
+// finish runs the callbacks matching the outcome of a transaction.
+func (h *txHooks) finish(err error) {
+	if err != nil {
+		h.rolledBack(err)
+		return
+	}
+	h.committed()
+}
@@ -0,0 +1,376 @@
+package ipop
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// Inspector reads the schema of a database, whatever its dialect. Tables
+// and columns are named the way the database reports them.
+//
+//	tables, err := db.Inspector().Tables()
+//	columns, err := db.Inspector().Columns("users")
+type Inspector interface {
+	// Tables returns the names of the tables of the database, the migration
+	// table included, in alphabetical order
+	Tables() ([]string, error)
+	// Columns returns the columns of table, in definition order
+	Columns(table string) ([]Column, error)
+	// Indexes returns the indexes of table, those backing the primary key
+	// aside, in alphabetical order
+	Indexes(table string) ([]Index, error)
+	// ForeignKeys returns the foreign keys of table
+	ForeignKeys(table string) ([]ForeignKey, error)
+	// PrimaryKey returns the columns of the primary key of table, in key order
+	PrimaryKey(table string) ([]string, error)
+}
+
+// ForeignKey describes a foreign key of a table
+type ForeignKey struct {
+	// Name is the name of the constraint, sqlite does not name them
+	Name              string   `json:"name,omitempty"`
+	Columns           []string `json:"columns"`
+	ReferencedTable   string   `json:"referenced_table"`
+	ReferencedColumns []string `json:"referenced_columns"`
+	// OnUpdate and OnDelete are the referential actions, such as "CASCADE"
+	// or "NO ACTION"
+	OnUpdate string `json:"on_update"`
+	OnDelete string `json:"on_delete"`
+}
+
+// InspectorAdapter reads the schema of the database of a pop connection,
+// for sqlite, Postgres, CockroachDB, MySQL and MariaDB
+type InspectorAdapter struct {
+	conn *pop.Connection
+}
+
+// Tables returns the names of the tables of the database, in alphabetical
+// order
+func (in *InspectorAdapter) Tables() ([]string, error) {
+	c := in.conn
+	var stmt string
+	switch c.Dialect.Name() {
+	case "sqlite3":
+		stmt = "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'"
+	case "postgres", "cockroach":
+		stmt = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE'"
+	case "mysql", "mariadb":
+		stmt = "SELECT table_name AS table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'"
+	default:
+		return nil, fmt.Errorf("schema introspection is not supported for %s", c.Dialect.Name())
+	}
+	tables := []string{}
+	if err := c.Store.Select(&tables, stmt); err != nil {
+		return nil, mapError(err, nil)
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// Columns returns the columns of table, in definition order
+func (in *InspectorAdapter) Columns(table string) ([]Column, error) {
+	c := in.conn
+	var columns []Column
+	switch c.Dialect.Name() {
+	case "sqlite3":
+		rows, err := sqliteTableInfo(c, table)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			columns = append(columns, Column{Name: r.Name, Type: r.Type, Nullable: !r.NotNull, PrimaryKey: r.PK > 0})
+		}
+	case "postgres", "cockroach", "mysql", "mariadb":
+		typeColumn, placeholder, schema := "data_type", "$1", "current_schema()"
+		if d := c.Dialect.Name(); d == "mysql" || d == "mariadb" {
+			typeColumn, placeholder, schema = "column_type", "?", "DATABASE()"
+		}
+		rows := []struct {
+			Name     string `db:"column_name"`
+			Type     string `db:"column_type"`
+			Nullable string `db:"is_nullable"`
+		}{}
+		stmt := fmt.Sprintf(`SELECT column_name AS column_name, %s AS column_type, is_nullable AS is_nullable
+			FROM information_schema.columns WHERE table_schema = %s AND table_name = %s
+			ORDER BY ordinal_position`, typeColumn, schema, placeholder)
+		if err := c.Store.Select(&rows, stmt, table); err != nil {
+			return nil, mapError(err, nil)
+		}
+		pk, err := in.PrimaryKey(table)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			columns = append(columns, Column{Name: r.Name, Type: r.Type, Nullable: r.Nullable == "YES", PrimaryKey: contains(pk, r.Name)})
+		}
+	default:
+		return nil, fmt.Errorf("schema introspection is not supported for %s", c.Dialect.Name())
+	}
+	return columns, nil
+}
+
+// PrimaryKey returns the columns of the primary key of table, in key order
+func (in *InspectorAdapter) PrimaryKey(table string) ([]string, error) {
+	c := in.conn
+	var stmt string
+	switch c.Dialect.Name() {
+	case "sqlite3":
+		rows, err := sqliteTableInfo(c, table)
+		if err != nil {
+			return nil, err
+		}
+		// pk is the position of the column in the key, or 0 outside of it
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].PK < rows[j].PK })
+		var pk []string
+		for _, r := range rows {
+			if r.PK > 0 {
+				pk = append(pk, r.Name)
+			}
+		}
+		return pk, nil
+	case "postgres", "cockroach":
+		stmt = `SELECT a.attname FROM pg_index ix
+			JOIN pg_class t ON t.oid = ix.indrelid
+			JOIN pg_namespace n ON n.oid = t.relnamespace
+			JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord) ON true
+			JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+			WHERE ix.indisprimary AND n.nspname = current_schema() AND t.relname = $1
+			ORDER BY k.ord`
+	case "mysql", "mariadb":
+		stmt = `SELECT column_name AS column_name FROM information_schema.statistics
+			WHERE table_schema = DATABASE() AND table_name = ? AND index_name = 'PRIMARY'
+			ORDER BY seq_in_index`
+	default:
+		return nil, fmt.Errorf("schema introspection is not supported for %s", c.Dialect.Name())
+	}
+	pk := []string{}
+	if err := c.Store.Select(&pk, stmt, table); err != nil {
+		return nil, mapError(err, nil)
+	}
+	return pk, nil
+}
+
+// sqliteTableInfo returns the columns of table as listed by PRAGMA
+// table_info, in definition order
+func sqliteTableInfo(c *pop.Connection, table string) ([]sqliteColumn, error) {
+	rows := []sqliteColumn{}
+	if err := c.Store.Select(&rows, fmt.Sprintf("PRAGMA table_info(%s)", c.Dialect.Quote(table))); err != nil {
+		return nil, mapError(err, nil)
+	}
+	return rows, nil
+}
+
+type sqliteColumn struct {
+	CID     int            `db:"cid"`
+	Name    string         `db:"name"`
+	Type    string         `db:"type"`
+	NotNull bool           `db:"notnull"`
+	Default sql.NullString `db:"dflt_value"`
+	PK      int            `db:"pk"`
+}
+
+// Indexes returns the indexes of table, in alphabetical order
+func (in *InspectorAdapter) Indexes(table string) ([]Index, error) {
+	c := in.conn
+	rows := []struct {
+		Name   string `db:"index_name"`
+		Unique bool   `db:"is_unique"`
+		Column string `db:"column_name"`
+	}{}
+	switch c.Dialect.Name() {
+	case "sqlite3":
+		list := []struct {
+			Seq     int    `db:"seq"`
+			Name    string `db:"name"`
+			Unique  bool   `db:"unique"`
+			Origin  string `db:"origin"`
+			Partial bool   `db:"partial"`
+		}{}
+		if err := c.Store.Select(&list, fmt.Sprintf("PRAGMA index_list(%s)", c.Dialect.Quote(table))); err != nil {
+			return nil, mapError(err, nil)
+		}
+		// indexes are listed newest first
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		for _, idx := range list {
+			// indexes backing the primary key and unique constraints are part
+			// of the table definition
+			if idx.Origin != "c" {
+				continue
+			}
+			info := []struct {
+				SeqNo int            `db:"seqno"`
+				CID   int            `db:"cid"`
+				Name  sql.NullString `db:"name"`
+			}{}
+			if err := c.Store.Select(&info, fmt.Sprintf("PRAGMA index_info(%s)", c.Dialect.Quote(idx.Name))); err != nil {
+				return nil, mapError(err, nil)
+			}
+			for _, col := range info {
+				rows = append(rows, struct {
+					Name   string `db:"index_name"`
+					Unique bool   `db:"is_unique"`
+					Column string `db:"column_name"`
+				}{idx.Name, idx.Unique, col.Name.String})
+			}
+		}
+	case "postgres", "cockroach":
+		stmt := `SELECT i.relname AS index_name, ix.indisunique AS is_unique, a.attname AS column_name FROM pg_index ix
+			JOIN pg_class t ON t.oid = ix.indrelid
+			JOIN pg_class i ON i.oid = ix.indexrelid
+			JOIN pg_namespace n ON n.oid = t.relnamespace
+			JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord) ON true
+			JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+			WHERE NOT ix.indisprimary AND n.nspname = current_schema() AND t.relname = $1
+			ORDER BY i.relname, k.ord`
+		if err := c.Store.Select(&rows, stmt, table); err != nil {
+			return nil, mapError(err, nil)
+		}
+	case "mysql", "mariadb":
+		stmt := `SELECT index_name AS index_name, non_unique = 0 AS is_unique, column_name AS column_name
+			FROM information_schema.statistics
+			WHERE table_schema = DATABASE() AND table_name = ? AND index_name <> 'PRIMARY'
+			ORDER BY index_name, seq_in_index`
+		if err := c.Store.Select(&rows, stmt, table); err != nil {
+			return nil, mapError(err, nil)
+		}
+	default:
+		return nil, fmt.Errorf("schema introspection is not supported for %s", c.Dialect.Name())
+	}
+
+	var indexes []Index
+	for _, r := range rows {
+		if n := len(indexes); n > 0 && indexes[n-1].Name == r.Name {
+			indexes[n-1].Columns = append(indexes[n-1].Columns, r.Column)
+			continue
+		}
+		indexes = append(indexes, Index{Name: r.Name, Columns: []string{r.Column}, Unique: r.Unique})
+	}
+	return indexes, nil
+}
+
+// pgReferentialActions maps the actions of pg_constraint to their SQL names
+var pgReferentialActions = map[string]string{
+	"a": "NO ACTION",
+	"r": "RESTRICT",
+	"c": "CASCADE",
+	"n": "SET NULL",
+	"d": "SET DEFAULT",
+}
+
+// ForeignKeys returns the foreign keys of table, in alphabetical order
+// outside of sqlite, in definition order there
+func (in *InspectorAdapter) ForeignKeys(table string) ([]ForeignKey, error) {
+	c := in.conn
+	rows := []struct {
+		Name             string `db:"constraint_name"`
+		Column           string `db:"column_name"`
+		ReferencedTable  string `db:"referenced_table"`
+		ReferencedColumn string `db:"referenced_column"`
+		OnUpdate         string `db:"on_update"`
+		OnDelete         string `db:"on_delete"`
+	}{}
+	switch c.Dialect.Name() {
+	case "sqlite3":
+		list := []struct {
+			ID       int            `db:"id"`
+			Seq      int            `db:"seq"`
+			Table    string         `db:"table"`
+			From     string         `db:"from"`
+			To       sql.NullString `db:"to"`
+			OnUpdate string         `db:"on_update"`
+			OnDelete string         `db:"on_delete"`
+			Match    string         `db:"match"`
+		}{}
+		if err := c.Store.Select(&list, fmt.Sprintf("PRAGMA foreign_key_list(%s)", c.Dialect.Quote(table))); err != nil {
+			return nil, mapError(err, nil)
+		}
+		// keys are listed newest first
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].ID != list[j].ID {
+				return list[i].ID > list[j].ID
+			}
+			return list[i].Seq < list[j].Seq
+		})
+		for _, fk := range list {
+			to := fk.To.String
+			if !fk.To.Valid {
+				// the key references the primary key of the other table
+				pk, err := in.PrimaryKey(fk.Table)
+				if err != nil {
+					return nil, err
+				}
+				if fk.Seq < len(pk) {
+					to = pk[fk.Seq]
+				}
+			}
+			rows = append(rows, struct {
+				Name             string `db:"constraint_name"`
+				Column           string `db:"column_name"`
+				ReferencedTable  string `db:"referenced_table"`
+				ReferencedColumn string `db:"referenced_column"`
+				OnUpdate         string `db:"on_update"`
+				OnDelete         string `db:"on_delete"`
+			}{fmt.Sprint(fk.ID), fk.From, fk.Table, to, fk.OnUpdate, fk.OnDelete})
+		}
+	case "postgres", "cockroach":
+		stmt := `SELECT con.conname AS constraint_name, a.attname AS column_name, rt.relname AS referenced_table,
+				ra.attname AS referenced_column, con.confupdtype AS on_update, con.confdeltype AS on_delete
+			FROM pg_constraint con
+			JOIN pg_class t ON t.oid = con.conrelid
+			JOIN pg_namespace n ON n.oid = t.relnamespace
+			JOIN pg_class rt ON rt.oid = con.confrelid
+			JOIN LATERAL unnest(con.conkey, con.confkey) WITH ORDINALITY AS k(attnum, refnum, ord) ON true
+			JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+			JOIN pg_attribute ra ON ra.attrelid = rt.oid AND ra.attnum = k.refnum
+			WHERE con.contype = 'f' AND n.nspname = current_schema() AND t.relname = $1
+			ORDER BY con.conname, k.ord`
+		if err := c.Store.Select(&rows, stmt, table); err != nil {
+			return nil, mapError(err, nil)
+		}
+		for i := range rows {
+			rows[i].OnUpdate = pgReferentialActions[rows[i].OnUpdate]
+			rows[i].OnDelete = pgReferentialActions[rows[i].OnDelete]
+		}
+	case "mysql", "mariadb":
+		stmt := `SELECT k.constraint_name AS constraint_name, k.column_name AS column_name,
+				k.referenced_table_name AS referenced_table, k.referenced_column_name AS referenced_column,
+				r.update_rule AS on_update, r.delete_rule AS on_delete
+			FROM information_schema.key_column_usage k
+			JOIN information_schema.referential_constraints r ON r.constraint_schema = k.table_schema
+				AND r.table_name = k.table_name AND r.constraint_name = k.constraint_name
+			WHERE k.table_schema = DATABASE() AND k.table_name = ? AND k.referenced_table_name IS NOT NULL
+			ORDER BY k.constraint_name, k.ordinal_position`
+		if err := c.Store.Select(&rows, stmt, table); err != nil {
+			return nil, mapError(err, nil)
+		}
+	default:
+		return nil, fmt.Errorf("schema introspection is not supported for %s", c.Dialect.Name())
+	}
+
+	var keys []ForeignKey
+	for _, r := range rows {
+		if n := len(keys); n > 0 && keys[n-1].Name == r.Name {
+			keys[n-1].Columns = append(keys[n-1].Columns, r.Column)
+			keys[n-1].ReferencedColumns = append(keys[n-1].ReferencedColumns, r.ReferencedColumn)
+			continue
+		}
+		keys = append(keys, ForeignKey{
+			Name:              r.Name,
+			Columns:           []string{r.Column},
+			ReferencedTable:   r.ReferencedTable,
+			ReferencedColumns: []string{r.ReferencedColumn},
+			OnUpdate:          r.OnUpdate,
+			OnDelete:          r.OnDelete,
+		})
+	}
+	if c.Dialect.Name() == "sqlite3" {
+		// the keys were grouped by id, sqlite does not name them
+		for i := range keys {
+			keys[i].Name = ""
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,72 @@
+package ipop
+
+import (
+	"sort"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// MockInspector is a mock implementation of the Inspector interface. Methods
+// without an override read the fake schema of Schema and ForeignKeysByTable,
+// unknown tables have no columns, indexes or keys.
+//
+//	inspector := &MockInspector{Schema: Schema{Tables: []TableSchema{{
+//		Name:    "users",
+//		Columns: []Column{{Name: "id", Type: "uuid", PrimaryKey: true}},
+//	}}}}
+//	conn := &MockConnection{InspectorFunc: func() Inspector { return inspector }}
+type MockInspector struct {
+	mock.Mock
+	Schema             Schema
+	ForeignKeysByTable map[string][]ForeignKey
+	TablesFunc         func() ([]string, error)
+	ColumnsFunc        func(table string) ([]Column, error)
+	IndexesFunc        func(table string) ([]Index, error)
+	ForeignKeysFunc    func(table string) ([]ForeignKey, error)
+	PrimaryKeyFunc     func(table string) ([]string, error)
+}
+
+func (m *MockInspector) Tables() ([]string, error) {
+	if m.TablesFunc != nil {
+		return m.TablesFunc()
+	}
+	tables := []string{}
+	for _, t := range m.Schema.Tables {
+		tables = append(tables, t.Name)
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+func (m *MockInspector) Columns(table string) ([]Column, error) {
+	if m.ColumnsFunc != nil {
+		return m.ColumnsFunc(table)
+	}
+	t, _ := m.Schema.Table(table)
+	return t.Columns, nil
+}
+func (m *MockInspector) Indexes(table string) ([]Index, error) {
+	if m.IndexesFunc != nil {
+		return m.IndexesFunc(table)
+	}
+	t, _ := m.Schema.Table(table)
+	return t.Indexes, nil
+}
+func (m *MockInspector) ForeignKeys(table string) ([]ForeignKey, error) {
+	if m.ForeignKeysFunc != nil {
+		return m.ForeignKeysFunc(table)
+	}
+	return m.ForeignKeysByTable[table], nil
+}
+func (m *MockInspector) PrimaryKey(table string) ([]string, error) {
+	if m.PrimaryKeyFunc != nil {
+		return m.PrimaryKeyFunc(table)
+	}
+	t, _ := m.Schema.Table(table)
+	var pk []string
+	for _, c := range t.Columns {
+		if c.PrimaryKey {
+			pk = append(pk, c.Name)
+		}
+	}
+	return pk, nil
+}
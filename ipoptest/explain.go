@@ -0,0 +1,26 @@
+// Package ipoptest provides helpers for testing code built on ipop.
+package ipoptest
+
+import (
+	"testing"
+
+	"github.com/kiihela/ipop"
+)
+
+// AssertNoFullScans explains the query built from q for model and fails the
+// test for every step of the plan reading a whole table. It returns the plan
+// for further checks.
+//
+//	ipoptest.AssertNoFullScans(t, ipop.NewQueryAdapter(db.Where("name = ?", "mark")), &User{})
+func AssertNoFullScans(t testing.TB, q ipop.Query, model interface{}) ipop.Plan {
+	t.Helper()
+	plan, err := q.Explain(model)
+	if err != nil {
+		t.Fatalf("explain failed: %s", err)
+		return plan
+	}
+	for _, scan := range plan.FullScans() {
+		t.Errorf("full scan of %s (%s) in plan of\n%s", scan.Table, scan.Detail, plan.SQL)
+	}
+	return plan
+}
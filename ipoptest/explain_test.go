@@ -0,0 +1,34 @@
+//go:build sqlite
+// +build sqlite
+
+package ipoptest
+
+import (
+	"testing"
+
+	"github.com/kiihela/ipop"
+	"github.com/kiihela/ipop/testdata/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingT struct {
+	testing.TB
+	errors int
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors++
+}
+
+func TestAssertNoFullScans(t *testing.T) {
+	db := NewSQLite(t, "../testdata/migrations")
+
+	plan := AssertNoFullScans(t, ipop.NewQueryAdapter(db.Where("id = ?", "00000000-0000-0000-0000-000000000000")), &models.User{})
+	assert.Equal(t, "sqlite3", plan.Dialect)
+	assert.Equal(t, "sqlite_autoindex_users_1", plan.Nodes[0].Index)
+
+	rt := &recordingT{TB: t}
+	plan = AssertNoFullScans(rt, ipop.NewQueryAdapter(db.Q()), &models.User{})
+	assert.Equal(t, 1, rt.errors)
+	assert.Equal(t, "users", plan.FullScans()[0].Table)
+}
@@ -0,0 +1,57 @@
+package ipoptest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/kiihela/ipop"
+)
+
+// NewSQLite returns a connection to a new sqlite database, in a file of a
+// temporary directory, migrated with the migrations of migrationsDir. The
+// connection is closed and the file removed when the test ends, so that
+// tests and packages do not share any state.
+//
+//	func TestSignup(t *testing.T) {
+//		t.Parallel()
+//		db := ipoptest.NewSQLite(t, "../migrations")
+//		...
+//	}
+//
+// An empty migrationsDir leaves the database empty. The sqlite driver is only
+// compiled in with the sqlite build tag. The database is not kept in memory,
+// as fizz reads the schema of sqlite databases through a connection of its
+// own, which would see another one.
+func NewSQLite(t testing.TB, migrationsDir string) ipop.Connection {
+	t.Helper()
+	conn, err := pop.NewConnection(&pop.ConnectionDetails{
+		Dialect:  "sqlite3",
+		Database: filepath.Join(t.TempDir(), "ipoptest.sqlite"),
+	})
+	if err != nil {
+		t.Fatalf("creating the sqlite connection: %s", err)
+	}
+	if err := conn.Open(); err != nil {
+		t.Fatalf("opening the sqlite database: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := conn.Close(); err != nil {
+			t.Errorf("closing the sqlite database: %s", err)
+		}
+	})
+
+	db := ipop.NewConnectionAdapter(conn)
+	if migrationsDir != "" {
+		migrator, err := ipop.NewFileMigrator(migrationsDir, db)
+		if err != nil {
+			t.Fatalf("reading the migrations: %s", err)
+		}
+		// the schema dump would be written next to the migrations
+		migrator.SetSchemaPath("")
+		if err := migrator.Up(); err != nil {
+			t.Fatalf("running the migrations: %s", err)
+		}
+	}
+	return db
+}
@@ -0,0 +1,38 @@
+//go:build sqlite
+// +build sqlite
+
+package ipoptest
+
+import (
+	"testing"
+
+	"github.com/kiihela/ipop"
+	"github.com/kiihela/ipop/testdata/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSQLite(t *testing.T) {
+	first := NewSQLite(t, "../testdata/migrations")
+	second := NewSQLite(t, "../testdata/migrations")
+	require.NoError(t, first.Create(&models.User{Name: "Mark"}))
+
+	count, err := first.Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = second.Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// a transaction and the connection see the same database
+	assert.NoError(t, first.Transaction(func(tx ipop.Connection) error {
+		return tx.Create(&models.User{Name: "Jane"})
+	}))
+	count, err = first.Count(&models.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	empty := NewSQLite(t, "")
+	_, err = empty.Count(&models.User{})
+	assert.Error(t, err)
+}
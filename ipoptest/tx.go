@@ -0,0 +1,52 @@
+package ipoptest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kiihela/ipop"
+)
+
+// TxConn returns a connection bound to a transaction of conn, or to a
+// savepoint when conn is already inside one, which is rolled back when the
+// test ends. Code under test calling Transaction on it runs in a savepoint,
+// so nothing it writes outlives the test.
+//
+//	func TestSignup(t *testing.T) {
+//		t.Parallel()
+//		db := ipoptest.TxConn(t, conn)
+//		...
+//	}
+//
+// sqlite allows a single writing transaction at a time, tests sharing one
+// sqlite database wait for each other.
+func TxConn(t testing.TB, conn ipop.Connection) ipop.Connection {
+	t.Helper()
+
+	txs := make(chan ipop.Connection)
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- conn.Rollback(func(tx ipop.Connection) {
+			txs <- tx
+			<-done
+		})
+	}()
+
+	select {
+	case tx := <-txs:
+		t.Cleanup(func() {
+			close(done)
+			if err := <-result; err != nil {
+				t.Errorf("rolling back the test transaction: %s", err)
+			}
+		})
+		return tx
+	case err := <-result:
+		if err == nil {
+			err = errors.New("Rollback did not run its function")
+		}
+		t.Fatalf("opening the test transaction: %s", err)
+		return nil
+	}
+}
@@ -0,0 +1,38 @@
+//go:build sqlite
+// +build sqlite
+
+package ipoptest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kiihela/ipop"
+	"github.com/kiihela/ipop/testdata/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxConn(t *testing.T) {
+	db := NewSQLite(t, "../testdata/migrations")
+
+	t.Run("writes", func(t *testing.T) {
+		tx := TxConn(t, db)
+		assert.NoError(t, tx.Create(&models.User{Name: "Rolled back"}))
+
+		assert.Error(t, tx.Transaction(func(inner ipop.Connection) error {
+			assert.NoError(t, inner.Create(&models.User{Name: "Inner"}))
+			return errors.New("ooops")
+		}))
+		assert.NoError(t, tx.Transaction(func(inner ipop.Connection) error {
+			return inner.Create(&models.User{Name: "Committed inner"})
+		}))
+
+		count, err := tx.Count(&models.User{})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+
+	count, err := db.Count(&models.User{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,326 @@
+package ipop
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// LintRule names a check made by a Linter
+type LintRule string
+
+const (
+	// LintLiteral flags values written into the where clause instead of
+	// being passed as arguments, a sign of fmt.Sprintf built queries
+	LintLiteral LintRule = "literal"
+	// LintPlaceholders flags statements whose placeholders and arguments do
+	// not add up
+	LintPlaceholders LintRule = "placeholders"
+	// LintUnboundedWrite flags UPDATE and DELETE statements without a where
+	// clause
+	LintUnboundedWrite LintRule = "unbounded-write"
+	// LintSelectStar flags SELECT * on tables wider than
+	// Linter.MaxSelectStarColumns
+	LintSelectStar LintRule = "select-star"
+	// LintLeadingWildcard flags LIKE patterns starting with a wildcard, which
+	// can not use an index
+	LintLeadingWildcard LintRule = "leading-wildcard"
+)
+
+// LintAction is what a Linter does about a broken rule
+type LintAction int
+
+const (
+	// LintWarn logs the issue and lets the statement run
+	LintWarn LintAction = iota
+	// LintReject refuses to run the statement, returning ErrQueryRejected
+	LintReject
+	// LintIgnore turns the rule off
+	LintIgnore
+)
+
+// LintIssue is a rule broken by a statement
+type LintIssue struct {
+	Rule    LintRule
+	Message string
+	SQL     string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s: %s in %q", i.Rule, i.Message, i.SQL)
+}
+
+// Linter inspects statements before they run. Every rule warns unless set
+// otherwise in Actions.
+type Linter struct {
+	// Actions sets what to do per rule
+	Actions map[LintRule]LintAction
+	// MaxSelectStarColumns is the width from which SELECT * is flagged, zero
+	// turns LintSelectStar off
+	MaxSelectStarColumns int
+	// Warnf receives the issues of rules set to warn, it defaults to
+	// log.Printf
+	Warnf func(format string, args ...interface{})
+}
+
+var (
+	lintStrings      = regexp.MustCompile(`'(?:[^']|'')*'`)
+	lintWhere        = regexp.MustCompile(`(?i)\bWHERE\b`)
+	lintLiteral      = regexp.MustCompile(`(?i)(=|<>|!=|<=|>=|<|>|\bLIKE|\bIN)\s*\(?\s*(\x00|-?\d+(?:\.\d+)?\b)`)
+	lintNumbered     = regexp.MustCompile(`\$(\d+)`)
+	lintWrite        = regexp.MustCompile(`(?i)^\s*(UPDATE|DELETE)\b`)
+	lintSelectStar   = regexp.MustCompile(`(?i)^\s*SELECT\s+(?:\w+\.)?\*\s+FROM\b`)
+	lintLike         = regexp.MustCompile(`(?i)\bLIKE\s+(\x00|\?|\$\d+)`)
+	lintLeadingWild  = regexp.MustCompile(`^'[%_]`)
+	lintStringMarker = "\x00"
+)
+
+// Lint returns the issues found in stmt run with args. width is the number
+// of columns of the table read, or zero when unknown.
+func (l Linter) Lint(stmt string, args []interface{}, width int) []LintIssue {
+	var issues []LintIssue
+	add := func(rule LintRule, format string, a ...interface{}) {
+		if l.action(rule) != LintIgnore {
+			issues = append(issues, LintIssue{Rule: rule, Message: fmt.Sprintf(format, a...), SQL: stmt})
+		}
+	}
+
+	// string literals are masked with a NUL byte, which can not appear in
+	// SQL, so that their content is not mistaken for SQL, and kept in order
+	// to look at LIKE patterns
+	literals := lintStrings.FindAllString(stmt, -1)
+	masked := lintStrings.ReplaceAllString(stmt, lintStringMarker)
+
+	if loc := lintWhere.FindStringIndex(masked); loc != nil {
+		if m := lintLiteral.FindStringSubmatch(masked[loc[1]:]); m != nil {
+			add(LintLiteral, "literal value in where clause after %s, pass it as an argument", m[1])
+		}
+	} else if m := lintWrite.FindStringSubmatch(masked); m != nil {
+		add(LintUnboundedWrite, "%s without where clause", strings.ToUpper(m[1]))
+	}
+
+	placeholders := strings.Count(masked, "?")
+	for _, m := range lintNumbered.FindAllStringSubmatch(masked, -1) {
+		if n, _ := strconv.Atoi(m[1]); n > placeholders {
+			placeholders = n
+		}
+	}
+	if placeholders != len(args) {
+		add(LintPlaceholders, "%d placeholders for %d arguments", placeholders, len(args))
+	}
+
+	if l.MaxSelectStarColumns > 0 && width > l.MaxSelectStarColumns && lintSelectStar.MatchString(masked) {
+		add(LintSelectStar, "SELECT * on a table of %d columns, list the columns needed", width)
+	}
+
+	for _, loc := range lintLike.FindAllStringSubmatchIndex(masked, -1) {
+		operand := masked[loc[2]:loc[3]]
+		pattern := ""
+		switch {
+		case operand == lintStringMarker:
+			pattern = literals[strings.Count(masked[:loc[2]], lintStringMarker)]
+		case operand == "?":
+			if i := strings.Count(masked[:loc[2]], "?"); i < len(args) {
+				pattern = "'" + fmt.Sprint(args[i])
+			}
+		default:
+			if i, _ := strconv.Atoi(operand[1:]); i > 0 && i <= len(args) {
+				pattern = "'" + fmt.Sprint(args[i-1])
+			}
+		}
+		if lintLeadingWild.MatchString(pattern) {
+			add(LintLeadingWildcard, "LIKE pattern starting with a wildcard can not use an index")
+		}
+	}
+	return issues
+}
+
+func (l Linter) action(rule LintRule) LintAction {
+	if a, ok := l.Actions[rule]; ok {
+		return a
+	}
+	return LintWarn
+}
+
+// Check lints stmt, logging the issues of rules set to warn, and returns
+// ErrQueryRejected for the first issue of a rule set to reject.
+func (l Linter) Check(stmt string, args []interface{}, width int) error {
+	warnf := l.Warnf
+	if warnf == nil {
+		warnf = log.Printf
+	}
+	var rejected error
+	for _, issue := range l.Lint(stmt, args, width) {
+		if l.action(issue.Rule) == LintReject {
+			if rejected == nil {
+				rejected = fmt.Errorf("%w: %s", ErrQueryRejected, issue)
+			}
+			continue
+		}
+		warnf("ipop: %s", issue)
+	}
+	return rejected
+}
+
+// LintedConnection decorates a Connection, running the statements read
+// through it past a Linter first.
+//
+// Queries built with Where, RawQuery and the like return a *pop.Query which
+// is not linted, hand them to Query to lint them too.
+type LintedConnection struct {
+	decorator
+	linter Linter
+}
+
+// Linted wraps conn so that its statements are checked by linter.
+//
+//	conn := Linted(db, Linter{Actions: map[LintRule]LintAction{LintUnboundedWrite: LintReject}})
+//	conn.Query(conn.RawQuery("DELETE FROM users")).Exec() // ErrQueryRejected
+func Linted(conn Connection, linter Linter) *LintedConnection {
+	c := &LintedConnection{linter: linter}
+	c.decorator = decorator{Connection: conn, wrap: func(conn Connection) Connection {
+		return Linted(conn, linter)
+	}}
+	return c
+}
+
+// Query wraps a query built on the connection so that it is linted too.
+// Finish building the query first, the methods returning a new Query return
+// an unlinted one.
+func (c *LintedConnection) Query(q *pop.Query) Query {
+	return &lintedQuery{Query: NewQueryAdapter(q), q: q, conn: c}
+}
+
+// check lints the statement q builds for model. model may be nil for raw
+// statements run with Exec.
+func (c *LintedConnection) check(q *pop.Query, model interface{}) error {
+	if q == nil || q.Connection == nil {
+		return nil
+	}
+	if model == nil {
+		if q.RawSQL == nil || q.RawSQL.Fragment == "" {
+			return nil
+		}
+		return c.linter.Check(q.RawSQL.Fragment, q.RawSQL.Arguments, 0)
+	}
+	m := pop.NewModel(model, c.Context())
+	stmt, args := q.ToSQL(m)
+	return c.linter.Check(stmt, args, len(m.Columns().Cols))
+}
+
+// Find the first record of the model in the database with a particular id.
+func (c *LintedConnection) Find(model interface{}, id interface{}) error {
+	if err := c.check(c.Connection.Q(), model); err != nil {
+		return err
+	}
+	return c.Connection.Find(model, id)
+}
+
+// First record of the model in the database that matches the query.
+func (c *LintedConnection) First(model interface{}) error {
+	if err := c.check(c.Connection.Q(), model); err != nil {
+		return err
+	}
+	return c.Connection.First(model)
+}
+
+// Last record of the model in the database that matches the query.
+func (c *LintedConnection) Last(model interface{}) error {
+	if err := c.check(c.Connection.Q(), model); err != nil {
+		return err
+	}
+	return c.Connection.Last(model)
+}
+
+// All retrieves all of the records in the database that match the query.
+func (c *LintedConnection) All(models interface{}) error {
+	if err := c.check(c.Connection.Q(), models); err != nil {
+		return err
+	}
+	return c.Connection.All(models)
+}
+
+// Count the number of records in the database.
+func (c *LintedConnection) Count(model interface{}) (int, error) {
+	if err := c.check(c.Connection.Q(), model); err != nil {
+		return 0, err
+	}
+	return c.Connection.Count(model)
+}
+
+// lintedQuery is the Query returned by LintedConnection.Query
+type lintedQuery struct {
+	Query
+	q    *pop.Query
+	conn *LintedConnection
+}
+
+// Find the first record of the model in the database with a particular id.
+func (q *lintedQuery) Find(model interface{}, id interface{}) error {
+	if err := q.conn.check(q.q, model); err != nil {
+		return err
+	}
+	return q.Query.Find(model, id)
+}
+
+// First record of the model in the database that matches the query.
+func (q *lintedQuery) First(model interface{}) error {
+	if err := q.conn.check(q.q, model); err != nil {
+		return err
+	}
+	return q.Query.First(model)
+}
+
+// Last record of the model in the database that matches the query.
+func (q *lintedQuery) Last(model interface{}) error {
+	if err := q.conn.check(q.q, model); err != nil {
+		return err
+	}
+	return q.Query.Last(model)
+}
+
+// All retrieves all of the records in the database that match the query.
+func (q *lintedQuery) All(models interface{}) error {
+	if err := q.conn.check(q.q, models); err != nil {
+		return err
+	}
+	return q.Query.All(models)
+}
+
+// Exists returns true/false if a record exists in the database that matches
+// the query.
+func (q *lintedQuery) Exists(model interface{}) (bool, error) {
+	if err := q.conn.check(q.q, model); err != nil {
+		return false, err
+	}
+	return q.Query.Exists(model)
+}
+
+// Count the number of records in the database.
+func (q *lintedQuery) Count(model interface{}) (int, error) {
+	if err := q.conn.check(q.q, model); err != nil {
+		return 0, err
+	}
+	return q.Query.Count(model)
+}
+
+// Exec runs the given query.
+func (q *lintedQuery) Exec() error {
+	if err := q.conn.check(q.q, nil); err != nil {
+		return err
+	}
+	return q.Query.Exec()
+}
+
+// ExecWithCount runs the given query, and returns the amount of affected
+// rows.
+func (q *lintedQuery) ExecWithCount() (int, error) {
+	if err := q.conn.check(q.q, nil); err != nil {
+		return 0, err
+	}
+	return q.Query.ExecWithCount()
+}
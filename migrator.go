@@ -0,0 +1,158 @@
+package ipop
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// MigrationStatus is the state of a migration in a database
+type MigrationStatus struct {
+	// Version is the timestamp prefix of the migration files
+	Version string
+	// Name is the part of the file names after the version
+	Name    string
+	Applied bool
+}
+
+// Migrator runs the migrations of a database
+type Migrator interface {
+	// Up runs the migrations not applied yet, in version order
+	Up() error
+	// Down rolls back the last step applied migrations, every one of them when
+	// step is zero
+	Down(step int) error
+	// Reset rolls back every migration, then runs them all again
+	Reset() error
+	// Status returns the migrations for the dialect of the connection, in
+	// version order
+	Status() ([]MigrationStatus, error)
+	// Create writes a new migration named name, with up and down as contents.
+	// ext is "fizz" or "sql".
+	Create(name, ext string, up, down []byte) error
+}
+
+// MigratorAdapter runs pop migrations through the Migrator interface
+type MigratorAdapter struct {
+	m    pop.Migrator
+	path string
+	conn Connection
+}
+
+// NewFileMigrator reads the migrations of the directory path, run on conn.
+// Like pop, it dumps the schema of the database to path after every run,
+// see SetSchemaPath.
+//
+//	m, err := NewFileMigrator("migrations", db)
+//	err = m.Up()
+func NewFileMigrator(path string, conn Connection) (*MigratorAdapter, error) {
+	fm, err := pop.NewFileMigrator(path, popConnection(conn))
+	if err != nil {
+		return nil, err
+	}
+	return &MigratorAdapter{m: fm.Migrator, path: path, conn: conn}, nil
+}
+
+// NewMigrationBox reads the migrations of fsys, such as an embed.FS, run on
+// conn, the way pop does. The migrations can not be added to with Create.
+// NewFSMigrator checks the migrations first.
+func NewMigrationBox(fsys fs.FS, conn Connection) (*MigratorAdapter, error) {
+	mb, err := pop.NewMigrationBox(fsys, popConnection(conn))
+	if err != nil {
+		return nil, err
+	}
+	return &MigratorAdapter{m: mb.Migrator, conn: conn}, nil
+}
+
+// popConnection returns the pop connection behind conn, bound to its
+// transaction if there is one.
+func popConnection(conn Connection) *pop.Connection {
+	return conn.Q().Connection
+}
+
+// SetSchemaPath sets the directory the schema is dumped to after Up, Down
+// and Reset. An empty path turns the dump off.
+func (m *MigratorAdapter) SetSchemaPath(path string) {
+	m.m.SchemaPath = path
+}
+
+// Up runs the migrations not applied yet, in version order
+func (m *MigratorAdapter) Up() error {
+	return m.m.Up()
+}
+
+// Down rolls back the last step applied migrations, every one of them when
+// step is zero
+func (m *MigratorAdapter) Down(step int) error {
+	return m.m.Down(step)
+}
+
+// Reset rolls back every migration, then runs them all again
+func (m *MigratorAdapter) Reset() error {
+	return m.m.Reset()
+}
+
+// Status returns the migrations for the dialect of the connection, in
+// version order
+func (m *MigratorAdapter) Status() ([]MigrationStatus, error) {
+	c := m.m.Connection
+	if err := m.m.CreateSchemaMigrations(); err != nil {
+		return nil, err
+	}
+	applied := []string{}
+	if err := c.Store.Select(&applied, fmt.Sprintf("SELECT version FROM %s", c.Dialect.Quote(c.MigrationTableName()))); err != nil {
+		return nil, mapError(err, nil)
+	}
+	versions := map[string]bool{}
+	for _, v := range applied {
+		versions[v] = true
+	}
+
+	var status []MigrationStatus
+	for _, mi := range m.m.UpMigrations.Migrations {
+		if mi.DBType != "all" && mi.DBType != c.Dialect.Name() {
+			continue
+		}
+		status = append(status, MigrationStatus{Version: mi.Version, Name: mi.Name, Applied: versions[mi.Version]})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
+
+var migrationName = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Create writes a new migration named name, with up and down as contents.
+// ext is "fizz" or "sql". It fails for migrations read from an fs.FS.
+func (m *MigratorAdapter) Create(name, ext string, up, down []byte) error {
+	if m.path == "" {
+		return fmt.Errorf("migrations read from a file system can not be created, write %s to the directory embedded instead", name)
+	}
+	if ext != "fizz" && ext != "sql" {
+		return fmt.Errorf("unknown migration type %q, use fizz or sql", ext)
+	}
+	name = strings.Trim(migrationName.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	base := filepath.Join(m.path, time.Now().UTC().Format("20060102150405")+"_"+name)
+	if err := os.WriteFile(base+".up."+ext, up, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".down."+ext, down, 0o644); err != nil {
+		return err
+	}
+
+	// read the migrations again so that the new one is run by Up
+	schemaPath := m.m.SchemaPath
+	fm, err := pop.NewFileMigrator(m.path, popConnection(m.conn))
+	if err != nil {
+		return err
+	}
+	m.m = fm.Migrator
+	m.m.SchemaPath = schemaPath
+	return nil
+}
@@ -0,0 +1,45 @@
+package ipop
+
+import "github.com/stretchr/testify/mock"
+
+// MockMigrator is a mock implementation of the Migrator interface. Methods
+// without an override succeed, and Status reports no migration.
+type MockMigrator struct {
+	mock.Mock
+	UpFunc     func() error
+	DownFunc   func(step int) error
+	ResetFunc  func() error
+	StatusFunc func() ([]MigrationStatus, error)
+	CreateFunc func(name, ext string, up, down []byte) error
+}
+
+func (m *MockMigrator) Up() error {
+	if m.UpFunc != nil {
+		return m.UpFunc()
+	}
+	return nil
+}
+func (m *MockMigrator) Down(step int) error {
+	if m.DownFunc != nil {
+		return m.DownFunc(step)
+	}
+	return nil
+}
+func (m *MockMigrator) Reset() error {
+	if m.ResetFunc != nil {
+		return m.ResetFunc()
+	}
+	return nil
+}
+func (m *MockMigrator) Status() ([]MigrationStatus, error) {
+	if m.StatusFunc != nil {
+		return m.StatusFunc()
+	}
+	return nil, nil
+}
+func (m *MockMigrator) Create(name, ext string, up, down []byte) error {
+	if m.CreateFunc != nil {
+		return m.CreateFunc(name, ext, up, down)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package ipop
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gobuffalo/flect"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// ModelProblemKind is the kind of a ModelProblem
+type ModelProblemKind string
+
+const (
+	// ModelMissingTable is a model whose table is not in the database
+	ModelMissingTable ModelProblemKind = "missing_table"
+	// ModelMissingColumn is a field whose column is not in the table
+	ModelMissingColumn ModelProblemKind = "missing_column"
+	// ModelTypeMismatch is a field whose column holds another kind of values
+	ModelTypeMismatch ModelProblemKind = "type_mismatch"
+	// ModelUnsupportedField is a field pop can not store in a column, such as
+	// a struct or a slice of structs
+	ModelUnsupportedField ModelProblemKind = "unsupported_field"
+	// ModelMissingID is a model without the ID field pop needs
+	ModelMissingID ModelProblemKind = "missing_id"
+	// ModelMissingForeignKey is an association without the field or column
+	// holding the key of the other model
+	ModelMissingForeignKey ModelProblemKind = "missing_foreign_key"
+)
+
+// ModelProblem is a reason a model can not be stored in its table
+type ModelProblem struct {
+	Kind    ModelProblemKind `json:"kind"`
+	Model   string           `json:"model"`
+	Table   string           `json:"table"`
+	Field   string           `json:"field,omitempty"`
+	Column  string           `json:"column,omitempty"`
+	Message string           `json:"message"`
+}
+
+func (p ModelProblem) String() string {
+	name := p.Model
+	if p.Field != "" {
+		name += "." + p.Field
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Kind, name, p.Message)
+}
+
+// ModelReport lists the problems found by ValidateModels
+type ModelReport struct {
+	Problems []ModelProblem `json:"problems"`
+}
+
+func (r ModelReport) String() string {
+	lines := make([]string, len(r.Problems))
+	for i, p := range r.Problems {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateModels checks that the given models can be stored in their tables
+// of the database of conn: that they have an ID, that every field has a
+// column holding the same kind of values and a type pop can store, and that
+// their associations have foreign keys. The error wraps ErrInvalidModels
+// when the report has problems; a model that is not a struct, or a pointer
+// or slice of one, is an error of its own.
+//
+//	if report, err := ValidateModels(db, &User{}, &Team{}); err != nil {
+//		log.Fatalf("%s\n%s", err, report)
+//	}
+func ValidateModels(conn Connection, models ...interface{}) (ModelReport, error) {
+	var report ModelReport
+	inspector := conn.Inspector()
+	tables, err := inspector.Tables()
+	if err != nil {
+		return report, err
+	}
+
+	for _, model := range models {
+		t := structType(model)
+		if t == nil {
+			return report, fmt.Errorf("model %T is not a struct", model)
+		}
+		problems, err := validateModel(inspector, t, tables)
+		if err != nil {
+			return report, err
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	if len(report.Problems) > 0 {
+		return report, fmt.Errorf("%w: %d problems found", ErrInvalidModels, len(report.Problems))
+	}
+	return report, nil
+}
+
+func validateModel(inspector Inspector, t reflect.Type, tables []string) ([]ModelProblem, error) {
+	var problems []ModelProblem
+	table := pop.NewModel(reflect.New(t).Interface(), nil).TableName()
+	add := func(kind ModelProblemKind, field, column, format string, args ...interface{}) {
+		problems = append(problems, ModelProblem{Kind: kind, Model: t.String(), Table: table, Field: field, Column: column, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if _, ok := t.FieldByName("ID"); !ok {
+		add(ModelMissingID, "", "", "pop needs an ID field to find, update and delete rows")
+	}
+
+	var columns map[string]Column
+	if contains(tables, table) {
+		list, err := inspector.Columns(table)
+		if err != nil {
+			return nil, err
+		}
+		columns = map[string]Column{}
+		for _, col := range list {
+			columns[col.Name] = col
+		}
+	} else {
+		add(ModelMissingTable, "", "", "table %s does not exist", table)
+	}
+
+	for _, f := range modelFields(t) {
+		if assoc := associationTag(f.StructField); assoc != "" {
+			add(ModelUnsupportedField, f.Name, f.Column, "%s association must be tagged db:\"-\"", assoc)
+			continue
+		}
+		if !storable(f.Type) {
+			add(ModelUnsupportedField, f.Name, f.Column, "%s can not be stored in a column, tag it db:\"-\" and use an association, or use a type implementing driver.Valuer and sql.Scanner", f.Type)
+			continue
+		}
+		if columns == nil {
+			continue
+		}
+		col, ok := columns[f.Column]
+		if !ok {
+			add(ModelMissingColumn, f.Name, f.Column, "column %s does not exist", f.Column)
+			continue
+		}
+		if typ, _ := goColumnType(f.Type); !sameType(typ, col.Type) {
+			add(ModelTypeMismatch, f.Name, f.Column, "%s field stored in a %s column", f.Type, col.Type)
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if msg := missingForeignKey(t, f); msg != "" {
+			add(ModelMissingForeignKey, f.Name, "", "%s", msg)
+		}
+	}
+	return problems, nil
+}
+
+var associationTags = []string{"belongs_to", "has_one", "has_many", "many_to_many"}
+
+// associationTag returns the association tag of f, or "".
+func associationTag(f reflect.StructField) string {
+	for _, tag := range associationTags {
+		if hasTag(f, tag) {
+			return tag
+		}
+	}
+	return ""
+}
+
+var (
+	valuerType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+)
+
+// storable reports whether values of type t can be written to a column.
+func storable(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(valuerType) || reflect.PtrTo(t).Implements(valuerType) {
+		return reflect.PtrTo(t).Implements(scannerType)
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return t.String() == "time.Time"
+}
+
+// missingForeignKey describes the foreign key missing for the association
+// field f of model t, the way pop looks for it, or returns "".
+func missingForeignKey(t reflect.Type, f reflect.StructField) string {
+	fk := f.Tag.Get("fk_id")
+	other := f.Type
+	for other.Kind() == reflect.Ptr || other.Kind() == reflect.Slice {
+		other = other.Elem()
+	}
+	switch {
+	case hasTag(f, "belongs_to"):
+		if fk == "" {
+			fk = f.Name + "ID"
+		}
+		if !hasField(t, fk) {
+			return fmt.Sprintf("belongs_to needs a %s field in %s, or an fk_id tag naming it", fk, t)
+		}
+	case hasTag(f, "has_one"), hasTag(f, "has_many"):
+		if fk == "" {
+			fk = flect.Underscore(t.Name()) + "_id"
+		}
+		if other.Kind() == reflect.Struct && !hasField(other, fk) {
+			return fmt.Sprintf("%s needs a %s column in %s, or an fk_id tag naming it", associationTag(f), fk, other)
+		}
+	}
+	return ""
+}
+
+func hasTag(f reflect.StructField, tag string) bool {
+	_, ok := f.Tag.Lookup(tag)
+	return ok
+}
+
+// hasField reports whether t has a field named name, or stored in the
+// column name.
+func hasField(t reflect.Type, name string) bool {
+	if _, ok := t.FieldByName(name); ok {
+		return true
+	}
+	for _, f := range modelFields(t) {
+		if f.Column == name {
+			return true
+		}
+	}
+	return false
+}
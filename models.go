@@ -0,0 +1,143 @@
+package ipop
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// eachModel calls fn with a pointer to every element when model is a slice,
+// and with model itself otherwise, the same way pop iterates models.
+func eachModel(model interface{}, fn func(m interface{})) {
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		fn(model)
+		return
+	}
+	for i := 0; i < v.Len(); i++ {
+		e := v.Index(i)
+		if e.Kind() == reflect.Ptr {
+			fn(e.Interface())
+			continue
+		}
+		fn(e.Addr().Interface())
+	}
+}
+
+// modelTable returns the table name pop uses for model.
+func modelTable(model interface{}) string {
+	return pop.NewModel(model, nil).TableName()
+}
+
+// modelID returns the value of the ID field of model, nil when it has none.
+func modelID(model interface{}) interface{} {
+	m := pop.NewModel(model, nil)
+	if v, ok := columnValue(model, m.IDField()); ok {
+		return v
+	}
+	return m.ID()
+}
+
+// hasZeroID reports whether the ID of model is not set, the test pop's Save
+// uses to choose between Create and Update.
+func hasZeroID(model interface{}) bool {
+	f := reflect.Indirect(reflect.ValueOf(model)).FieldByName("ID")
+	return !f.IsValid() || f.IsZero()
+}
+
+// newModelLike returns a pointer to a new zero value of model's type.
+func newModelLike(model interface{}) interface{} {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.New(t).Interface()
+}
+
+// snapshot returns a copy of the struct model points to, so that later
+// changes to model do not show through.
+func snapshot(model interface{}) interface{} {
+	if model == nil {
+		return nil
+	}
+	return reflect.Indirect(reflect.ValueOf(model)).Interface()
+}
+
+// dbFields returns the values of the fields of a struct keyed by their `db`
+// column name. Fields tagged `db:"-"` or without a tag are skipped.
+func dbFields(model interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if model == nil {
+		return fields
+	}
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return fields
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("db"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = v.Field(i).Interface()
+	}
+	return fields
+}
+
+// sameValue compares two field values, treating times at the same instant
+// as equal whatever their location.
+func sameValue(a, b interface{}) bool {
+	ta, aok := a.(time.Time)
+	tb, bok := b.(time.Time)
+	if aok && bok {
+		return ta.Equal(tb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// loadStored reads the stored version of each model that has an ID, keyed by
+// that ID.
+func loadStored(conn Connection, model interface{}) map[interface{}]interface{} {
+	stored := map[interface{}]interface{}{}
+	eachModel(model, func(m interface{}) {
+		if hasZeroID(m) {
+			return
+		}
+		s := newModelLike(m)
+		if err := conn.Find(s, modelID(m)); err == nil {
+			stored[modelID(m)] = snapshot(s)
+		}
+	})
+	return stored
+}
+
+// findByColumns reads the stored row sharing the values of the given columns
+// with model.
+func findByColumns(conn Connection, model interface{}, columns []string) (interface{}, bool) {
+	q := conn.Q()
+	if q == nil || q.Connection == nil {
+		return nil, false
+	}
+	clauses := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+	for _, col := range columns {
+		v, ok := columnValue(model, col)
+		if !ok {
+			return nil, false
+		}
+		clauses = append(clauses, q.Connection.Dialect.Quote(col)+" = ?")
+		args = append(args, v)
+	}
+	stored := newModelLike(model)
+	if err := q.Where(strings.Join(clauses, " AND "), args...).First(stored); err != nil {
+		return nil, false
+	}
+	return snapshot(stored), true
+}
@@ -0,0 +1,353 @@
+package ipop
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// NPlusOne describes a query shape that ran more often than allowed within a
+// detection scope, usually because a loop loads rows one by one.
+type NPlusOne struct {
+	// Shape is the SQL of the query with its values replaced by placeholders
+	Shape string
+	// Count is how many times the shape ran within the scope
+	Count int
+	// Stack is the stack trace of the first query of that shape
+	Stack string
+	// Suggestion hints at the Eager call loading the rows up front
+	Suggestion string
+}
+
+func (n NPlusOne) String() string {
+	return fmt.Sprintf("%s ran %d times, %s\nfirst run at:\n%s", n.Shape, n.Count, n.Suggestion, n.Stack)
+}
+
+// TestingT is the subset of testing.TB used by the test helpers
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Cleanup(fn func())
+}
+
+// NPlusOneDetector decorates a Connection, counting the reads made through
+// it by shape within a scope. A shape running more than the threshold is
+// reported by End.
+//
+// Find, First, Last, All, Count, Load and Reload are counted. Queries built
+// with Where, Order and the like return a *pop.Query which is not seen, hand
+// them to Query to count them too.
+type NPlusOneDetector struct {
+	decorator
+	scope *nPlusOneScope
+}
+
+type nPlusOneScope struct {
+	threshold int
+
+	mu     sync.Mutex
+	order  []string
+	shapes map[string]*NPlusOne
+	// models holds the model types read within the scope, the parents whose
+	// associations may load the rows of a repeated shape
+	models []reflect.Type
+}
+
+// DetectNPlusOne wraps conn and begins a scope in which a shape may run at
+// most threshold times.
+//
+//	scope := DetectNPlusOne(conn, 5)
+//	handler(scope)
+//	for _, n := range scope.End() {
+//		log.Print(n)
+//	}
+func DetectNPlusOne(conn Connection, threshold int) *NPlusOneDetector {
+	return newNPlusOneDetector(conn, &nPlusOneScope{threshold: threshold, shapes: map[string]*NPlusOne{}})
+}
+
+// DetectNPlusOneT wraps conn for the duration of a test, failing the test
+// when a shape ran more than threshold times once it is over.
+func DetectNPlusOneT(t TestingT, conn Connection, threshold int) Connection {
+	t.Helper()
+	d := DetectNPlusOne(conn, threshold)
+	t.Cleanup(func() {
+		for _, n := range d.End() {
+			t.Errorf("N+1 queries: %s", n)
+		}
+	})
+	return d
+}
+
+func newNPlusOneDetector(conn Connection, scope *nPlusOneScope) *NPlusOneDetector {
+	d := &NPlusOneDetector{scope: scope}
+	d.decorator = decorator{Connection: conn, wrap: func(conn Connection) Connection {
+		return newNPlusOneDetector(conn, scope)
+	}}
+	return d
+}
+
+// Begin returns a connection counting into a new scope, with the same
+// threshold, such as one per request.
+func (d *NPlusOneDetector) Begin() *NPlusOneDetector {
+	return DetectNPlusOne(d.Connection, d.scope.threshold)
+}
+
+// End returns the shapes that ran more than the threshold since the scope
+// began, or since the previous End, and starts counting afresh.
+func (d *NPlusOneDetector) End() []NPlusOne {
+	s := d.scope
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offenders := []NPlusOne{}
+	for _, shape := range s.order {
+		if n := s.shapes[shape]; n.Count > s.threshold {
+			offenders = append(offenders, *n)
+		}
+	}
+	sort.SliceStable(offenders, func(i, j int) bool {
+		return offenders[i].Count > offenders[j].Count
+	})
+	s.order, s.shapes, s.models = nil, map[string]*NPlusOne{}, nil
+	return offenders
+}
+
+// Query wraps a query built on the connection so that its reads are counted
+// too. Finish building the query first, the methods returning a new Query
+// return an uncounted one.
+func (d *NPlusOneDetector) Query(q *pop.Query) Query {
+	return &countedQuery{Query: NewQueryAdapter(q), q: q, detector: d}
+}
+
+// record counts a run of shape for a read of model, suggest is called with
+// the scope locked the first time the shape runs.
+func (s *nPlusOneScope) record(shape string, model interface{}, suggest func() string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := structType(model)
+	if t != nil && !containsType(s.models, t) {
+		s.models = append(s.models, t)
+	}
+	n, ok := s.shapes[shape]
+	if !ok {
+		n = &NPlusOne{Shape: shape, Stack: string(debug.Stack()), Suggestion: suggest()}
+		s.shapes[shape] = n
+		s.order = append(s.order, shape)
+	}
+	n.Count++
+}
+
+// eagerSuggestion names the associations of the models read within the
+// scope that would load the rows of model up front. The scope must be locked.
+func (s *nPlusOneScope) eagerSuggestion(model interface{}, table string) string {
+	t := structType(model)
+	for _, parent := range s.models {
+		if parent == t {
+			continue
+		}
+		if fields := associationsTo(parent, table); len(fields) > 0 {
+			return fmt.Sprintf("use %s on the query loading the %s rows", eagerCall(fields),
+				pop.NewModel(reflect.New(parent).Interface(), nil).TableName())
+		}
+	}
+	return fmt.Sprintf("load the %s rows through an Eager association of the query returning their parents", table)
+}
+
+func (d *NPlusOneDetector) recordQuery(q *pop.Query, op string, model interface{}) {
+	if q == nil || q.Connection == nil {
+		return
+	}
+	m := pop.NewModel(model, d.Context())
+	sql, _ := q.ToSQL(m)
+	d.scope.record(op+": "+normalizeSQL(sql), model, func() string {
+		return d.scope.eagerSuggestion(model, m.TableName())
+	})
+}
+
+// associationsTo returns the association fields of the model type t holding
+// rows of table, or every association field when table is "".
+func associationsTo(t reflect.Type, table string) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || associationTag(f) == "" {
+			continue
+		}
+		target := structType(reflect.New(f.Type).Interface())
+		if target == nil {
+			continue
+		}
+		if table == "" || pop.NewModel(reflect.New(target).Interface(), nil).TableName() == table {
+			fields = append(fields, f.Name)
+		}
+	}
+	return fields
+}
+
+// structType returns the struct type of a model, a slice of models or a
+// pointer to either, nil for anything else.
+func structType(model interface{}) reflect.Type {
+	t := reflect.TypeOf(model)
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+func containsType(types []reflect.Type, t reflect.Type) bool {
+	for _, e := range types {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// eagerCall formats the Eager call loading the given association fields.
+func eagerCall(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		quoted[i] = strconv.Quote(f)
+	}
+	return fmt.Sprintf("Eager(%s)", strings.Join(quoted, ", "))
+}
+
+var (
+	sqlStrings      = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumbers      = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	sqlPlaceholders = regexp.MustCompile(`\$\d+|:\w+`)
+	sqlLists        = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	sqlSpaces       = regexp.MustCompile(`\s+`)
+)
+
+// normalizeSQL replaces the values of a statement by placeholders, so that
+// statements differing only by their values share a shape.
+func normalizeSQL(sql string) string {
+	sql = sqlStrings.ReplaceAllString(sql, "?")
+	sql = sqlPlaceholders.ReplaceAllString(sql, "?")
+	sql = sqlNumbers.ReplaceAllString(sql, "?")
+	sql = sqlLists.ReplaceAllString(sql, "(?)")
+	return strings.TrimSpace(sqlSpaces.ReplaceAllString(sql, " "))
+}
+
+// Find the first record of the model in the database with a particular id.
+//
+//	c.Find(&User{}, 1)
+func (d *NPlusOneDetector) Find(model interface{}, id interface{}) error {
+	q := d.Connection.Q()
+	if q.Connection != nil {
+		q = q.Where(pop.NewModel(model, d.Context()).WhereID(), id)
+	}
+	d.recordQuery(q, "find", model)
+	return d.Connection.Find(model, id)
+}
+
+// First record of the model in the database that matches the query.
+//
+//	c.First(&User{})
+func (d *NPlusOneDetector) First(model interface{}) error {
+	d.recordQuery(d.Connection.Q(), "first", model)
+	return d.Connection.First(model)
+}
+
+// Last record of the model in the database that matches the query.
+//
+//	c.Last(&User{})
+func (d *NPlusOneDetector) Last(model interface{}) error {
+	d.recordQuery(d.Connection.Q(), "last", model)
+	return d.Connection.Last(model)
+}
+
+// All retrieves all of the records in the database that match the query.
+//
+//	c.All(&[]User{})
+func (d *NPlusOneDetector) All(models interface{}) error {
+	d.recordQuery(d.Connection.Q(), "all", models)
+	return d.Connection.All(models)
+}
+
+// Count the number of records in the database.
+//
+//	c.Count(&User{})
+func (d *NPlusOneDetector) Count(model interface{}) (int, error) {
+	d.recordQuery(d.Connection.Q(), "count", model)
+	return d.Connection.Count(model)
+}
+
+// Reload fetch fresh data for a given model, using its ID.
+func (d *NPlusOneDetector) Reload(model interface{}) error {
+	d.recordQuery(d.Connection.Q(), "reload", model)
+	return d.Connection.Reload(model)
+}
+
+// Load loads all association or the fields specified in params for
+// an already loaded model.
+//
+//	c.First(&u)
+//	c.Load(&u)
+func (d *NPlusOneDetector) Load(model interface{}, fields ...string) error {
+	table := modelTable(model)
+	d.scope.record(fmt.Sprintf("load: %s %s", table, strings.Join(fields, ", ")), model, func() string {
+		eager := fields
+		if len(eager) == 0 {
+			if t := structType(model); t != nil {
+				eager = associationsTo(t, "")
+			}
+		}
+		return fmt.Sprintf("use %s on the query loading the %s rows instead of Load", eagerCall(eager), table)
+	})
+	return d.Connection.Load(model, fields...)
+}
+
+// countedQuery is the Query returned by NPlusOneDetector.Query
+type countedQuery struct {
+	Query
+	q        *pop.Query
+	detector *NPlusOneDetector
+}
+
+// Find the first record of the model in the database with a particular id.
+func (q *countedQuery) Find(model interface{}, id interface{}) error {
+	q.detector.recordQuery(q.q, "find", model)
+	return q.Query.Find(model, id)
+}
+
+// First record of the model in the database that matches the query.
+func (q *countedQuery) First(model interface{}) error {
+	q.detector.recordQuery(q.q, "first", model)
+	return q.Query.First(model)
+}
+
+// Last record of the model in the database that matches the query.
+func (q *countedQuery) Last(model interface{}) error {
+	q.detector.recordQuery(q.q, "last", model)
+	return q.Query.Last(model)
+}
+
+// All retrieves all of the records in the database that match the query.
+func (q *countedQuery) All(models interface{}) error {
+	q.detector.recordQuery(q.q, "all", models)
+	return q.Query.All(models)
+}
+
+// Exists returns true/false if a record exists in the database that matches
+// the query.
+func (q *countedQuery) Exists(model interface{}) (bool, error) {
+	q.detector.recordQuery(q.q, "exists", model)
+	return q.Query.Exists(model)
+}
+
+// Count the number of records in the database.
+func (q *countedQuery) Count(model interface{}) (int, error) {
+	q.detector.recordQuery(q.q, "count", model)
+	return q.Query.Count(model)
+}
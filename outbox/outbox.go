@@ -0,0 +1,62 @@
+// Package outbox implements the transactional outbox pattern on top of an
+// ipop.Connection: messages are written to a table in the same transaction
+// as the data they describe, and a Relay delivers them afterwards.
+package outbox
+
+import (
+	"embed"
+	"errors"
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gofrs/uuid"
+	"github.com/kiihela/ipop"
+)
+
+// TableName is the name of the table holding the outbox messages
+const TableName = "ipop_outbox"
+
+// Migrations holds the fizz migrations creating the outbox table. Run them
+// with pop.NewMigrationBox, or copy them next to your own migrations.
+//
+//go:embed migrations
+var Migrations embed.FS
+
+// Message is a row of the outbox table
+type Message struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+	Topic         string     `json:"topic" db:"topic"`
+	Payload       []byte     `json:"payload" db:"payload"`
+	Attempts      int        `json:"attempts" db:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" db:"next_attempt_at"`
+	SentAt        nulls.Time `json:"sent_at" db:"sent_at"`
+	LastError     string     `json:"last_error" db:"last_error"`
+}
+
+// TableName maps Message onto the outbox table
+func (Message) TableName() string {
+	return TableName
+}
+
+// Enqueue writes a message to the outbox. Pass the transaction that writes
+// the data the message is about, so that both are committed or rolled back
+// together.
+//
+//	tx.Transaction(func(tx ipop.Connection) error {
+//		if err := tx.Create(&order); err != nil {
+//			return err
+//		}
+//		return outbox.Enqueue(tx, "orders.created", payload)
+//	})
+func Enqueue(tx ipop.Connection, topic string, payload []byte) error {
+	if topic == "" {
+		return errors.New("outbox messages need a topic")
+	}
+	return tx.Create(&Message{
+		Topic:         topic,
+		Payload:       payload,
+		NextAttemptAt: time.Now().UTC(),
+	})
+}
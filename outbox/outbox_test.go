@@ -0,0 +1,159 @@
+//go:build sqlite
+// +build sqlite
+
+package outbox
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/kiihela/ipop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConnection(t *testing.T) ipop.Connection {
+	conn, err := pop.NewConnection(&pop.ConnectionDetails{
+		Dialect:  "sqlite3",
+		Database: filepath.Join(t.TempDir(), "outbox.sqlite"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, conn.Open())
+	t.Cleanup(func() { conn.Close() })
+
+	db := ipop.NewConnectionAdapter(conn)
+	migrator, err := ipop.NewMigrationBox(Migrations, db)
+	require.NoError(t, err)
+	require.NoError(t, migrator.Up())
+
+	return db
+}
+
+type published struct {
+	topic   string
+	payload string
+}
+
+func TestEnqueue_RolledBackWithTransaction(t *testing.T) {
+	db := newTestConnection(t)
+
+	err := db.Transaction(func(tx ipop.Connection) error {
+		assert.NoError(t, Enqueue(tx, "users.created", []byte("bob")))
+		return errors.New("ooops")
+	})
+	assert.Error(t, err)
+
+	count, err := db.Count(&Message{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.Error(t, Enqueue(db, "", nil))
+}
+
+func TestRelay_DeliversAndRetries(t *testing.T) {
+	db := newTestConnection(t)
+
+	assert.NoError(t, db.Transaction(func(tx ipop.Connection) error {
+		assert.NoError(t, Enqueue(tx, "users.created", []byte("bob")))
+		return Enqueue(tx, "users.deleted", []byte("alice"))
+	}))
+
+	var got []published
+	failing := true
+	relay := NewRelay(db, PublisherFunc(func(ctx context.Context, topic string, payload []byte) error {
+		if topic == "users.deleted" && failing {
+			return errors.New("broker unavailable")
+		}
+		got = append(got, published{topic, string(payload)})
+		return nil
+	}))
+
+	now := time.Now()
+	relay.Now = func() time.Time { return now }
+
+	n, err := relay.Process(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []published{{"users.created", "bob"}}, got)
+
+	var failed Message
+	assert.NoError(t, db.Where("topic = ?", "users.deleted").First(&failed))
+	assert.Equal(t, 1, failed.Attempts)
+	assert.Equal(t, "broker unavailable", failed.LastError)
+	assert.False(t, failed.SentAt.Valid)
+
+	// still backing off
+	n, err = relay.Process(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	failing = false
+	now = now.Add(time.Minute)
+	n, err = relay.Process(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, published{"users.deleted", "alice"}, got[1])
+
+	pending, err := db.Where("sent_at IS NULL").Count(&Message{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+}
+
+func TestRelay_PublishesOutsideTheClaim(t *testing.T) {
+	db := newTestConnection(t)
+	assert.NoError(t, Enqueue(db, "users.created", []byte("bob")))
+
+	var other *Relay
+	relay := NewRelay(db, PublisherFunc(func(context.Context, string, []byte) error {
+		// the message is claimed, and the outbox is not locked
+		n, err := other.Process(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		return Enqueue(db, "users.updated", []byte("bob"))
+	}))
+	other = NewRelay(db, PublisherFunc(func(context.Context, string, []byte) error {
+		t.Error("claimed message published twice")
+		return nil
+	}))
+
+	n, err := relay.Process(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	pending, err := db.Where("sent_at IS NULL").Count(&Message{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pending)
+}
+
+func TestRelay_RunStopsWithContext(t *testing.T) {
+	db := newTestConnection(t)
+	assert.NoError(t, Enqueue(db, "users.created", []byte("bob")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	relay := NewRelay(db, PublisherFunc(func(context.Context, string, []byte) error {
+		cancel()
+		return nil
+	}))
+	relay.PollInterval = time.Millisecond
+
+	assert.NoError(t, relay.Run(ctx))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, 5*time.Second)
+	assert.Equal(t, time.Second, backoff(1))
+	assert.Equal(t, 2*time.Second, backoff(2))
+	assert.Equal(t, 4*time.Second, backoff(3))
+	assert.Equal(t, 5*time.Second, backoff(4))
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "abc", truncate("abc", 5))
+	assert.Equal(t, "ab", truncate("abc", 2))
+	assert.Equal(t, "a", truncate("aé", 2))
+	assert.Equal(t, "aé", truncate("aé", 3))
+}
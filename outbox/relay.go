@@ -0,0 +1,180 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/kiihela/ipop"
+)
+
+const maxErrorLength = 1024
+
+// Publisher delivers outbox messages to the outside world, a message broker
+// for instance.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+}
+
+// PublisherFunc lets an ordinary function be used as a Publisher
+type PublisherFunc func(ctx context.Context, topic string, payload []byte) error
+
+// Publish calls f(ctx, topic, payload)
+func (f PublisherFunc) Publish(ctx context.Context, topic string, payload []byte) error {
+	return f(ctx, topic, payload)
+}
+
+// Relay polls the outbox table and hands pending messages to a Publisher.
+// Messages that fail to publish are retried after a backoff, so delivery is
+// at least once and publishers should be idempotent.
+type Relay struct {
+	conn      ipop.Connection
+	publisher Publisher
+
+	// BatchSize is the maximum number of messages claimed at once
+	BatchSize int
+	// ClaimTimeout is how long claimed messages are left to the relay
+	// publishing them. They are retried once it passes if the relay did not
+	// record the outcome, because it stopped while publishing for instance.
+	ClaimTimeout time.Duration
+	// PollInterval is how long Run waits when the outbox is empty
+	PollInterval time.Duration
+	// Backoff returns how long to wait before retrying a message that failed
+	// to publish the given number of times
+	Backoff func(attempts int) time.Duration
+	// Now returns the current time, it can be replaced in tests
+	Now func() time.Time
+}
+
+// NewRelay creates a Relay delivering the messages stored through conn to p
+func NewRelay(conn ipop.Connection, p Publisher) *Relay {
+	return &Relay{
+		conn:         conn,
+		publisher:    p,
+		BatchSize:    100,
+		ClaimTimeout: 5 * time.Minute,
+		PollInterval: time.Second,
+		Backoff:      ExponentialBackoff(time.Second, 5*time.Minute),
+		Now:          time.Now,
+	}
+}
+
+// ExponentialBackoff doubles the wait after every failed attempt, starting
+// at base and never exceeding max.
+func ExponentialBackoff(base, max time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		d := base
+		for i := 1; i < attempts && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			return max
+		}
+		return d
+	}
+}
+
+// Run delivers messages until ctx is cancelled. It only returns early when
+// reading from or writing to the outbox table fails.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Process(ctx)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.PollInterval):
+		}
+	}
+}
+
+// Process delivers one batch of pending messages and returns how many were
+// handed to the publisher, successfully or not. The batch is claimed in a
+// short transaction, pushing the next attempt of its messages ClaimTimeout
+// away, and published once that transaction is committed, so that no rows
+// stay locked while the publisher runs. Rows are locked with
+// FOR UPDATE SKIP LOCKED while they are claimed where the database supports
+// it, so several relays can share one outbox.
+func (r *Relay) Process(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil
+	}
+
+	now := r.Now().UTC()
+	pending, err := r.claim(now)
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	for i := range pending {
+		msg := &pending[i]
+		if err := ctx.Err(); err != nil {
+			// hand the rest back without waiting for the claim to time out
+			msg.NextAttemptAt = now
+		} else if err := r.publisher.Publish(ctx, msg.Topic, msg.Payload); err != nil {
+			msg.Attempts++
+			msg.NextAttemptAt = now.Add(r.Backoff(msg.Attempts))
+			msg.LastError = truncate(err.Error(), maxErrorLength)
+			processed++
+		} else {
+			msg.SentAt = nulls.NewTime(now)
+			msg.LastError = ""
+			processed++
+		}
+		if err := r.conn.Update(msg); err != nil {
+			return processed, err
+		}
+	}
+	return processed, nil
+}
+
+// claim reads a batch of pending messages and moves their next attempt
+// ClaimTimeout away, so that no other relay picks them up meanwhile.
+func (r *Relay) claim(now time.Time) ([]Message, error) {
+	var pending []Message
+	err := r.conn.Transaction(func(tx ipop.Connection) error {
+		stmt := fmt.Sprintf("SELECT * FROM %s WHERE sent_at IS NULL AND next_attempt_at <= ? ORDER BY created_at LIMIT %d%s",
+			TableName, r.BatchSize, lockClause(tx.Dialect()))
+		if err := tx.RawQuery(stmt, now).All(&pending); err != nil {
+			return err
+		}
+		for i := range pending {
+			pending[i].NextAttemptAt = now.Add(r.ClaimTimeout)
+			if err := tx.Update(&pending[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// lockClause returns the row locking suffix for dialects that support it.
+// sqlite locks the whole database for writes anyway.
+func lockClause(dialect string) string {
+	switch dialect {
+	case "postgres", "cockroach", "mysql":
+		return " FOR UPDATE SKIP LOCKED"
+	}
+	return ""
+}
+
+// truncate cuts s to at most n bytes, without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
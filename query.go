@@ -21,6 +21,20 @@ type Query interface {
 	// ExecWithCount runs the given query, and returns the amount of
 	// affected rows.
 	ExecWithCount() (int, error)
+	// UpdateAll sets the given column values on every row of the model's table
+	// matched by the query, and returns the amount of affected rows. The
+	// `updated_at` column is set automatically when the model has one.
+	//
+	//	q.Where("team_id = ?", id).UpdateAll(&User{}, map[string]interface{}{"active": false})
+	UpdateAll(model interface{}, values map[string]interface{}) (int, error)
+	// DeleteAll deletes every row of the model's table matched by the query,
+	// and returns the amount of affected rows.
+	//
+	//	q.Where("team_id = ?", id).DeleteAll(&User{})
+	DeleteAll(model interface{}) (int, error)
+	// AllowFullTable lets UpdateAll and DeleteAll run on a query without a
+	// where clause. Without it they refuse to touch the whole table.
+	AllowFullTable() Query
 
 	// Find the first record of the model in the database with a particular id.
 	//
@@ -100,6 +114,12 @@ type Query interface {
 	// ToSQL will generate SQL and the appropriate arguments for that SQL
 	// from the `Model` passed in.
 	ToSQL(model *pop.Model, addColumns ...string) (string, []interface{})
+	// Explain runs the EXPLAIN statement of the database for the query built
+	// from the model passed in, and returns the plan it reports.
+	//
+	//	plan, err := q.Where("name = ?", "mark").Explain(&User{})
+	//	plan.FullScans()
+	Explain(model interface{}) (Plan, error)
 
 	// GroupBy will append a GROUP BY clause to the query
 	GroupBy(field string, fields ...string) Query
@@ -137,3 +157,290 @@ type Query interface {
 	//	c.Scope(ByName("mark)).Scope(WithDeleted).First(&User{})
 	Scope(sf pop.ScopeFunc) Query
 }
+
+// QueryAdapter wraps a *pop.Query so that it can be used as a Query.
+type QueryAdapter struct {
+	q              *pop.Query
+	allowFullTable bool
+}
+
+// NewQueryAdapter wraps the given pop query.
+//
+//	q := NewQueryAdapter(conn.Where("name = ?", "mark"))
+func NewQueryAdapter(q *pop.Query) *QueryAdapter {
+	return &QueryAdapter{q: q}
+}
+
+func (q *QueryAdapter) wrap(pq *pop.Query) *QueryAdapter {
+	return &QueryAdapter{q: pq, allowFullTable: q.allowFullTable}
+}
+
+// BelongsTo adds a "where" clause based on the "ID" of the
+// "model" passed into it.
+func (q *QueryAdapter) BelongsTo(model interface{}) Query {
+	return q.wrap(q.q.BelongsTo(model))
+}
+
+// BelongsToAs adds a "where" clause based on the "ID" of the
+// "model" passed into it, using an alias.
+func (q *QueryAdapter) BelongsToAs(model interface{}, as string) Query {
+	return q.wrap(q.q.BelongsToAs(model, as))
+}
+
+// BelongsToThrough adds a "where" clause that connects the "bt" model
+// through the associated "thru" model.
+func (q *QueryAdapter) BelongsToThrough(bt, thru interface{}) Query {
+	return q.wrap(q.q.BelongsToThrough(bt, thru))
+}
+
+// Exec runs the given query.
+func (q *QueryAdapter) Exec() error {
+	return mapError(q.q.Exec(), nil)
+}
+
+// ExecWithCount runs the given query, and returns the amount of
+// affected rows.
+func (q *QueryAdapter) ExecWithCount() (int, error) {
+	n, err := q.q.ExecWithCount()
+	return n, mapError(err, nil)
+}
+
+// UpdateAll sets the given column values on every row of the model's table
+// matched by the query, and returns the amount of affected rows. The
+// `updated_at` column is set automatically when the model has one.
+//
+//	q.Where("team_id = ?", id).UpdateAll(&User{}, map[string]interface{}{"active": false})
+func (q *QueryAdapter) UpdateAll(model interface{}, values map[string]interface{}) (int, error) {
+	n, err := updateAll(q.q, model, values, q.allowFullTable)
+	return n, mapError(err, model)
+}
+
+// DeleteAll deletes every row of the model's table matched by the query,
+// and returns the amount of affected rows.
+//
+//	q.Where("team_id = ?", id).DeleteAll(&User{})
+func (q *QueryAdapter) DeleteAll(model interface{}) (int, error) {
+	n, err := deleteAll(q.q, model, q.allowFullTable)
+	return n, mapError(err, model)
+}
+
+// AllowFullTable lets UpdateAll and DeleteAll run on a query without a
+// where clause. Without it they refuse to touch the whole table.
+func (q *QueryAdapter) AllowFullTable() Query {
+	a := q.wrap(q.q)
+	a.allowFullTable = true
+	return a
+}
+
+// Find the first record of the model in the database with a particular id.
+//
+//	q.Find(&User{}, 1)
+func (q *QueryAdapter) Find(model interface{}, id interface{}) error {
+	return mapError(q.q.Find(model, id), model)
+}
+
+// First record of the model in the database that matches the query.
+//
+//	q.Where("name = ?", "mark").First(&User{})
+func (q *QueryAdapter) First(model interface{}) error {
+	return mapError(q.q.First(model), model)
+}
+
+// Last record of the model in the database that matches the query.
+//
+//	q.Where("name = ?", "mark").Last(&User{})
+func (q *QueryAdapter) Last(model interface{}) error {
+	return mapError(q.q.Last(model), model)
+}
+
+// All retrieves all of the records in the database that match the query.
+//
+//	q.Where("name = ?", "mark").All(&[]User{})
+func (q *QueryAdapter) All(models interface{}) error {
+	return mapError(q.q.All(models), models)
+}
+
+// Exists returns true/false if a record exists in the database that matches
+// the query.
+//
+//	q.Where("name = ?", "mark").Exists(&User{})
+func (q *QueryAdapter) Exists(model interface{}) (bool, error) {
+	ok, err := q.q.Exists(model)
+	return ok, mapError(err, model)
+}
+
+// Count the number of records in the database.
+//
+//	q.Where("name = ?", "mark").Count(&User{})
+func (q *QueryAdapter) Count(model interface{}) (int, error) {
+	n, err := q.q.Count(model)
+	return n, mapError(err, model)
+}
+
+// CountByField counts the number of records in the database, for a given field.
+//
+//	q.Where("sex = ?", "f").Count(&User{}, "name")
+func (q *QueryAdapter) CountByField(model interface{}, field string) (int, error) {
+	n, err := q.q.CountByField(model, field)
+	return n, mapError(err, model)
+}
+
+// Select allows to query only fields passed as parameter.
+// c.Select("field1", "field2").All(&model)
+// => SELECT field1, field2 FROM models
+func (q *QueryAdapter) Select(fields ...string) Query {
+	return q.wrap(q.q.Select(fields...))
+}
+
+// Paginate records returned from the database.
+//
+//	q = q.Paginate(2, 15)
+//	q.All(&[]User{})
+//	q.Paginator
+func (q *QueryAdapter) Paginate(page int, perPage int) Query {
+	return q.wrap(q.q.Paginate(page, perPage))
+}
+
+// PaginateFromParams paginates records returned from the database.
+//
+//	q = q.PaginateFromParams(req.URL.Query())
+//	q.All(&[]User{})
+//	q.Paginator
+func (q *QueryAdapter) PaginateFromParams(params pop.PaginationParams) Query {
+	return q.wrap(q.q.PaginateFromParams(params))
+}
+
+// Clone will fill targetQ query with the connection used in q, if
+// targetQ is not empty, Clone will override all the fields. targetQ
+// must be a *QueryAdapter, anything else is left untouched.
+func (q *QueryAdapter) Clone(targetQ Query) {
+	t, ok := targetQ.(*QueryAdapter)
+	if !ok {
+		return
+	}
+	if t.q == nil {
+		t.q = &pop.Query{}
+	}
+	q.q.Clone(t.q)
+	t.allowFullTable = q.allowFullTable
+}
+
+// RawQuery will override the query building feature of Pop and will use
+// whatever query you want to execute against the `Connection`. You can continue
+// to use the `?` argument syntax.
+//
+//	q.RawQuery("select * from foo where id = ?", 1)
+func (q *QueryAdapter) RawQuery(stmt string, args ...interface{}) Query {
+	return q.wrap(q.q.RawQuery(stmt, args...))
+}
+
+// Eager will enable load associations of the model.
+// by defaults loads all the associations on the model,
+// but can take a variadic list of associations to load.
+//
+//	q.Eager().Find(model, 1) // will load all associations for model.
+//	q.Eager("Books").Find(model, 1) // will load only Book association for model.
+func (q *QueryAdapter) Eager(fields ...string) Query {
+	return q.wrap(q.q.Eager(fields...))
+}
+
+// Where will append a where clause to the query. You may use `?` in place of
+// arguments.
+//
+//	q.Where("id = ?", 1)
+//	q.Where("id in (?)", 1, 2, 3)
+func (q *QueryAdapter) Where(stmt string, args ...interface{}) Query {
+	return q.wrap(q.q.Where(stmt, args...))
+}
+
+// Order will append an order clause to the query.
+//
+//	q.Order("name desc")
+func (q *QueryAdapter) Order(stmt string) Query {
+	return q.wrap(q.q.Order(stmt))
+}
+
+// Limit will add a limit clause to the query.
+func (q *QueryAdapter) Limit(limit int) Query {
+	return q.wrap(q.q.Limit(limit))
+}
+
+// ToSQL will generate SQL and the appropriate arguments for that SQL
+// from the `Model` passed in.
+func (q *QueryAdapter) ToSQL(model *pop.Model, addColumns ...string) (string, []interface{}) {
+	return q.q.ToSQL(model, addColumns...)
+}
+
+// Explain runs the EXPLAIN statement of the database for the query built
+// from the model passed in, and returns the plan it reports.
+//
+//	plan, err := q.Where("name = ?", "mark").Explain(&User{})
+//	plan.FullScans()
+func (q *QueryAdapter) Explain(model interface{}) (Plan, error) {
+	plan, err := explain(q.q, model)
+	return plan, mapError(err, model)
+}
+
+// GroupBy will append a GROUP BY clause to the query
+func (q *QueryAdapter) GroupBy(field string, fields ...string) Query {
+	return q.wrap(q.q.GroupBy(field, fields...))
+}
+
+// Having will append a HAVING clause to the query
+func (q *QueryAdapter) Having(condition string, args ...interface{}) Query {
+	return q.wrap(q.q.Having(condition, args...))
+}
+
+// Join will append a JOIN clause to the query
+func (q *QueryAdapter) Join(table string, on string, args ...interface{}) Query {
+	return q.wrap(q.q.Join(table, on, args...))
+}
+
+// LeftJoin will append a LEFT JOIN clause to the query
+func (q *QueryAdapter) LeftJoin(table string, on string, args ...interface{}) Query {
+	return q.wrap(q.q.LeftJoin(table, on, args...))
+}
+
+// RightJoin will append a RIGHT JOIN clause to the query
+func (q *QueryAdapter) RightJoin(table string, on string, args ...interface{}) Query {
+	return q.wrap(q.q.RightJoin(table, on, args...))
+}
+
+// LeftOuterJoin will append a LEFT OUTER JOIN clause to the query
+func (q *QueryAdapter) LeftOuterJoin(table string, on string, args ...interface{}) Query {
+	return q.wrap(q.q.LeftOuterJoin(table, on, args...))
+}
+
+// RightOuterJoin will append a RIGHT OUTER JOIN clause to the query
+func (q *QueryAdapter) RightOuterJoin(table string, on string, args ...interface{}) Query {
+	return q.wrap(q.q.RightOuterJoin(table, on, args...))
+}
+
+// LeftInnerJoin will append an INNER JOIN clause to the query, pop no
+// longer distinguishes left and right inner joins.
+func (q *QueryAdapter) LeftInnerJoin(table string, on string, args ...interface{}) Query {
+	return q.wrap(q.q.InnerJoin(table, on, args...))
+}
+
+// RightInnerJoin will append an INNER JOIN clause to the query, pop no
+// longer distinguishes left and right inner joins.
+func (q *QueryAdapter) RightInnerJoin(table string, on string, args ...interface{}) Query {
+	return q.wrap(q.q.InnerJoin(table, on, args...))
+}
+
+// Scope the query by using a `ScopeFunc`
+//
+//	func ByName(name string) ScopeFunc {
+//		return func(q Query) Query {
+//			return q.Where("name = ?", name)
+//		}
+//	}
+//
+//	func WithDeleted(q *pop.Query) *pop.Query {
+//		return q.Where("deleted_at is null")
+//	}
+//
+//	c.Scope(ByName("mark)).Scope(WithDeleted).First(&User{})
+func (q *QueryAdapter) Scope(sf pop.ScopeFunc) Query {
+	return q.wrap(q.q.Scope(sf))
+}
@@ -23,39 +23,51 @@ func (m *MockQuery) BelongsToThrough(bt, thru interface{}) Query {
 }
 func (m *MockQuery) Exec() error {
 	args := m.Called()
-	return args.Error(0)
+	return mapError(args.Error(0), nil)
 }
 func (m *MockQuery) ExecWithCount() (int, error) {
 	args := m.Called()
-	return args.Int(0), args.Error(1)
+	return args.Int(0), mapError(args.Error(1), nil)
+}
+func (m *MockQuery) UpdateAll(model interface{}, values map[string]interface{}) (int, error) {
+	args := m.Called(model, values)
+	return args.Int(0), mapError(args.Error(1), model)
+}
+func (m *MockQuery) DeleteAll(model interface{}) (int, error) {
+	args := m.Called(model)
+	return args.Int(0), mapError(args.Error(1), model)
+}
+func (m *MockQuery) AllowFullTable() Query {
+	args := m.Called()
+	return args.Get(0).(Query)
 }
 func (m *MockQuery) Find(model interface{}, id interface{}) error {
 	args := m.Called(model, id)
-	return args.Error(0)
+	return mapError(args.Error(0), model)
 }
 func (m *MockQuery) First(model interface{}) error {
 	args := m.Called(model)
-	return args.Error(0)
+	return mapError(args.Error(0), model)
 }
 func (m *MockQuery) Last(model interface{}) error {
 	args := m.Called(model)
-	return args.Error(0)
+	return mapError(args.Error(0), model)
 }
 func (m *MockQuery) All(models interface{}) error {
 	args := m.Called(models)
-	return args.Error(0)
+	return mapError(args.Error(0), models)
 }
 func (m *MockQuery) Exists(model interface{}) (bool, error) {
 	args := m.Called(model)
-	return args.Bool(0), args.Error(1)
+	return args.Bool(0), mapError(args.Error(1), model)
 }
 func (m *MockQuery) Count(model interface{}) (int, error) {
 	args := m.Called(model)
-	return args.Int(0), args.Error(1)
+	return args.Int(0), mapError(args.Error(1), model)
 }
 func (m *MockQuery) CountByField(model interface{}, field string) (int, error) {
 	args := m.Called(model, field)
-	return args.Int(0), args.Error(1)
+	return args.Int(0), mapError(args.Error(1), model)
 }
 func (m *MockQuery) Select(fields ...string) Query {
 	args := m.Called(fields)
@@ -96,6 +108,10 @@ func (m *MockQuery) ToSQL(model *pop.Model, addColumns ...string) (string, []int
 	args := m.Called(model, addColumns)
 	return args.String(0), args.Get(1).([]interface{})
 }
+func (m *MockQuery) Explain(model interface{}) (Plan, error) {
+	args := m.Called(model)
+	return args.Get(0).(Plan), mapError(args.Error(1), model)
+}
 func (m *MockQuery) GroupBy(field string, fields ...string) Query {
 	args := m.Called(field, fields)
 	return args.Get(0).(Query)
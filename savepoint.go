@@ -0,0 +1,73 @@
+package ipop
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+var (
+	savepointCounter   uint64
+	validSavepointName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	errRollbackSavepoint = errors.New("rollback savepoint as planned")
+)
+
+// nextSavepointName returns a savepoint name that is unique within the
+// process, used when transactions are nested.
+func nextSavepointName() string {
+	return fmt.Sprintf("ipop_sp_%d", atomic.AddUint64(&savepointCounter, 1))
+}
+
+// savepoint runs fn between SAVEPOINT and RELEASE SAVEPOINT, rolling back to
+// the savepoint when fn fails or panics. The statements are the same for
+// sqlite, Postgres, CockroachDB and MySQL.
+func savepoint(conn *pop.Connection, name string, fn popCBErr) (err error) {
+	if conn.TX == nil {
+		return ErrNoTransaction
+	}
+	if !validSavepointName.MatchString(name) {
+		return fmt.Errorf("invalid savepoint name %q", name)
+	}
+
+	sp := conn.Dialect.Quote(name)
+	if err := conn.RawQuery("SAVEPOINT " + sp).Exec(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if ex := recover(); ex != nil {
+			_ = conn.RawQuery("ROLLBACK TO SAVEPOINT " + sp).Exec()
+			panic(ex)
+		}
+	}()
+
+	if err = fn(conn); err != nil {
+		if rerr := conn.RawQuery("ROLLBACK TO SAVEPOINT " + sp).Exec(); rerr != nil {
+			return errors.Join(err, fmt.Errorf("database error while rolling back to savepoint %s: %w", name, rerr))
+		}
+		// Postgres keeps a savepoint after rolling back to it
+		if rerr := conn.RawQuery("RELEASE SAVEPOINT " + sp).Exec(); rerr != nil {
+			return errors.Join(err, fmt.Errorf("database error while releasing savepoint %s: %w", name, rerr))
+		}
+		return err
+	}
+
+	return conn.RawQuery("RELEASE SAVEPOINT " + sp).Exec()
+}
+
+// rollbackSavepoint is the savepoint counterpart of pop's Rollback: fn runs
+// inside a savepoint that is always rolled back.
+func rollbackSavepoint(conn *pop.Connection, name string, fn popCB) error {
+	err := savepoint(conn, name, func(tx *pop.Connection) error {
+		fn(tx)
+		return errRollbackSavepoint
+	})
+	if err == errRollbackSavepoint {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,371 @@
+package ipop
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/pop/v6/columns"
+)
+
+// Schema describes the tables of a database, as read from the database
+// itself, a schema dump or models
+type Schema struct {
+	Tables []TableSchema `json:"tables"`
+	// Partial is set for schemas describing only part of the database, such
+	// as the ones built from models: the tables, columns and indexes of the
+	// database they do not mention are not differences.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// Table returns the table named name
+func (s Schema) Table(name string) (TableSchema, bool) {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TableSchema{}, false
+}
+
+// TableSchema describes a table
+type TableSchema struct {
+	Name    string   `json:"name"`
+	Columns []Column `json:"columns"`
+	Indexes []Index  `json:"indexes,omitempty"`
+}
+
+// Column describes a column of a table
+type Column struct {
+	Name string `json:"name"`
+	// Type is the type as declared in the database, or the kind of Go value
+	// for models, such as "string" or "uuid"
+	Type       string `json:"type"`
+	Nullable   bool   `json:"nullable"`
+	PrimaryKey bool   `json:"primary_key,omitempty"`
+}
+
+// Kind returns the kind of values the column holds whatever the database,
+// such as "string", "uuid", "integer", "float", "bool", "timestamp", "blob"
+// or "json"
+func (c Column) Kind() string {
+	return typeFamily(c.Type)
+}
+
+// Index describes an index of a table, those backing the primary key aside
+type Index struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+}
+
+// inspectSchema reads the schema of the database of conn, the migration
+// table aside.
+func inspectSchema(conn Connection) (Schema, error) {
+	inspector := conn.Inspector()
+	var schema Schema
+	tables, err := inspector.Tables()
+	if err != nil {
+		return schema, err
+	}
+	for _, name := range tables {
+		if name == conn.MigrationTableName() {
+			continue
+		}
+		t := TableSchema{Name: name}
+		if t.Columns, err = inspector.Columns(name); err != nil {
+			return schema, err
+		}
+		if t.Indexes, err = inspector.Indexes(name); err != nil {
+			return schema, err
+		}
+		schema.Tables = append(schema.Tables, t)
+	}
+	return schema, nil
+}
+
+var (
+	dumpComments    = regexp.MustCompile(`(?s)--[^\n]*|/\*.*?\*/`)
+	dumpCreateTable = regexp.MustCompile(`(?is)^CREATE\s+(?:TEMP(?:ORARY)?\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?(\S+)\s*\((.*)\)[^)]*$`)
+	dumpCreateIndex = regexp.MustCompile(`(?is)^CREATE\s+(UNIQUE\s+)?INDEX\s+(?:CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?(\S+)\s+ON\s+(?:ONLY\s+)?(\S+)(?:\s+USING\s+\w+)?\s*\((.*)\)`)
+	dumpAddPK       = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(?:ONLY\s+)?(\S+)\s+ADD\s+(?:CONSTRAINT\s+\S+\s+)?PRIMARY\s+KEY\s*\((.*)\)`)
+	dumpTableKey    = regexp.MustCompile(`(?is)^(?:CONSTRAINT\s+\S+\s+)?PRIMARY\s+KEY\s*\((.*)\)`)
+	dumpTableIndex  = regexp.MustCompile(`(?is)^(UNIQUE\s+)?(?:KEY|INDEX)\s+(\S+)\s*\((.*)\)`)
+	dumpConstraint  = regexp.MustCompile(`(?i)^(CONSTRAINT|UNIQUE|FOREIGN|CHECK|FULLTEXT|SPATIAL)\b`)
+	dumpColumnEnd   = regexp.MustCompile(`(?i)\b(NOT\s+NULL|NULL|PRIMARY\s+KEY|DEFAULT|REFERENCES|UNIQUE|CHECK|COLLATE|AUTO_INCREMENT|AUTOINCREMENT|CONSTRAINT|GENERATED|ON\s+UPDATE|CHARACTER\s+SET|COMMENT)\b`)
+	dumpNotNull     = regexp.MustCompile(`(?i)\bNOT\s+NULL\b`)
+	dumpPrimaryKey  = regexp.MustCompile(`(?i)\bPRIMARY\s+KEY\b`)
+	dumpOrder       = regexp.MustCompile(`(?i)\s+(ASC|DESC)$`)
+)
+
+// ParseSchemaDump reads the tables, columns and indexes created by a schema
+// dump, such as the schema.sql written by the migrators of sqlite, pg_dump or
+// mysqldump. Other statements are ignored.
+func ParseSchemaDump(dump string) (Schema, error) {
+	var schema Schema
+	tables := map[string]*TableSchema{}
+	var order []string
+	table := func(name string) *TableSchema {
+		if t, ok := tables[name]; ok {
+			return t
+		}
+		tables[name] = &TableSchema{Name: name}
+		order = append(order, name)
+		return tables[name]
+	}
+
+	for _, stmt := range splitTopLevel(dumpComments.ReplaceAllString(dump, ""), ';') {
+		stmt = strings.TrimSpace(stmt)
+		if m := dumpCreateTable.FindStringSubmatch(stmt); m != nil {
+			t := table(unquoteName(m[1]))
+			for _, def := range splitTopLevel(m[2], ',') {
+				def = strings.TrimSpace(def)
+				switch {
+				case def == "":
+				case dumpTableKey.MatchString(def):
+					for _, col := range splitNames(dumpTableKey.FindStringSubmatch(def)[1]) {
+						markPrimaryKey(t, col)
+					}
+				case dumpTableIndex.MatchString(def):
+					k := dumpTableIndex.FindStringSubmatch(def)
+					t.Indexes = append(t.Indexes, Index{Name: unquoteName(k[2]), Columns: splitNames(k[3]), Unique: k[1] != ""})
+				case dumpConstraint.MatchString(def):
+				default:
+					col, err := parseDumpColumn(def)
+					if err != nil {
+						return schema, fmt.Errorf("table %s: %w", t.Name, err)
+					}
+					t.Columns = append(t.Columns, col)
+				}
+			}
+			continue
+		}
+		if m := dumpCreateIndex.FindStringSubmatch(stmt); m != nil {
+			t := table(unquoteName(m[3]))
+			t.Indexes = append(t.Indexes, Index{Name: unquoteName(m[2]), Columns: splitNames(m[4]), Unique: m[1] != ""})
+			continue
+		}
+		if m := dumpAddPK.FindStringSubmatch(stmt); m != nil {
+			t := table(unquoteName(m[1]))
+			for _, col := range splitNames(m[2]) {
+				markPrimaryKey(t, col)
+			}
+		}
+	}
+
+	for _, name := range order {
+		schema.Tables = append(schema.Tables, *tables[name])
+	}
+	sort.Slice(schema.Tables, func(i, j int) bool { return schema.Tables[i].Name < schema.Tables[j].Name })
+	return schema, nil
+}
+
+func parseDumpColumn(def string) (Column, error) {
+	fields := strings.Fields(def)
+	if len(fields) == 0 {
+		return Column{}, fmt.Errorf("empty column definition")
+	}
+	col := Column{Name: unquoteName(fields[0])}
+	rest := strings.TrimSpace(def[strings.Index(def, fields[0])+len(fields[0]):])
+	col.Type = rest
+	if loc := dumpColumnEnd.FindStringIndex(rest); loc != nil {
+		col.Type = strings.TrimSpace(rest[:loc[0]])
+	}
+	col.PrimaryKey = dumpPrimaryKey.MatchString(rest)
+	col.Nullable = !dumpNotNull.MatchString(rest)
+	return col, nil
+}
+
+func markPrimaryKey(t *TableSchema, column string) {
+	for i := range t.Columns {
+		if t.Columns[i].Name == column {
+			t.Columns[i].PrimaryKey = true
+		}
+	}
+}
+
+// splitTopLevel splits s on sep, outside of parentheses and quotes.
+func splitTopLevel(s string, sep rune) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitNames reads a list of columns, such as `"name", "created_at" DESC`.
+func splitNames(s string) []string {
+	var names []string
+	for _, part := range splitTopLevel(s, ',') {
+		part = dumpOrder.ReplaceAllString(strings.TrimSpace(part), "")
+		if i := strings.Index(part, "("); i > 0 && !strings.HasPrefix(part, "(") {
+			// mysql prefix length, such as name(10)
+			part = part[:i]
+		}
+		names = append(names, unquoteName(part))
+	}
+	return names
+}
+
+// unquoteName strips the quotes and schema of a name, such as
+// public."users".
+func unquoteName(name string) string {
+	parts := splitTopLevel(strings.TrimSpace(name), '.')
+	return strings.Trim(parts[len(parts)-1], "\"`[]")
+}
+
+// SchemaFromModels describes the tables of the given models from their `db`
+// tags. The schema is partial, and has no indexes.
+func SchemaFromModels(models ...interface{}) Schema {
+	schema := Schema{Partial: true}
+	for _, model := range models {
+		t := reflect.TypeOf(model)
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		table := TableSchema{Name: pop.NewModel(reflect.New(t).Interface(), nil).TableName()}
+		for _, f := range modelFields(t) {
+			typ, nullable := goColumnType(f.Type)
+			table.Columns = append(table.Columns, Column{Name: f.Column, Type: typ, Nullable: nullable, PrimaryKey: f.Column == "id"})
+		}
+		schema.Tables = append(schema.Tables, table)
+	}
+	sort.Slice(schema.Tables, func(i, j int) bool { return schema.Tables[i].Name < schema.Tables[j].Name })
+	return schema
+}
+
+// modelField is a field of a model stored in a column
+type modelField struct {
+	reflect.StructField
+	Column string
+}
+
+// modelFields returns the fields of the model type t stored in columns,
+// following pop's rules: a field is stored in the column named by its `db`
+// tag, or by its name when it has no pop tag at all, and the fields of
+// embedded structs are stored as the model's own.
+func modelFields(t reflect.Type) []modelField {
+	var fields []modelField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				fields = append(fields, modelFields(embedded)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := columns.TagsFor(f).Find("db")
+		if tag.Empty() || tag.Ignored() {
+			continue
+		}
+		fields = append(fields, modelField{StructField: f, Column: strings.Split(tag.Value, ",")[0]})
+	}
+	return fields
+}
+
+// goColumnType returns the kind of column holding values of Go type t, and
+// whether they can be NULL.
+func goColumnType(t reflect.Type) (string, bool) {
+	nullable := false
+	if t.Kind() == reflect.Ptr {
+		t, nullable = t.Elem(), true
+	}
+	switch t.String() {
+	case "uuid.UUID":
+		return "uuid", nullable
+	case "time.Time":
+		return "timestamp", nullable
+	case "[]uint8":
+		return "blob", nullable
+	}
+	// nulls.String, sql.NullInt64 and the like hold a value next to Valid
+	if t.Kind() == reflect.Struct && t.NumField() == 2 {
+		if valid, ok := t.FieldByName("Valid"); ok && valid.Type.Kind() == reflect.Bool {
+			for i := 0; i < 2; i++ {
+				if f := t.Field(i); f.Name != "Valid" {
+					typ, _ := goColumnType(f.Type)
+					return typ, true
+				}
+			}
+		}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string", nullable
+	case reflect.Bool:
+		return "bool", nullable
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer", nullable
+	case reflect.Float32, reflect.Float64:
+		return "float", nullable
+	}
+	return t.String(), nullable
+}
+
+// typeFamily groups database and Go types holding the same kind of values,
+// such as VARCHAR(255) and TEXT. Types it does not know are returned as is.
+func typeFamily(typ string) string {
+	t := strings.ToLower(strings.TrimSpace(typ))
+	if strings.HasPrefix(t, "tinyint(1)") {
+		return "bool"
+	}
+	if i := strings.Index(t, "("); i > 0 {
+		t = strings.TrimSpace(t[:i])
+	}
+	switch {
+	case t == "uuid":
+		return "uuid"
+	case strings.Contains(t, "json"):
+		return "json"
+	case strings.Contains(t, "char"), strings.Contains(t, "text"), strings.Contains(t, "clob"), t == "string", t == "enum":
+		return "string"
+	case strings.Contains(t, "bool"):
+		return "bool"
+	case strings.Contains(t, "int"), strings.Contains(t, "serial"):
+		return "integer"
+	case strings.Contains(t, "real"), strings.Contains(t, "floa"), strings.Contains(t, "doub"), strings.Contains(t, "numeric"), strings.Contains(t, "decimal"):
+		return "float"
+	case strings.Contains(t, "date"), strings.Contains(t, "time"):
+		return "timestamp"
+	case strings.Contains(t, "blob"), strings.Contains(t, "bytea"), strings.Contains(t, "binary"):
+		return "blob"
+	}
+	return t
+}
+
+// sameType reports whether columns of types a and b hold the same kind of
+// values. UUIDs are stored as text outside of Postgres.
+func sameType(a, b string) bool {
+	fa, fb := typeFamily(a), typeFamily(b)
+	if fa == fb {
+		return true
+	}
+	return (fa == "uuid" && fb == "string") || (fa == "string" && fb == "uuid")
+}
@@ -0,0 +1,170 @@
+package ipop
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SchemaDiffKind is the kind of a SchemaDifference
+type SchemaDiffKind string
+
+const (
+	// MissingTable is a table expected but not in the database
+	MissingTable SchemaDiffKind = "missing_table"
+	// ExtraTable is a table of the database that is not expected
+	ExtraTable SchemaDiffKind = "extra_table"
+	// MissingColumn is a column expected but not in the database
+	MissingColumn SchemaDiffKind = "missing_column"
+	// ExtraColumn is a column of the database that is not expected
+	ExtraColumn SchemaDiffKind = "extra_column"
+	// TypeMismatch is a column holding another kind of values than expected
+	TypeMismatch SchemaDiffKind = "type_mismatch"
+	// NullabilityMismatch is a column accepting NULL when it should not, or
+	// the other way around
+	NullabilityMismatch SchemaDiffKind = "nullability_mismatch"
+	// MissingIndex is an index expected but not in the database
+	MissingIndex SchemaDiffKind = "missing_index"
+	// ExtraIndex is an index of the database that is not expected
+	ExtraIndex SchemaDiffKind = "extra_index"
+	// IndexMismatch is an index on other columns, or of another uniqueness,
+	// than expected
+	IndexMismatch SchemaDiffKind = "index_mismatch"
+)
+
+// SchemaDifference is a difference between the expected schema and the one
+// of the database. It marshals to JSON for tools to read.
+type SchemaDifference struct {
+	Kind   SchemaDiffKind `json:"kind"`
+	Table  string         `json:"table"`
+	Column string         `json:"column,omitempty"`
+	Index  string         `json:"index,omitempty"`
+	// Expected and Actual describe the differing property, when the
+	// difference is not about something missing
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (d SchemaDifference) String() string {
+	name := d.Table
+	if d.Column != "" {
+		name += "." + d.Column
+	}
+	if d.Index != "" {
+		name += " index " + d.Index
+	}
+	if d.Expected == "" && d.Actual == "" {
+		return fmt.Sprintf("%s: %s", d.Kind, name)
+	}
+	return fmt.Sprintf("%s: %s, expected %s, got %s", d.Kind, name, d.Expected, d.Actual)
+}
+
+// SchemaDiff compares the schema of the database of conn with expected,
+// read from a schema dump with ParseSchemaDump or built from models with
+// SchemaFromModels. It returns the differences in table order, nil when the
+// schemas agree. The migration table is left out.
+//
+// Types are compared by the kind of values they hold, so that VARCHAR(255)
+// matches TEXT, and UUIDs match the text columns they are stored in outside
+// of Postgres. The nullability of primary keys is not compared, databases
+// disagree about it.
+//
+//	expected, _ := ParseSchemaDump(dump)
+//	diffs, err := SchemaDiff(db, expected)
+//	json.NewEncoder(os.Stdout).Encode(diffs)
+func SchemaDiff(conn Connection, expected Schema) ([]SchemaDifference, error) {
+	actual, err := inspectSchema(conn)
+	if err != nil {
+		return nil, err
+	}
+	return diffSchemas(expected, actual, conn.MigrationTableName()), nil
+}
+
+func diffSchemas(expected, actual Schema, ignore string) []SchemaDifference {
+	var diffs []SchemaDifference
+	for _, want := range expected.Tables {
+		if want.Name == ignore {
+			continue
+		}
+		got, ok := actual.Table(want.Name)
+		if !ok {
+			diffs = append(diffs, SchemaDifference{Kind: MissingTable, Table: want.Name})
+			continue
+		}
+		diffs = append(diffs, diffTables(want, got, expected.Partial)...)
+	}
+	if !expected.Partial {
+		for _, got := range actual.Tables {
+			if _, ok := expected.Table(got.Name); !ok && got.Name != ignore {
+				diffs = append(diffs, SchemaDifference{Kind: ExtraTable, Table: got.Name})
+			}
+		}
+	}
+	return diffs
+}
+
+func diffTables(want, got TableSchema, partial bool) []SchemaDifference {
+	var diffs []SchemaDifference
+	columns := map[string]Column{}
+	for _, c := range got.Columns {
+		columns[c.Name] = c
+	}
+	for _, w := range want.Columns {
+		g, ok := columns[w.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, SchemaDifference{Kind: MissingColumn, Table: want.Name, Column: w.Name, Expected: w.Type})
+			continue
+		case !sameType(w.Type, g.Type):
+			diffs = append(diffs, SchemaDifference{Kind: TypeMismatch, Table: want.Name, Column: w.Name, Expected: w.Type, Actual: g.Type})
+		}
+		if w.Nullable != g.Nullable && !w.PrimaryKey && !g.PrimaryKey {
+			diffs = append(diffs, SchemaDifference{Kind: NullabilityMismatch, Table: want.Name, Column: w.Name, Expected: nullability(w.Nullable), Actual: nullability(g.Nullable)})
+		}
+		delete(columns, w.Name)
+	}
+	if !partial {
+		for _, g := range got.Columns {
+			if _, ok := columns[g.Name]; ok {
+				diffs = append(diffs, SchemaDifference{Kind: ExtraColumn, Table: want.Name, Column: g.Name, Actual: g.Type})
+			}
+		}
+	}
+
+	indexes := map[string]Index{}
+	for _, i := range got.Indexes {
+		indexes[i.Name] = i
+	}
+	for _, w := range want.Indexes {
+		g, ok := indexes[w.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, SchemaDifference{Kind: MissingIndex, Table: want.Name, Index: w.Name, Expected: describeIndex(w)})
+		case describeIndex(w) != describeIndex(g):
+			diffs = append(diffs, SchemaDifference{Kind: IndexMismatch, Table: want.Name, Index: w.Name, Expected: describeIndex(w), Actual: describeIndex(g)})
+		}
+		delete(indexes, w.Name)
+	}
+	if !partial {
+		for _, g := range got.Indexes {
+			if _, ok := indexes[g.Name]; ok {
+				diffs = append(diffs, SchemaDifference{Kind: ExtraIndex, Table: want.Name, Index: g.Name, Actual: describeIndex(g)})
+			}
+		}
+	}
+	return diffs
+}
+
+func nullability(nullable bool) string {
+	if nullable {
+		return "NULL"
+	}
+	return "NOT NULL"
+}
+
+func describeIndex(i Index) string {
+	d := "(" + strings.Join(i.Columns, ", ") + ")"
+	if i.Unique {
+		return "UNIQUE " + d
+	}
+	return d
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Project is owned by a User, the factory and fixtures tests load it with its
+// owner and members.
+type Project struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	Name      string    `json:"name" db:"name"`
+	OwnerID   uuid.UUID `json:"owner_id" db:"owner_id"`
+	DueAt     time.Time `json:"due_at" db:"due_at"`
+	Owner     User      `json:"owner" db:"-"`
+	Members   []User    `json:"members" db:"-"`
+}
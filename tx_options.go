@@ -0,0 +1,149 @@
+package ipop
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// TxOptions configures a transaction started with TransactionWith or
+// NewTransactionWith. The zero value gives the same transaction as
+// Transaction and NewTransaction.
+type TxOptions struct {
+	// Isolation is the isolation level, the database default when zero.
+	Isolation sql.IsolationLevel
+	// ReadOnly rejects writes made inside the transaction.
+	ReadOnly bool
+	// Timeout cancels the transaction once it has been running this long.
+	// There is no limit when zero.
+	Timeout time.Duration
+}
+
+var (
+	errNestedTxOptions   = errors.New("transaction options can not be changed inside a transaction")
+	errSQLiteReadOnly    = errors.New("sqlite read only transactions need TransactionWith")
+	errNotNewTransaction = errors.New("only transactions started with NewTransaction or NewTransactionWith are committed or rolled back by hand")
+)
+
+func (o TxOptions) isZero() bool {
+	return o == TxOptions{}
+}
+
+func (o TxOptions) validate() error {
+	if o.Timeout < 0 {
+		return fmt.Errorf("negative transaction timeout %s", o.Timeout)
+	}
+	if o.Isolation < sql.LevelDefault || o.Isolation > sql.LevelLinearizable {
+		return fmt.Errorf("unknown isolation level %d", o.Isolation)
+	}
+	return nil
+}
+
+// nestedOptions checks opts for a transaction nested in another one, which
+// can only inherit the options of the outer transaction.
+func nestedOptions(opts TxOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if !opts.isZero() {
+		return errNestedTxOptions
+	}
+	return nil
+}
+
+func (o TxOptions) sqlOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: o.Isolation, ReadOnly: o.ReadOnly}
+}
+
+// beginWith starts a transaction honouring opts. The returned cancel func
+// releases the context of the transaction and must only be called once the
+// transaction is over.
+func beginWith(conn *pop.Connection, opts TxOptions) (*pop.Connection, context.CancelFunc, error) {
+	if conn.TX != nil {
+		if err := nestedOptions(opts); err != nil {
+			return nil, nil, err
+		}
+		return conn, func() {}, nil
+	}
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := conn.Context(), context.CancelFunc(func() {})
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	}
+
+	cn, err := conn.NewTransactionContextOptions(ctx, opts.sqlOptions())
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return cn, cancel, nil
+}
+
+// sqliteQueryOnly toggles the query_only pragma, sqlite ignores the read only
+// flag of sql.TxOptions. The pragma sticks to the underlying connection so it
+// has to be switched off again before the transaction ends.
+func sqliteQueryOnly(cn *pop.Connection, opts TxOptions, on bool) error {
+	if !opts.ReadOnly || cn.Dialect.Name() != "sqlite3" {
+		return nil
+	}
+	if on {
+		return cn.RawQuery("PRAGMA query_only = 1").Exec()
+	}
+	return cn.RawQuery("PRAGMA query_only = 0").Exec()
+}
+
+// transactionWith is pop's Transaction with options: fn runs in a new
+// transaction that is committed when fn succeeds and rolled back otherwise.
+// Inside a transaction fn runs in a savepoint.
+func transactionWith(conn *pop.Connection, opts TxOptions, fn popCBErr) error {
+	if conn.TX != nil {
+		if err := nestedOptions(opts); err != nil {
+			return err
+		}
+		return savepoint(conn, nextSavepointName(), fn)
+	}
+
+	return conn.Dialect.Lock(func() error {
+		cn, cancel, err := beginWith(conn, opts)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		if err := sqliteQueryOnly(cn, opts, true); err != nil {
+			_ = cn.TX.Rollback()
+			return err
+		}
+
+		defer func() {
+			if ex := recover(); ex != nil {
+				_ = sqliteQueryOnly(cn, opts, false)
+				_ = cn.TX.Rollback()
+				panic(ex)
+			}
+		}()
+
+		err = fn(cn)
+		if ctxErr := cn.Context().Err(); err == nil && ctxErr != nil {
+			err = ctxErr
+		}
+
+		dberr := sqliteQueryOnly(cn, opts, false)
+		if err == nil && dberr == nil {
+			dberr = cn.TX.Commit()
+		} else if rerr := cn.TX.Rollback(); rerr != nil && !errors.Is(rerr, sql.ErrTxDone) && dberr == nil {
+			dberr = rerr
+		}
+		if dberr != nil {
+			return fmt.Errorf("database error on committing or rolling back transaction: %w", dberr)
+		}
+		return err
+	})
+}
@@ -0,0 +1,183 @@
+package ipop
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	createdAtColumn = "created_at"
+	updatedAtColumn = "updated_at"
+)
+
+// upsert inserts model, or updates the row that collides with it on the
+// conflict columns, and then reloads model from the row that ended up in the
+// database.
+func upsert(conn *pop.Connection, model interface{}, conflictColumns []string, updateColumns []string) error {
+	if len(conflictColumns) == 0 {
+		return errors.New("upsert requires at least one conflict column")
+	}
+
+	m := pop.NewModel(model, conn.Context())
+	keyType, err := m.PrimaryKeyType()
+	if err != nil {
+		return err
+	}
+
+	cols := m.Columns()
+	switch keyType {
+	case "int", "int64":
+		cols.Remove(m.IDField())
+	case "UUID":
+		if err := ensureUUID(model); err != nil {
+			return err
+		}
+	}
+	w := cols.Writeable()
+	if keyType != "int" && keyType != "int64" {
+		w.Add(m.IDField())
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	setTimestamp(model, "CreatedAt", now, false)
+	setTimestamp(model, "UpdatedAt", now, true)
+
+	if len(updateColumns) == 0 {
+		skip := map[string]bool{m.IDField(): true, createdAtColumn: true}
+		for _, c := range conflictColumns {
+			skip[c] = true
+		}
+		for _, c := range w.Cols {
+			if !skip[c.Name] {
+				updateColumns = append(updateColumns, c.Name)
+			}
+		}
+	} else if _, ok := w.Cols[updatedAtColumn]; ok && !contains(updateColumns, updatedAtColumn) {
+		updateColumns = append(updateColumns, updatedAtColumn)
+	}
+
+	quoter := conn.Dialect
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s",
+		quoter.Quote(m.TableName()),
+		w.QuotedString(quoter),
+		w.SymbolizedString(),
+		upsertClause(conn.Dialect.Name(), quoter, conflictColumns, updateColumns))
+
+	if _, err := conn.Store.NamedExec(stmt, model); err != nil {
+		return err
+	}
+
+	return reloadByColumns(conn, model, conflictColumns)
+}
+
+// upsertClause builds the dialect specific conflict handling part of an
+// upsert statement.
+func upsertClause(dialect string, quoter interface{ Quote(string) string }, conflictColumns []string, updateColumns []string) string {
+	sets := make([]string, 0, len(updateColumns))
+
+	switch dialect {
+	case "mysql", "mariadb":
+		for _, c := range updateColumns {
+			sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", quoter.Quote(c), quoter.Quote(c)))
+		}
+		if len(sets) == 0 {
+			c := quoter.Quote(conflictColumns[0])
+			sets = append(sets, fmt.Sprintf("%s = %s", c, c))
+		}
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	default:
+		conflicts := make([]string, 0, len(conflictColumns))
+		for _, c := range conflictColumns {
+			conflicts = append(conflicts, quoter.Quote(c))
+		}
+		if len(updateColumns) == 0 {
+			return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(conflicts, ", "))
+		}
+		for _, c := range updateColumns {
+			sets = append(sets, fmt.Sprintf("%s = excluded.%s", quoter.Quote(c), quoter.Quote(c)))
+		}
+		return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(conflicts, ", "), strings.Join(sets, ", "))
+	}
+}
+
+// reloadByColumns fetches model again, matching on the current values of the
+// given columns rather than on its ID.
+func reloadByColumns(conn *pop.Connection, model interface{}, columns []string) error {
+	clauses := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+	for _, c := range columns {
+		v, ok := columnValue(model, c)
+		if !ok {
+			return fmt.Errorf("model %T has no field for column %s", model, c)
+		}
+		clauses = append(clauses, fmt.Sprintf("%s = ?", conn.Dialect.Quote(c)))
+		args = append(args, v)
+	}
+	return conn.Where(strings.Join(clauses, " AND "), args...).First(model)
+}
+
+// columnValue returns the value of the field of model tagged with the given
+// `db` column name.
+func columnValue(model interface{}, column string) (interface{}, bool) {
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("db"), ",")[0]
+		if name == column {
+			return v.Field(i).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// ensureUUID generates a UUID for the ID of model when it is a zero UUID.
+func ensureUUID(model interface{}) error {
+	f := reflect.Indirect(reflect.ValueOf(model)).FieldByName("ID")
+	if !f.IsValid() || !f.CanSet() {
+		return nil
+	}
+	if id, ok := f.Interface().(uuid.UUID); ok && id == uuid.Nil {
+		u, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(u))
+	}
+	return nil
+}
+
+func setTimestamp(model interface{}, field string, now time.Time, overwrite bool) {
+	f := reflect.Indirect(reflect.ValueOf(model)).FieldByName(field)
+	if !f.IsValid() || !f.CanSet() {
+		return
+	}
+	if !overwrite && !f.IsZero() {
+		return
+	}
+	switch f.Kind() {
+	case reflect.Int, reflect.Int64:
+		f.SetInt(now.Unix())
+	default:
+		if f.Type() == reflect.TypeOf(now) {
+			f.Set(reflect.ValueOf(now))
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}